@@ -0,0 +1,565 @@
+package pgredis
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/yob/pgredis/internal/repositories"
+)
+
+const (
+	// the number of entries ACL LOG keeps, like acllog-max-len in redis.conf
+	ACL_LOG_MAX_LEN = 128
+
+	// denials within this many milliseconds of a similar entry update it, rather than adding another
+	ACL_LOG_GROUPING_MAX_TIME_DELTA = 60000
+)
+
+// Every ACL category in redis, even the ones that don't have any commands we support
+var ACL_CATEGORIES = []string{
+	"keyspace", "read", "write", "set", "sortedset", "list", "hash", "string", "bitmap",
+	"hyperloglog", "geo", "stream", "pubsub", "admin", "fast", "slow", "blocking", "dangerous",
+	"connection", "transaction", "scripting",
+}
+
+// A user created with ACL SETUSER. Users are stored in postgres as the rules that ACL LIST
+// prints, and parsed again whenever an instance loads them.
+//
+// Passwords are only kept as SHA256 hashes. allowed is the set of commands the user can run,
+// built by applying the command rules in order.
+type aclUser struct {
+	name            string
+	enabled         bool
+	nopass          bool
+	passwords       []string
+	keyPatterns     []string
+	channelPatterns []string
+	commandRules    []string
+	allowed         map[string]bool
+	commands        map[string]*commandDefinition
+}
+
+// A new user can't do anything until it's given a password and some permissions
+func newAclUser(name string, commands map[string]*commandDefinition) *aclUser {
+	return &aclUser{
+		name:            name,
+		passwords:       []string{},
+		keyPatterns:     []string{},
+		channelPatterns: []string{},
+		commandRules:    []string{"-@all"},
+		allowed:         map[string]bool{},
+		commands:        commands,
+	}
+}
+
+// Build a user from the rules stored in postgres
+func parseAclUser(name string, rules string, commands map[string]*commandDefinition) (*aclUser, error) {
+	user := newAclUser(name, commands)
+	for _, rule := range strings.Fields(rules) {
+		err := user.applyRule(rule)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+// Apply a single ACL SETUSER rule, like on, >password, ~pattern or +@read
+func (user *aclUser) applyRule(rule string) error {
+	switch strings.ToLower(rule) {
+	case "on":
+		user.enabled = true
+	case "off":
+		user.enabled = false
+	case "nopass":
+		user.nopass = true
+		user.passwords = []string{}
+	case "resetpass":
+		user.nopass = false
+		user.passwords = []string{}
+	case "allkeys":
+		return user.applyRule("~*")
+	case "resetkeys":
+		user.keyPatterns = []string{}
+	case "allchannels":
+		return user.applyRule("&*")
+	case "resetchannels":
+		user.channelPatterns = []string{}
+	case "allcommands":
+		return user.applyRule("+@all")
+	case "nocommands":
+		return user.applyRule("-@all")
+	case "reset":
+		for _, resetRule := range []string{"resetpass", "resetkeys", "resetchannels", "off", "-@all"} {
+			user.applyRule(resetRule)
+		}
+	default:
+		if len(rule) == 0 {
+			return fmt.Errorf("Syntax error")
+		}
+		switch rule[0] {
+		case '>':
+			user.addPasswordHash(hashPassword(rule[1:]))
+		case '#':
+			hash := rule[1:]
+			if !isPasswordHash(hash) {
+				return fmt.Errorf("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+			}
+			user.addPasswordHash(hash)
+		case '<', '!':
+			hash := rule[1:]
+			if rule[0] == '<' {
+				hash = hashPassword(rule[1:])
+			}
+			if !user.removePasswordHash(hash) {
+				return fmt.Errorf("The password you are trying to remove from the user does not exist")
+			}
+		case '~':
+			patterns, err := addAclPattern(user.keyPatterns, rule[1:], "allkeys", "resetkeys")
+			if err != nil {
+				return err
+			}
+			user.keyPatterns = patterns
+		case '&':
+			patterns, err := addAclPattern(user.channelPatterns, rule[1:], "allchannels", "resetchannels")
+			if err != nil {
+				return err
+			}
+			user.channelPatterns = patterns
+		case '+', '-':
+			return user.applyCommandRule(rule)
+		default:
+			return fmt.Errorf("Syntax error")
+		}
+	}
+	return nil
+}
+
+// Allow or deny a command (+get, -set) or a category of commands (+@read, -@dangerous)
+func (user *aclUser) applyCommandRule(rule string) error {
+	allow := rule[0] == '+'
+	name := strings.ToLower(rule[1:])
+
+	names := []string{}
+	if name == "@all" {
+		for commandName := range user.commands {
+			names = append(names, commandName)
+		}
+		// allowing or denying everything makes any earlier rules irrelevant
+		user.commandRules = []string{}
+	} else if strings.HasPrefix(name, "@") {
+		if !isAclCategory(name[1:]) {
+			return fmt.Errorf("Unknown command or category name in ACL")
+		}
+		for commandName, definition := range user.commands {
+			if definition.inCategory(name[1:]) {
+				names = append(names, commandName)
+			}
+		}
+	} else {
+		if user.commands[strings.ToUpper(name)] == nil {
+			return fmt.Errorf("Unknown command or category name in ACL")
+		}
+		names = append(names, strings.ToUpper(name))
+	}
+
+	for _, commandName := range names {
+		if allow {
+			user.allowed[commandName] = true
+		} else {
+			delete(user.allowed, commandName)
+		}
+	}
+	user.commandRules = append(user.commandRules, rule[0:1]+name)
+	return nil
+}
+
+func (user *aclUser) addPasswordHash(hash string) {
+	user.nopass = false
+	for _, existing := range user.passwords {
+		if existing == hash {
+			return
+		}
+	}
+	user.passwords = append(user.passwords, hash)
+}
+
+func (user *aclUser) removePasswordHash(hash string) bool {
+	for idx, existing := range user.passwords {
+		if existing == hash {
+			user.passwords = append(user.passwords[:idx], user.passwords[idx+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Add a key or channel pattern. Like redis, a pattern after * is an error as it would have no effect.
+func addAclPattern(patterns []string, pattern string, allFlag string, resetFlag string) ([]string, error) {
+	for _, existing := range patterns {
+		if existing == "*" {
+			return nil, fmt.Errorf("Adding a pattern after the * pattern (or the '%s' flag) is not valid and does not have any effect. Try '%s' to start with an empty list of patterns", allFlag, resetFlag)
+		}
+		if existing == pattern {
+			return patterns, nil
+		}
+	}
+	if pattern == "*" {
+		return []string{"*"}, nil
+	}
+	return append(patterns, pattern), nil
+}
+
+func (user *aclUser) flags() []string {
+	flags := []string{"off"}
+	if user.enabled {
+		flags = []string{"on"}
+	}
+	if user.nopass {
+		flags = append(flags, "nopass")
+	}
+	return flags
+}
+
+// The user's rules in the order ACL LIST prints them. Applying them to a new user gives back an
+// identical user.
+func (user *aclUser) rules() string {
+	rules := user.flags()
+	for _, hash := range user.passwords {
+		rules = append(rules, "#"+hash)
+	}
+	for _, pattern := range user.keyPatterns {
+		rules = append(rules, "~"+pattern)
+	}
+	if len(user.channelPatterns) == 0 {
+		rules = append(rules, "resetchannels")
+	}
+	for _, pattern := range user.channelPatterns {
+		rules = append(rules, "&"+pattern)
+	}
+	rules = append(rules, user.commandRules...)
+	return strings.Join(rules, " ")
+}
+
+func (user *aclUser) canRun(cmd string) bool {
+	return user.allowed[cmd]
+}
+
+func (user *aclUser) canAccessKey(key string) bool {
+	for _, pattern := range user.keyPatterns {
+		if globMatch(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// A PSUBSCRIBE pattern is only allowed if it's identical to one of the user's patterns, as a
+// pattern could match channels the user isn't allowed to see
+func (user *aclUser) canAccessChannel(channel string, isPattern bool) bool {
+	for _, pattern := range user.channelPatterns {
+		if pattern == "*" || pattern == channel || (!isPattern && globMatch(pattern, channel)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (user *aclUser) passwordMatches(password string) bool {
+	if user.nopass {
+		return true
+	}
+	hash := hashPassword(password)
+	for _, existing := range user.passwords {
+		if existing == hash {
+			return true
+		}
+	}
+	return false
+}
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+func isPasswordHash(hash string) bool {
+	return len(hash) == 64 && strings.Trim(hash, "0123456789abcdef") == ""
+}
+
+func isAclCategory(name string) bool {
+	for _, category := range ACL_CATEGORIES {
+		if category == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Every instance caches the users its clients are logged in as, so permissions can be checked
+// without a query for every command. Users are dropped from the cache when a notification says
+// they've changed, and loaded again the next time they're needed.
+//
+// A notification can arrive while a user is being loaded, so the generation goes up whenever
+// users are dropped, and a user loaded in an earlier generation isn't cached.
+type aclUserCache struct {
+	mutex      sync.Mutex
+	users      map[string]*aclUser
+	generation uint64
+}
+
+func newAclUserCache() *aclUserCache {
+	return &aclUserCache{
+		users: map[string]*aclUser{},
+	}
+}
+
+// Return the cached user, or nil and the generation to pass to put once it has been loaded
+func (cache *aclUserCache) get(name string) (*aclUser, uint64) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.users[name], cache.generation
+}
+
+// Cache a user, unless users have been dropped since generation
+func (cache *aclUserCache) put(user *aclUser, generation uint64) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if generation == cache.generation {
+		cache.users[user.name] = user
+	}
+}
+
+func (cache *aclUserCache) forget(name string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	delete(cache.users, name)
+	cache.generation++
+}
+
+// Handle a notification that has the name of a changed user as the payload. If the listening
+// connection was lost we may have missed some changes, so everything is dropped.
+func (cache *aclUserCache) handleNotification(notification *pq.Notification) {
+	if notification == nil {
+		cache.mutex.Lock()
+		cache.users = map[string]*aclUser{}
+		cache.generation++
+		cache.mutex.Unlock()
+		return
+	}
+	cache.forget(notification.Extra)
+}
+
+// Load a user from the database, within a command's transaction. Returns nil if the user doesn't exist.
+func (redis *PgRedis) loadUser(tx repositories.Querier, name string) (*aclUser, error) {
+	exists, rules, err := redis.users.Get(tx, name)
+	if err != nil || !exists {
+		return nil, err
+	}
+	return parseAclUser(name, rules, redis.commands)
+}
+
+// Find a user, from the cache if possible. Returns nil if the user doesn't exist.
+func (redis *PgRedis) findUser(name string) (*aclUser, error) {
+	user, generation := redis.userCache.get(name)
+	if user != nil {
+		return user, nil
+	}
+
+	tx, err := redis.begin(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	user, err = redis.loadUser(tx, name)
+	if err != nil || user == nil {
+		return nil, err
+	}
+	redis.userCache.put(user, generation)
+	return user, nil
+}
+
+// Log a client in as a user, if the password is right and the user is enabled
+func (redis *PgRedis) authenticate(tx repositories.Querier, client *redisClient, name string, password string) error {
+	err := redis.checkCredentials(tx, client, name, password)
+	if err != nil {
+		return err
+	}
+	client.user = name
+	client.authenticated = true
+	return nil
+}
+
+// Check a client could log in as a user, without logging them in
+func (redis *PgRedis) checkCredentials(tx repositories.Querier, client *redisClient, name string, password string) error {
+	user, err := redis.loadUser(tx, name)
+	if err != nil {
+		return err
+	}
+	if user == nil || !user.enabled || !user.passwordMatches(password) {
+		redis.aclLog.add("auth", client.aclContext(), "AUTH", name, client)
+		return newRedisError(WRONGPASS_PREFIX, "invalid username-password pair or user is disabled.")
+	}
+	return nil
+}
+
+// Clients are logged in as the default user when they connect. They're only authenticated if the
+// default user doesn't need a password.
+func (redis *PgRedis) authenticateAsDefault(client *redisClient) {
+	client.user = repositories.DefaultUserName
+	user, err := redis.findUser(repositories.DefaultUserName)
+	client.authenticated = err == nil && user != nil && user.enabled && user.nopass
+}
+
+// Check the client is allowed to run a request, returning the error to send them if they're not.
+// Unknown commands and requests with the wrong number of arguments are left for validateRequest.
+func (redis *PgRedis) checkPermissions(client *redisClient, request *redisRequest) string {
+	definition := redis.commands[request.CommandString()]
+	if definition == nil || !definition.acceptsArgCount(request.ArgCount()) || definition.hasFlag("no_auth") {
+		return ""
+	}
+	if !client.authenticated {
+		return NOAUTH_PREFIX + " Authentication required."
+	}
+
+	user, err := redis.findUser(client.user)
+	if err != nil {
+		return toRedisError(err).Error()
+	}
+	if user == nil {
+		// the user has been deleted since the client logged in, possibly by another instance
+		client.authenticated = false
+		return NOAUTH_PREFIX + " Authentication required."
+	}
+
+	cmdName := strings.ToLower(request.CommandString())
+	if !user.canRun(request.CommandString()) {
+		redis.aclLog.add("command", client.aclContext(), cmdName, user.name, client)
+		return fmt.Sprintf("%s this user has no permissions to run the '%s' command", NOPERM_PREFIX, cmdName)
+	}
+	for _, key := range redis.commandKeys(request) {
+		if !user.canAccessKey(key) {
+			redis.aclLog.add("key", client.aclContext(), key, user.name, client)
+			return NOPERM_PREFIX + " this user has no permissions to access one of the keys used as arguments"
+		}
+	}
+	for _, channel := range requestChannels(request) {
+		if !user.canAccessChannel(channel, request.CommandString() == "PSUBSCRIBE") {
+			redis.aclLog.add("channel", client.aclContext(), channel, user.name, client)
+			return NOPERM_PREFIX + " this user has no permissions to access one of the channels used as arguments"
+		}
+	}
+	return ""
+}
+
+// The pubsub channels (or patterns) a request uses, for checking against a user's channel patterns
+func requestChannels(request *redisRequest) []string {
+	switch request.CommandString() {
+	case "PUBLISH":
+		return request.Args()[1:2]
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		return request.Args()[1:]
+	default:
+		return []string{}
+	}
+}
+
+// A denied command, key, channel or login, as reported by ACL LOG
+type aclLogEntry struct {
+	id         int64
+	count      int64
+	reason     string
+	context    string
+	object     string
+	username   string
+	clientInfo string
+	created    time.Time
+	updated    time.Time
+}
+
+// The most recent ACL denials on this instance, newest first. Like redis, the log is kept in
+// memory and isn't shared with other instances.
+type aclLog struct {
+	mutex   sync.Mutex
+	entries []*aclLogEntry
+	nextId  int64
+}
+
+func newAclLog() *aclLog {
+	return &aclLog{
+		entries: []*aclLogEntry{},
+	}
+}
+
+// Record a denial. A denial that's similar to a recent one updates that entry instead, so a
+// misbehaving client doesn't fill the log.
+func (log *aclLog) add(reason string, context string, object string, username string, client *redisClient) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	now := time.Now()
+	clientInfo := client.info()
+	for idx, entry := range log.entries {
+		similar := entry.reason == reason && entry.context == context && entry.object == object && entry.username == username
+		if similar && now.Sub(entry.updated) < ACL_LOG_GROUPING_MAX_TIME_DELTA*time.Millisecond {
+			entry.count++
+			entry.updated = now
+			entry.clientInfo = clientInfo
+			log.entries = append(append([]*aclLogEntry{entry}, log.entries[:idx]...), log.entries[idx+1:]...)
+			return
+		}
+	}
+
+	entry := &aclLogEntry{
+		id:         log.nextId,
+		count:      1,
+		reason:     reason,
+		context:    context,
+		object:     object,
+		username:   username,
+		clientInfo: clientInfo,
+		created:    now,
+		updated:    now,
+	}
+	log.nextId++
+	log.entries = append([]*aclLogEntry{entry}, log.entries...)
+	if len(log.entries) > ACL_LOG_MAX_LEN {
+		log.entries = log.entries[:ACL_LOG_MAX_LEN]
+	}
+}
+
+func (log *aclLog) latest(count int) []aclLogEntry {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	result := []aclLogEntry{}
+	for idx := 0; idx < count && idx < len(log.entries); idx++ {
+		result = append(result, *log.entries[idx])
+	}
+	return result
+}
+
+func (log *aclLog) reset() {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	log.entries = []*aclLogEntry{}
+}
+
+// The commands in an ACL category, sorted
+func (redis *PgRedis) commandsInCategory(category string) []string {
+	result := []string{}
+	for name, definition := range redis.commands {
+		if definition.inCategory(category) {
+			result = append(result, strings.ToLower(name))
+		}
+	}
+	sort.Strings(result)
+	return result
+}
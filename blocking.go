@@ -0,0 +1,285 @@
+package pgredis
+
+import (
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// blocked clients hold their place in the shared queue for this long, unless they refresh it
+	BLOCKED_CLIENT_LEASE = 30 * time.Second
+
+	// how often blocked clients refresh their place in the queue
+	BLOCKED_CLIENT_REFRESH = 10 * time.Second
+)
+
+// Blocking commands (like BRPOP) make an attempt to complete, and if they can't they release
+// their transaction and wait to be notified that one of their keys has changed. That way a
+// blocked client doesn't hold a database connection, or any locks, while it waits.
+//
+// To be fair to clients that have been waiting longer, a blocked client joins a queue shared by
+// all pgredis instances and won't take a value from a key while an earlier client is waiting on it.
+//
+// It's called with the client's writeMutex held, and releases it while it waits.
+func (redis *PgRedis) executeBlockingCommand(cmdObject blockingRedisCommand, client *redisClient, request redisRequest) bool {
+	timeout, err := cmdObject.timeout(&request)
+	if err != nil {
+		client.reply(newPgRedisErrorFromError(err))
+		return true
+	}
+
+	// register before the first attempt, so a notification that arrives while we're trying isn't missed
+	keys := cmdObject.keysToWaitOn(&request)
+	wakeup := redis.waiters.register(client.db, keys)
+	defer redis.waiters.unregister(client.db, keys, wakeup)
+
+	// we haven't joined the queue yet, so every client in it is ahead of us
+	ticket := int64(math.MaxInt64)
+
+	// a timeout of 0 means block forever, and a nil channel never receives
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	refresh := time.NewTicker(BLOCKED_CLIENT_REFRESH)
+	defer refresh.Stop()
+
+	for {
+		success, result, err := redis.tryBlockingCommand(cmdObject, client, request, ticket)
+		if err != nil {
+			client.reply(newPgRedisErrorFromError(err))
+			redis.leaveBlockedQueue(client, ticket)
+			return true
+		}
+		if success {
+			ew := client.reply(result)
+			if ew != nil {
+				log.Println("Error during command execution, connection closed", ew)
+				return false
+			}
+			return true
+		}
+
+		if ticket == math.MaxInt64 {
+			ticket, err = redis.joinBlockedQueue(client, keys)
+			if err != nil {
+				client.reply(newPgRedisErrorFromError(err))
+				return true
+			}
+		}
+
+		// a RESP3 client can be subscribed while it's blocked, so pubsub messages can be written to
+		// it while it waits
+		closed, stopWatching := client.conn.watch()
+		client.writeMutex.Unlock()
+		timedOut, disconnected, shuttingDown := false, false, false
+		select {
+		case <-wakeup:
+		case <-refresh.C:
+			err = redis.refreshBlockedQueue(client, ticket)
+		case <-deadline:
+			timedOut = true
+		case <-closed:
+			disconnected = true
+		case <-redis.shuttingDown:
+			shuttingDown = true
+		}
+		client.writeMutex.Lock()
+		stopWatching()
+
+		switch {
+		case timedOut:
+			redis.leaveBlockedQueue(client, ticket)
+			client.reply(newPgRedisNilArray())
+			return true
+		case disconnected:
+			redis.leaveBlockedQueue(client, ticket)
+			return false
+		case shuttingDown:
+			redis.leaveBlockedQueue(client, ticket)
+			client.reply(newPgRedisError("ERR server is shutting down"))
+			return true
+		case err != nil:
+			client.reply(newPgRedisErrorFromError(err))
+			redis.leaveBlockedQueue(client, ticket)
+			return true
+		}
+	}
+}
+
+// Make a single attempt to complete a blocking command, in a fresh transaction. Keys that an
+// earlier client in the queue is waiting on are skipped.
+func (redis *PgRedis) tryBlockingCommand(cmdObject blockingRedisCommand, client *redisClient, request redisRequest, ticket int64) (bool, pgRedisValue, error) {
+	tx, err := redis.begin(client)
+	if err != nil {
+		return false, nil, err
+	}
+	defer tx.Rollback()
+
+	err = redis.keys.LockKeys(tx, client.db, redis.keysToLock(&request))
+	if err != nil {
+		return false, nil, err
+	}
+
+	availableKeys := []string{}
+	for _, key := range cmdObject.keysToWaitOn(&request) {
+		earlierWaiter, err := redis.blocked.HasEarlierWaiter(tx, client.db, []byte(key), ticket)
+		if err != nil {
+			return false, nil, err
+		}
+		if !earlierWaiter {
+			availableKeys = append(availableKeys, key)
+		}
+	}
+	if len(availableKeys) == 0 {
+		return false, nil, nil
+	}
+
+	success, result, err := cmdObject.tryExecute(&request, redis, client, tx, availableKeys)
+	if err != nil || !success {
+		return false, nil, err
+	}
+
+	// leave the queue in the same transaction, so the next client in line can't miss its turn
+	if ticket != math.MaxInt64 {
+		err = redis.blocked.Unregister(tx, ticket)
+		if err != nil {
+			return false, nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, nil, err
+	}
+	client.committed()
+	return true, result, nil
+}
+
+func (redis *PgRedis) joinBlockedQueue(client *redisClient, keys []string) (int64, error) {
+	tx, err := redis.begin(client)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	ticket, err := redis.blocked.Register(tx, client.db, keys, BLOCKED_CLIENT_LEASE)
+	if err != nil {
+		return 0, err
+	}
+	return ticket, tx.Commit()
+}
+
+func (redis *PgRedis) refreshBlockedQueue(client *redisClient, ticket int64) error {
+	tx, err := redis.begin(client)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = redis.blocked.Refresh(tx, ticket, BLOCKED_CLIENT_LEASE)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Leave the queue without being served. This is best effort, if it fails our place in the queue
+// will be released when the lease expires.
+func (redis *PgRedis) leaveBlockedQueue(client *redisClient, ticket int64) {
+	if ticket == math.MaxInt64 {
+		return
+	}
+
+	tx, err := redis.begin(client)
+	if err != nil {
+		log.Println("Error leaving blocked client queue: ", err)
+		return
+	}
+	defer tx.Rollback()
+
+	err = redis.blocked.Unregister(tx, ticket)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println("Error leaving blocked client queue: ", err)
+	}
+}
+
+// Parse a blocking command timeout, which is a number of seconds with optional decimal places.
+// 0 means block forever.
+func parseTimeout(value []byte) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(string(value), 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return 0, newErr("timeout is not a float or out of range")
+	}
+	if seconds < 0 {
+		return 0, newErr("timeout is negative")
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// While a client is blocked we aren't reading from its connection, so we wouldn't notice if it
+// disconnected. watchedConn sits between the connection and the protocol parser, and can read
+// from the connection in the background while the client is blocked. Anything read is held for
+// the parser.
+type watchedConn struct {
+	net.Conn
+	pending []byte
+	err     error
+}
+
+func newWatchedConn(conn net.Conn) *watchedConn {
+	return &watchedConn{Conn: conn}
+}
+
+func (c *watchedConn) Read(p []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(p)
+}
+
+// Start reading from the connection in the background. The returned channel is closed if the
+// connection is closed by the client, and the returned function must be called to stop reading
+// before the connection is used again.
+func (c *watchedConn) watch() (<-chan struct{}, func()) {
+	closed := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		buf := make([]byte, 4096)
+		for {
+			n, err := c.Conn.Read(buf)
+			c.pending = append(c.pending, buf[:n]...)
+			if err != nil {
+				netErr, ok := err.(net.Error)
+				if !ok || !netErr.Timeout() {
+					c.err = err
+					close(closed)
+				}
+				return
+			}
+		}
+	}()
+
+	stop := func() {
+		c.Conn.SetReadDeadline(time.Now())
+		<-done
+		c.Conn.SetReadDeadline(time.Time{})
+	}
+	return closed, stop
+}
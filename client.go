@@ -0,0 +1,186 @@
+package pgredis
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/secmask/go-redisproto"
+)
+
+const (
+	// the number of pubsub messages that can be waiting for a slow client before we give up on it
+	MAX_PUBSUB_OUTBOX_SIZE = 1000
+)
+
+// State for a single client connection.
+type redisClient struct {
+	id     uint64
+	conn   *watchedConn
+	buffer *bufio.Writer
+	writer *redisproto.Writer
+
+	// RESP2 or RESP3, as chosen with HELLO
+	protocol int
+
+	// the ACL user the client is logged in as. Until the client is authenticated it can only run
+	// commands with the no_auth flag, like AUTH and HELLO.
+	user          string
+	authenticated bool
+
+	// the state of a transaction started with MULTI. Requests are queued until EXEC, and
+	// multiError is set if any of them are invalid
+	inMulti    bool
+	multiQueue []redisRequest
+	multiError bool
+
+	// the logical database selected with SELECT
+	db int
+
+	// keys the client has WATCHed, their version at the time, and when the first was watched
+	watched   map[dbKey]int64
+	watchedAt time.Time
+
+	// the database connection pinned to this client, or nil if it uses the pool
+	session *dbSession
+
+	// whether read only commands can go to a replica, turned off with READWRITE
+	readFromReplicas bool
+
+	// whether the client has committed a transaction, so WAIT has something to wait for
+	hasWritten bool
+
+	// changes to make once the client's transaction commits, like applying a CONFIG SET to this
+	// instance. They're dropped when the next transaction begins, so a rollback discards them.
+	afterCommit []func()
+
+	// the appendfsync chosen with CLIENT APPENDFSYNC, or blank to use the server's
+	appendfsync string
+
+	// Most writes to the client come from the goroutine handling its requests, but pubsub messages
+	// are written from another goroutine. Both must hold writeMutex.
+	writeMutex sync.Mutex
+
+	// the pubsub channels and patterns the client is subscribed to, and a queue of messages
+	// waiting to be written to it
+	channels map[string]bool
+	patterns map[string]bool
+	outbox   chan pgRedisValue
+}
+
+func newRedisClient(conn net.Conn, id uint64) *redisClient {
+	buffer := bufio.NewWriter(conn)
+	return &redisClient{
+		id:               id,
+		protocol:         RESP2,
+		conn:             newWatchedConn(conn),
+		buffer:           buffer,
+		writer:           redisproto.NewWriter(buffer),
+		multiQueue:       []redisRequest{},
+		watched:          map[dbKey]int64{},
+		channels:         map[string]bool{},
+		patterns:         map[string]bool{},
+		readFromReplicas: true,
+	}
+}
+
+// Write a reply to the client's buffer, in the protocol the client has chosen
+func (client *redisClient) reply(value pgRedisValue) error {
+	return value.writeTo(client.buffer, client.protocol)
+}
+
+// A client that's subscribed to any channels or patterns is in pubsub mode, and can only use a
+// handful of commands
+func (client *redisClient) subscriptionCount() int {
+	return len(client.channels) + len(client.patterns)
+}
+
+// A RESP2 client that's subscribed can only use the commands that change its subscriptions (and
+// PING), as replies would be indistinguishable from messages. RESP3 has a separate type for messages,
+// so RESP3 clients can use any command.
+func (client *redisClient) inPubsubMode() bool {
+	return client.protocol == RESP2 && client.subscriptionCount() > 0
+}
+
+// Queue a pubsub message to be written to the client. This must not block, so if the client
+// isn't reading fast enough to keep up we disconnect it, like redis does.
+func (client *redisClient) deliver(message pgRedisValue) {
+	if client.outbox == nil {
+		return
+	}
+	select {
+	case client.outbox <- message:
+	default:
+		client.conn.Close()
+	}
+}
+
+// Start writing queued pubsub messages to the client. This is called when the client first
+// subscribes, as clients that never subscribe don't need the extra goroutine.
+func (client *redisClient) startDelivery() {
+	if client.outbox != nil {
+		return
+	}
+	client.outbox = make(chan pgRedisValue, MAX_PUBSUB_OUTBOX_SIZE)
+	go func(outbox chan pgRedisValue) {
+		for message := range outbox {
+			client.writeMutex.Lock()
+			client.reply(message)
+			client.buffer.Flush()
+			client.writeMutex.Unlock()
+		}
+	}(client.outbox)
+}
+
+// Stop writing pubsub messages to the client. The client must already be unsubscribed from
+// everything, so no more messages can be queued.
+func (client *redisClient) stopDelivery() {
+	if client.outbox != nil {
+		close(client.outbox)
+	}
+}
+
+// Run a function once the client's transaction commits
+func (client *redisClient) onCommit(change func()) {
+	client.afterCommit = append(client.afterCommit, change)
+}
+
+// Called after each of the client's transactions commits
+func (client *redisClient) committed() {
+	client.hasWritten = true
+	for _, change := range client.afterCommit {
+		change()
+	}
+	client.afterCommit = nil
+}
+
+func (client *redisClient) resetMulti() {
+	client.inMulti = false
+	client.multiQueue = []redisRequest{}
+	client.multiError = false
+}
+
+func (client *redisClient) unwatchAll() {
+	client.watched = map[dbKey]int64{}
+}
+
+// Describe the client for ACL LOG, like a line of CLIENT LIST
+func (client *redisClient) info() string {
+	return fmt.Sprintf("id=%d addr=%s laddr=%s db=%d user=%s", client.id, client.conn.RemoteAddr(), client.conn.LocalAddr(), client.db, client.user)
+}
+
+// Where a denied command was run, for ACL LOG
+func (client *redisClient) aclContext() string {
+	if client.inMulti {
+		return "multi"
+	}
+	return "toplevel"
+}
+
+// A key in one of the logical databases. The same key in two databases is a different key.
+type dbKey struct {
+	db  int
+	key string
+}
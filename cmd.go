@@ -1,23 +1,84 @@
 package pgredis
 
 import (
-	"errors"
-	"fmt"
+	"math"
+	"strconv"
+	"time"
 
-	"database/sql"
+	"github.com/yob/pgredis/internal/repositories"
 )
 
 type redisCommand interface {
-	Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error)
-	keysToLock(command *redisRequest) []string
+	Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error)
 }
 
 type unrecognisedCommand struct{}
 
-func (cmd *unrecognisedCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
-	return nil, errors.New(fmt.Sprintf("Command %s not recognised", command.Get(0)))
+func (cmd *unrecognisedCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	return nil, newErr("unknown command '%s'", command.Get(0))
 }
 
-func (cmd *unrecognisedCommand) keysToLock(command *redisRequest) []string {
-	return []string{}
+// Commands that can block waiting for a key to change (like BRPOP) implement this interface. They
+// don't execute within a single long-running transaction, instead tryExecute is called in a fresh
+// transaction each time one of the keys might have changed, until it succeeds or the timeout
+// passes. tryExecute is given the subset of keysToWaitOn that it may take a value from, in order.
+//
+// timeout should also validate the rest of the arguments, as it's called before any attempt is made.
+//
+// Execute should make a single attempt and return immediately. That's what redis does for blocking
+// commands within MULTI.
+type blockingRedisCommand interface {
+	redisCommand
+	tryExecute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier, keys []string) (bool, pgRedisValue, error)
+	keysToWaitOn(command *redisRequest) []string
+	timeout(command *redisRequest) (time.Duration, error)
+}
+
+// Make a single, non-blocking attempt at a blocking command. If it can't complete, empty is returned
+func executeWithoutBlocking(cmd blockingRedisCommand, command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier, empty pgRedisValue) (pgRedisValue, error) {
+	_, err := cmd.timeout(command)
+	if err != nil {
+		return nil, err
+	}
+	success, result, err := cmd.tryExecute(command, redis, client, tx, cmd.keysToWaitOn(command))
+	if err != nil {
+		return nil, err
+	}
+	if success {
+		return result, nil
+	} else {
+		return empty, nil
+	}
+}
+
+// Parse an integer argument, returning the error redis sends when it's not an integer
+func parseIntArg(arg []byte) (int, error) {
+	value, err := strconv.Atoi(string(arg))
+	if err != nil {
+		return 0, newErr("value is not an integer or out of range")
+	}
+	return value, nil
+}
+
+// Parse a float argument, returning the error redis sends when it's not a float
+func parseFloatArg(arg []byte) (float64, error) {
+	value, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || math.IsNaN(value) {
+		return 0, newErr("value is not a valid float")
+	}
+	return value, nil
+}
+
+// Parse the min or max of a sorted set score range, like 1.5, (1.5 (exclusive), -inf or +inf
+func parseScoreRangeArg(arg []byte) (float64, bool, error) {
+	exclusive := false
+	if len(arg) > 0 && arg[0] == '(' {
+		exclusive = true
+		arg = arg[1:]
+	}
+	value, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || math.IsNaN(value) {
+		return 0, false, newErr("min or max is not a float")
+	}
+	return value, exclusive, nil
 }
@@ -1,23 +1,108 @@
 package pgredis
 
 import (
-	"database/sql"
+	"strconv"
+	"strings"
+
+	"github.com/yob/pgredis/internal/repositories"
 )
 
+type authCommand struct{}
+
+// AUTH [username] password. With just a password, the client logs in as the default user.
+func (cmd *authCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	if command.ArgCount() > 3 {
+		return nil, newSyntaxError()
+	}
+	name := repositories.DefaultUserName
+	password := string(command.Get(1))
+	if command.ArgCount() == 3 {
+		name = string(command.Get(1))
+		password = string(command.Get(2))
+	} else {
+		user, err := redis.loadUser(tx, name)
+		if err != nil {
+			return nil, err
+		}
+		if user != nil && user.nopass {
+			return nil, newErr("AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+		}
+	}
+
+	err := redis.authenticate(tx, client, name, password)
+	if err != nil {
+		return nil, err
+	}
+	return newPgRedisString("OK"), nil
+}
+
 type echoCommand struct{}
 
-func (cmd *echoCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *echoCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	arg := command.Get(1)
 	return newPgRedisString(string(arg)), nil
 }
 
-func (cmd *echoCommand) keysToLock(command *redisRequest) []string {
-	return []string{}
+type helloCommand struct{}
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+//
+// The protocol only changes if the whole command succeeds, and the reply is sent in the new protocol.
+func (cmd *helloCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	protocol := client.protocol
+	if command.ArgCount() > 1 {
+		protover, err := strconv.Atoi(string(command.Get(1)))
+		if err != nil {
+			return nil, newErr("Protocol version is not an integer or out of range")
+		}
+		if protover != RESP2 && protover != RESP3 {
+			return nil, newRedisError(NOPROTO_PREFIX, "unsupported protocol version")
+		}
+		protocol = protover
+	}
+
+	// every option is checked before the client is logged in, so a HELLO that fails changes nothing
+	var authUser, authPassword string
+	auth := false
+	for i := 2; i < command.ArgCount(); i++ {
+		option := strings.ToUpper(string(command.Get(i)))
+		if option == "AUTH" && i+2 < command.ArgCount() {
+			auth = true
+			authUser = string(command.Get(i + 1))
+			authPassword = string(command.Get(i + 2))
+			i += 2
+		} else if option == "SETNAME" && i+1 < command.ArgCount() {
+			// like CLIENT SETNAME, the name is accepted and ignored
+			i += 1
+		} else {
+			return nil, newErr("Syntax error in HELLO option '%s'", command.Get(i))
+		}
+	}
+	if auth {
+		err := redis.checkCredentials(tx, client, authUser, authPassword)
+		if err != nil {
+			return nil, err
+		}
+		client.user = authUser
+		client.authenticated = true
+	} else if !client.authenticated {
+		return nil, newRedisError(NOAUTH_PREFIX, "HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+	}
+	client.protocol = protocol
+	return newPgRedisMap([]pgRedisValue{
+		newPgRedisString("server"), newPgRedisString("redis"),
+		newPgRedisString("version"), newPgRedisString(REDIS_VERSION),
+		newPgRedisString("proto"), newPgRedisInt(int64(protocol)),
+		newPgRedisString("id"), newPgRedisInt(int64(client.id)),
+		newPgRedisString("mode"), newPgRedisString("standalone"),
+		newPgRedisString("role"), newPgRedisString("master"),
+		newPgRedisString("modules"), newPgRedisArray([]pgRedisValue{}),
+	}), nil
 }
 
 type pingCommand struct{}
 
-func (cmd *pingCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *pingCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	arg := command.Get(1)
 	if len(arg) == 0 {
 		return newPgRedisString("PONG"), nil
@@ -26,26 +111,45 @@ func (cmd *pingCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.T
 	}
 }
 
-func (cmd *pingCommand) keysToLock(command *redisRequest) []string {
-	return []string{}
+type quitCommand struct{}
+
+func (cmd *quitCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	return newPgRedisString("OK"), nil
 }
 
-type quitCommand struct{}
+type readonlyCommand struct{}
 
-func (cmd *quitCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *readonlyCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	client.readFromReplicas = true
 	return newPgRedisString("OK"), nil
 }
 
-func (cmd *quitCommand) keysToLock(command *redisRequest) []string {
-	return []string{}
+type readwriteCommand struct{}
+
+func (cmd *readwriteCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	client.readFromReplicas = false
+	return newPgRedisString("OK"), nil
 }
 
 type selectCommand struct{}
 
-func (cmd *selectCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *selectCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	db, err := parseDbIndex(command.Get(1))
+	if err != nil {
+		return nil, err
+	}
+	client.db = db
 	return newPgRedisString("OK"), nil
 }
 
-func (cmd *selectCommand) keysToLock(command *redisRequest) []string {
-	return []string{}
+// Parse the index of a logical database, as used by SELECT, MOVE and SWAPDB
+func parseDbIndex(arg []byte) (int, error) {
+	db, err := strconv.Atoi(string(arg))
+	if err != nil {
+		return 0, newErr("invalid DB index")
+	}
+	if db < 0 || db >= DATABASE_COUNT {
+		return 0, newErr("DB index is out of range")
+	}
+	return db, nil
 }
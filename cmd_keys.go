@@ -1,19 +1,24 @@
 package pgredis
 
 import (
-	"database/sql"
 	"log"
-	"strconv"
+	"math/big"
+	"strings"
+
+	"github.com/yob/pgredis/internal/repositories"
 )
 
+// The number of keys SCAN looks at when the client doesn't send COUNT
+const SCAN_DEFAULT_COUNT = 10
+
 type delCommand struct{}
 
-func (cmd *delCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *delCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	result := int64(0)
 	for i := 1; i < command.ArgCount(); i++ {
 		// TODO calling Delete in a loop like this returns the correct result, but is super
 		//      inefficient. It'd be better to delete them in a single SQL call
-		success, err := redis.keys.Delete(tx, command.Get(i))
+		success, err := redis.keys.Delete(tx, client.db, command.Get(i))
 		if err != nil {
 			log.Println("ERROR: ", err.Error())
 		}
@@ -24,16 +29,12 @@ func (cmd *delCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx
 	return newPgRedisInt(result), nil
 }
 
-func (cmd *delCommand) keysToLock(command *redisRequest) []string {
-	return command.Args()[1:2]
-}
-
 type existsCommand struct{}
 
-func (cmd *existsCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *existsCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	result := int64(0)
 	for i := 1; i < command.ArgCount(); i++ {
-		success, err := redis.keys.Exist(tx, command.Get(i))
+		success, err := redis.keys.Exist(tx, client.db, command.Get(i))
 		if err != nil {
 			log.Println("ERROR: ", err.Error())
 		}
@@ -44,17 +45,16 @@ func (cmd *existsCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql
 	return newPgRedisInt(result), nil
 }
 
-func (cmd *existsCommand) keysToLock(command *redisRequest) []string {
-	return []string{}
-}
-
 type expireCommand struct{}
 
-func (cmd *expireCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *expireCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	key := command.Get(1)
-	seconds, _ := strconv.Atoi(string(command.Get(2)))
+	seconds, err := parseIntArg(command.Get(2))
+	if err != nil {
+		return nil, err
+	}
 
-	success, err := redis.keys.SetExpire(tx, key, seconds)
+	success, err := redis.keys.SetExpire(tx, client.db, key, seconds)
 	if err != nil {
 		log.Println("ERROR: ", err.Error())
 		return newPgRedisInt(0), nil
@@ -66,16 +66,54 @@ func (cmd *expireCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql
 	}
 }
 
-func (cmd *expireCommand) keysToLock(command *redisRequest) []string {
-	return command.Args()[1:2]
+type keysCommand struct{}
+
+func (cmd *keysCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	pattern := string(command.Get(1))
+	filter, exact := globKeyFilter(pattern)
+
+	keys, err := redis.keys.Keys(tx, client.db, filter)
+	if err != nil {
+		return nil, err
+	}
+	return newPgRedisArrayOfStrings(matchingKeys(keys, pattern, exact)), nil
+}
+
+type moveCommand struct{}
+
+func (cmd *moveCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	key := command.Get(1)
+	toDb, err := parseDbIndex(command.Get(2))
+	if err != nil {
+		return nil, err
+	}
+	if toDb == client.db {
+		return nil, newErr("source and destination objects are the same")
+	}
+
+	// the command table only knows about the key in the current database
+	err = redis.keys.LockKeys(tx, toDb, []string{string(key)})
+	if err != nil {
+		return nil, err
+	}
+
+	moved, err := redis.keys.Move(tx, client.db, key, toDb)
+	if err != nil {
+		return nil, err
+	}
+	if moved {
+		return newPgRedisInt(1), nil
+	} else {
+		return newPgRedisInt(0), nil
+	}
 }
 
 type pttlCommand struct{}
 
-func (cmd *pttlCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *pttlCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	key := command.Get(1)
 	// this should probably use KeyRepository and not be string specific
-	keyExists, millis, err := redis.keys.TTLInMillis(tx, key)
+	keyExists, millis, err := redis.keys.TTLInMillis(tx, client.db, key)
 	if err != nil {
 		return nil, err
 	}
@@ -88,37 +126,117 @@ func (cmd *pttlCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.T
 	}
 }
 
-func (cmd *pttlCommand) keysToLock(command *redisRequest) []string {
-	return []string{}
+type scanCommand struct{}
+
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func (cmd *scanCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	after, err := decodeScanCursor(command.Get(1))
+	if err != nil {
+		return nil, err
+	}
+
+	pattern := "*"
+	count := SCAN_DEFAULT_COUNT
+	keyType := ""
+	for idx := 2; idx < command.ArgCount(); idx += 2 {
+		if idx+1 >= command.ArgCount() {
+			return nil, newSyntaxError()
+		}
+		switch strings.ToUpper(string(command.Get(idx))) {
+		case "MATCH":
+			pattern = string(command.Get(idx + 1))
+		case "COUNT":
+			count, err = parseIntArg(command.Get(idx + 1))
+			if err != nil {
+				return nil, err
+			}
+			if count < 1 {
+				return nil, newSyntaxError()
+			}
+		case "TYPE":
+			keyType = strings.ToLower(string(command.Get(idx + 1)))
+		default:
+			return nil, newSyntaxError()
+		}
+	}
+
+	filter, exact := globKeyFilter(pattern)
+	filter.Type = keyType
+
+	keys, last, err := redis.keys.Scan(tx, client.db, after, filter, count)
+	if err != nil {
+		return nil, err
+	}
+
+	return newPgRedisArray([]pgRedisValue{
+		newPgRedisString(encodeScanCursor(last)),
+		newPgRedisArrayOfStrings(matchingKeys(keys, pattern, exact)),
+	}), nil
+}
+
+// SCAN's cursor is the last key the previous page looked at, so any pgredis instance can continue
+// a scan and a cursor can be used more than once. Clients expect cursors to be numbers, so the key
+// is read as a big endian number, after a 1 byte that keeps any leading zero bytes (and makes the
+// empty key 1). The cursor that starts and ends a scan is 0.
+func encodeScanCursor(key []byte) string {
+	if key == nil {
+		return "0"
+	}
+	return new(big.Int).SetBytes(append([]byte{1}, key...)).String()
+}
+
+// The key a scan continues after, or nil to start from the beginning
+func decodeScanCursor(cursor []byte) ([]byte, error) {
+	number, ok := new(big.Int).SetString(string(cursor), 10)
+	if !ok || number.Sign() < 0 {
+		return nil, newErr("invalid cursor")
+	}
+	if number.Sign() == 0 {
+		return nil, nil
+	}
+
+	bytes := number.Bytes()
+	if bytes[0] != 1 {
+		return nil, newErr("invalid cursor")
+	}
+	return bytes[1:], nil
+}
+
+// The keys as strings, skipping any that don't match pattern when the filter that found them
+// wasn't exact
+func matchingKeys(keys [][]byte, pattern string, exact bool) []string {
+	result := []string{}
+	for _, key := range keys {
+		if exact || globMatch(pattern, string(key)) {
+			result = append(result, string(key))
+		}
+	}
+	return result
 }
 
 type ttlCommand struct{}
 
-func (cmd *ttlCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *ttlCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	key := command.Get(1)
-	// this should probably use KeyRepository and not be string specific
-	success, resp, err := redis.strings.Get(tx, key)
+	keyExists, millis, err := redis.keys.TTLInMillis(tx, client.db, key)
 	if err != nil {
 		return nil, err
 	}
-	if success && resp.WillExpire() {
-		return newPgRedisInt(resp.TTLInSeconds()), nil
-	} else if success {
+	if keyExists && millis > 0 {
+		// round to the nearest second, like redis does
+		return newPgRedisInt((millis + 500) / 1000), nil
+	} else if keyExists {
 		return newPgRedisInt(-1), nil // the key exists, but it won't expire
 	} else {
 		return newPgRedisInt(-2), nil // the key didn't exist
 	}
 }
 
-func (cmd *ttlCommand) keysToLock(command *redisRequest) []string {
-	return []string{}
-}
-
 type typeCommand struct{}
 
-func (cmd *typeCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *typeCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	key := command.Get(1)
-	result, err := redis.keys.Type(tx, key)
+	result, err := redis.keys.Type(tx, client.db, key)
 	if err != nil {
 		return nil, err
 	}
@@ -128,7 +246,3 @@ func (cmd *typeCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.T
 		return newPgRedisString("none"), nil
 	}
 }
-
-func (cmd *typeCommand) keysToLock(command *redisRequest) []string {
-	return []string{}
-}
@@ -1,69 +1,191 @@
 package pgredis
 
 import (
-	"database/sql"
-	"fmt"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/yob/pgredis/internal/repositories"
 )
 
-type brpopCommand struct{}
+type blmoveCommand struct{}
 
-// TODO this sleeping approach might work, but it's lame. It'd be neat to use psql NOTIFY
-// to be informed when a list is ready to rpop
-func (cmd *brpopCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
-	listCount := command.ArgCount() - 2
-	listKeys := []string{}
-	for i := 1; i <= listCount; i++ {
-		listKeys = append(listKeys, string(command.Get(i)))
-	}
-	startTime := time.Now()
-	timeout := fmt.Sprintf("%ss", string(command.Get(command.ArgCount()-1)))
-	maxDuration, _ := time.ParseDuration(timeout)
-	for {
-		for _, key := range listKeys {
-			success, value, err := redis.lists.RightPop(tx, []byte(key))
-			if err != nil {
-				return nil, err
-			}
-			if success {
-				items := []string{string(key), string(value)}
-				return newPgRedisArrayOfStrings(items), nil
-			}
-			if time.Since(startTime) > maxDuration {
-				return newPgRedisNilArray(), nil
+func (cmd *blmoveCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	return executeWithoutBlocking(cmd, command, redis, client, tx, newPgRedisNil())
+}
+
+func (cmd *blmoveCommand) tryExecute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier, keys []string) (bool, pgRedisValue, error) {
+	// BLMOVE source destination LEFT|RIGHT LEFT|RIGHT timeout
+	from, _ := parseListDirection(command.Get(3))
+	to, _ := parseListDirection(command.Get(4))
+	return moveBetweenLists(redis, tx, client.db, command.Get(1), command.Get(2), from, to)
+}
+
+func (cmd *blmoveCommand) keysToWaitOn(command *redisRequest) []string {
+	return command.Args()[1:2]
+}
+
+func (cmd *blmoveCommand) timeout(command *redisRequest) (time.Duration, error) {
+	_, err := parseListDirection(command.Get(3))
+	if err != nil {
+		return 0, err
+	}
+	_, err = parseListDirection(command.Get(4))
+	if err != nil {
+		return 0, err
+	}
+	return parseTimeout(command.Get(5))
+}
+
+type blmpopCommand struct{}
+
+func (cmd *blmpopCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	return executeWithoutBlocking(cmd, command, redis, client, tx, newPgRedisNilArray())
+}
+
+func (cmd *blmpopCommand) tryExecute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier, keys []string) (bool, pgRedisValue, error) {
+	_, direction, count, _ := cmd.parseArgs(command)
+	for _, key := range keys {
+		var values [][]byte
+		var err error
+		if direction == "left" {
+			values, err = redis.lists.LeftPopCount(tx, client.db, []byte(key), count)
+		} else {
+			values, err = redis.lists.RightPopCount(tx, client.db, []byte(key), count)
+		}
+		if err != nil {
+			return false, nil, err
+		}
+		if len(values) > 0 {
+			items := make([]string, len(values))
+			for idx, value := range values {
+				items[idx] = string(value)
 			}
+			result := []pgRedisValue{newPgRedisString(key), newPgRedisArrayOfStrings(items)}
+			return true, newPgRedisArray(result), nil
 		}
-		time.Sleep(1 * time.Second)
 	}
+	return false, nil, nil
+}
+
+func (cmd *blmpopCommand) keysToWaitOn(command *redisRequest) []string {
+	keys, _, _, _ := cmd.parseArgs(command)
+	return keys
+}
+
+func (cmd *blmpopCommand) getKeys(command *redisRequest) []string {
+	return cmd.keysToWaitOn(command)
+}
+
+func (cmd *blmpopCommand) timeout(command *redisRequest) (time.Duration, error) {
+	_, _, _, err := cmd.parseArgs(command)
+	if err != nil {
+		return 0, err
+	}
+	return parseTimeout(command.Get(1))
+}
+
+// BLMPOP timeout numkeys key [key ...] LEFT|RIGHT [COUNT count]
+func (cmd *blmpopCommand) parseArgs(command *redisRequest) (keys []string, direction string, count int, err error) {
+	numkeys, err := strconv.Atoi(string(command.Get(2)))
+	if err != nil || numkeys <= 0 {
+		return nil, "", 0, newErr("numkeys should be greater than 0")
+	}
+	if command.ArgCount() < 4+numkeys {
+		return nil, "", 0, newSyntaxError()
+	}
+	keys = command.Args()[3 : 3+numkeys]
+	direction, err = parseListDirection(command.Get(3 + numkeys))
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	count = 1
+	remaining := command.ArgCount() - (4 + numkeys)
+	if remaining == 2 && strings.ToUpper(string(command.Get(4+numkeys))) == "COUNT" {
+		count, err = strconv.Atoi(string(command.Get(5 + numkeys)))
+		if err != nil || count <= 0 {
+			return nil, "", 0, newErr("count should be greater than 0")
+		}
+	} else if remaining != 0 {
+		return nil, "", 0, newSyntaxError()
+	}
+	return keys, direction, count, nil
+}
+
+type blpopCommand struct{}
+
+func (cmd *blpopCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	return executeWithoutBlocking(cmd, command, redis, client, tx, newPgRedisNilArray())
+}
+
+func (cmd *blpopCommand) tryExecute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier, keys []string) (bool, pgRedisValue, error) {
+	return popFromFirstList(redis, tx, client.db, keys, "left")
+}
+
+func (cmd *blpopCommand) keysToWaitOn(command *redisRequest) []string {
+	// BLPOP key [key ...] timeout
+	return command.Args()[1 : command.ArgCount()-1]
+}
+
+func (cmd *blpopCommand) timeout(command *redisRequest) (time.Duration, error) {
+	return parseTimeout(command.Get(command.ArgCount() - 1))
+}
+
+type brpopCommand struct{}
+
+func (cmd *brpopCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	return executeWithoutBlocking(cmd, command, redis, client, tx, newPgRedisNilArray())
+}
+
+func (cmd *brpopCommand) tryExecute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier, keys []string) (bool, pgRedisValue, error) {
+	return popFromFirstList(redis, tx, client.db, keys, "right")
+}
+
+func (cmd *brpopCommand) keysToWaitOn(command *redisRequest) []string {
+	// BRPOP key [key ...] timeout
+	return command.Args()[1 : command.ArgCount()-1]
+}
+
+func (cmd *brpopCommand) timeout(command *redisRequest) (time.Duration, error) {
+	return parseTimeout(command.Get(command.ArgCount() - 1))
+}
+
+type brpoplpushCommand struct{}
+
+func (cmd *brpoplpushCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	return executeWithoutBlocking(cmd, command, redis, client, tx, newPgRedisNil())
+}
+
+func (cmd *brpoplpushCommand) tryExecute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier, keys []string) (bool, pgRedisValue, error) {
+	// BRPOPLPUSH source destination timeout
+	return moveBetweenLists(redis, tx, client.db, command.Get(1), command.Get(2), "right", "left")
+}
+
+func (cmd *brpoplpushCommand) keysToWaitOn(command *redisRequest) []string {
+	return command.Args()[1:2]
 }
 
-func (cmd *brpopCommand) keysToLock(command *redisRequest) []string {
-	// TODO we don't claim any locks here, because we don't want to block other connections
-	//      while we poll. This makes this command open to deadlocks.
-	return []string{}
+func (cmd *brpoplpushCommand) timeout(command *redisRequest) (time.Duration, error) {
+	return parseTimeout(command.Get(3))
 }
 
 type llenCommand struct{}
 
-func (cmd *llenCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *llenCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	key := command.Get(1)
-	length, err := redis.lists.Length(tx, key)
+	length, err := redis.lists.Length(tx, client.db, key)
 	if err != nil {
 		return nil, err
 	}
 	return newPgRedisInt(int64(length)), nil
 }
 
-func (cmd *llenCommand) keysToLock(command *redisRequest) []string {
-	return []string{}
-}
-
 type lpopCommand struct{}
 
-func (cmd *lpopCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *lpopCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	key := command.Get(1)
-	success, value, err := redis.lists.LeftPop(tx, key)
+	success, value, err := redis.lists.LeftPop(tx, client.db, key)
 	if err != nil {
 		return nil, err
 	}
@@ -74,36 +196,34 @@ func (cmd *lpopCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.T
 	}
 }
 
-func (cmd *lpopCommand) keysToLock(command *redisRequest) []string {
-	return command.Args()[1:2]
-}
-
 type lpushCommand struct{}
 
-func (cmd *lpushCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *lpushCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	values := make([][]byte, 0)
 	key := command.Get(1)
 	for i := 2; i < command.ArgCount(); i++ {
 		values = append(values, command.Get(i))
 	}
-	newLength, err := redis.lists.LeftPush(tx, key, values)
+	newLength, err := redis.lists.LeftPush(tx, client.db, key, values)
 	if err != nil {
 		return nil, err
 	}
 	return newPgRedisInt(int64(newLength)), nil
 }
 
-func (cmd *lpushCommand) keysToLock(command *redisRequest) []string {
-	return command.Args()[1:2]
-}
-
 type lrangeCommand struct{}
 
-func (cmd *lrangeCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *lrangeCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	key := command.Get(1)
-	start, _ := strconv.Atoi(string(command.Get(2)))
-	end, _ := strconv.Atoi(string(command.Get(3)))
-	items, err := redis.lists.Lrange(tx, key, start, end)
+	start, err := parseIntArg(command.Get(2))
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseIntArg(command.Get(3))
+	if err != nil {
+		return nil, err
+	}
+	items, err := redis.lists.Lrange(tx, client.db, key, start, end)
 	if err == nil {
 		return newPgRedisArrayOfStrings(items), nil
 	} else {
@@ -111,32 +231,27 @@ func (cmd *lrangeCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql
 	}
 }
 
-func (cmd *lrangeCommand) keysToLock(command *redisRequest) []string {
-	return []string{}
-}
-
 type lremCommand struct{}
 
-func (cmd *lremCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *lremCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	key := command.Get(1)
-	count, _ := strconv.Atoi(string(command.Get(2)))
+	count, err := parseIntArg(command.Get(2))
+	if err != nil {
+		return nil, err
+	}
 	value := command.Get(3)
-	removed_count, err := redis.lists.LeftRemove(tx, key, count, value)
+	removed_count, err := redis.lists.LeftRemove(tx, client.db, key, count, value)
 	if err != nil {
 		return nil, err
 	}
 	return newPgRedisInt(removed_count), nil
 }
 
-func (cmd *lremCommand) keysToLock(command *redisRequest) []string {
-	return command.Args()[1:2]
-}
-
 type rpopCommand struct{}
 
-func (cmd *rpopCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *rpopCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	key := command.Get(1)
-	success, value, err := redis.lists.RightPop(tx, key)
+	success, value, err := redis.lists.RightPop(tx, client.db, key)
 	if err != nil {
 		return nil, err
 	}
@@ -147,25 +262,58 @@ func (cmd *rpopCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.T
 	}
 }
 
-func (cmd *rpopCommand) keysToLock(command *redisRequest) []string {
-	return command.Args()[1:2]
-}
-
 type rpushCommand struct{}
 
-func (cmd *rpushCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *rpushCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	values := make([][]byte, 0)
 	key := command.Get(1)
 	for i := 2; i < command.ArgCount(); i++ {
 		values = append(values, command.Get(i))
 	}
-	newLength, err := redis.lists.RightPush(tx, key, values)
+	newLength, err := redis.lists.RightPush(tx, client.db, key, values)
 	if err != nil {
 		return nil, err
 	}
 	return newPgRedisInt(int64(newLength)), nil
 }
 
-func (cmd *rpushCommand) keysToLock(command *redisRequest) []string {
-	return command.Args()[1:2]
+// pop a single value from the first non-empty list, returning an array of the key and value
+func popFromFirstList(redis *PgRedis, tx repositories.Querier, db int, keys []string, direction string) (bool, pgRedisValue, error) {
+	for _, key := range keys {
+		var success bool
+		var value []byte
+		var err error
+		if direction == "left" {
+			success, value, err = redis.lists.LeftPop(tx, db, []byte(key))
+		} else {
+			success, value, err = redis.lists.RightPop(tx, db, []byte(key))
+		}
+		if err != nil {
+			return false, nil, err
+		}
+		if success {
+			items := []string{key, string(value)}
+			return true, newPgRedisArrayOfStrings(items), nil
+		}
+	}
+	return false, nil, nil
+}
+
+func moveBetweenLists(redis *PgRedis, tx repositories.Querier, db int, source []byte, destination []byte, from string, to string) (bool, pgRedisValue, error) {
+	success, value, err := redis.lists.Move(tx, db, source, destination, from, to)
+	if err != nil || !success {
+		return false, nil, err
+	}
+	return true, newPgRedisString(string(value)), nil
+}
+
+func parseListDirection(value []byte) (string, error) {
+	switch strings.ToUpper(string(value)) {
+	case "LEFT":
+		return "left", nil
+	case "RIGHT":
+		return "right", nil
+	default:
+		return "", newSyntaxError()
+	}
 }
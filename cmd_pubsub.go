@@ -0,0 +1,44 @@
+package pgredis
+
+import (
+	"strings"
+
+	"github.com/yob/pgredis/internal/repositories"
+)
+
+type publishCommand struct{}
+
+func (cmd *publishCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	channel := command.Get(1)
+	message := command.Get(2)
+	err := redis.pubsub.Publish(tx, channel, message)
+	if err != nil {
+		return nil, err
+	}
+	// the message is delivered to subscribers on every pgredis instance, but we can only count the
+	// ones connected to this instance
+	return newPgRedisInt(redis.subscribers.receiverCount(string(channel))), nil
+}
+
+type pubsubCommand struct{}
+
+// The PUBSUB subcommands only report on clients connected to this pgredis instance, much like
+// they only report on a single node in a redis cluster.
+func (cmd *pubsubCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	subcommand := strings.ToUpper(string(command.Get(1)))
+	if subcommand == "CHANNELS" {
+		pattern := string(command.Get(2))
+		return newPgRedisArrayOfStrings(redis.subscribers.channelNames(pattern)), nil
+	} else if subcommand == "NUMSUB" {
+		result := []pgRedisValue{}
+		for _, channel := range command.Args()[2:] {
+			result = append(result, newPgRedisString(channel))
+			result = append(result, newPgRedisInt(redis.subscribers.subscriberCount(channel)))
+		}
+		return newPgRedisArray(result), nil
+	} else if subcommand == "NUMPAT" {
+		return newPgRedisInt(redis.subscribers.patternCount()), nil
+	} else {
+		return nil, newErr("unknown subcommand '%s'", strings.ToLower(subcommand))
+	}
+}
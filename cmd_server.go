@@ -1,15 +1,17 @@
 package pgredis
 
 import (
-	"database/sql"
-	"errors"
 	"fmt"
+	"sort"
 	"strings"
+	"time"
+
+	"github.com/yob/pgredis/internal/repositories"
 )
 
 type flushallCommand struct{}
 
-func (cmd *flushallCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *flushallCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	err := redis.keys.FlushAll(tx)
 	if err != nil {
 		return nil, err
@@ -17,63 +19,400 @@ func (cmd *flushallCommand) Execute(command *redisRequest, redis *PgRedis, tx *s
 	return newPgRedisString("OK"), nil
 }
 
-func (cmd *flushallCommand) keysToLock(command *redisRequest) []string {
-	// TODO do we need to lock on all keys/tables?
-	return []string{}
+type flushdbCommand struct{}
+
+func (cmd *flushdbCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	err := redis.keys.FlushDb(tx, client.db)
+	if err != nil {
+		return nil, err
+	}
+	return newPgRedisString("OK"), nil
+}
+
+type swapdbCommand struct{}
+
+func (cmd *swapdbCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	db, err := parseDbIndex(command.Get(1))
+	if err != nil {
+		return nil, err
+	}
+	otherDb, err := parseDbIndex(command.Get(2))
+	if err != nil {
+		return nil, err
+	}
+	if db != otherDb {
+		err = redis.keys.SwapDb(tx, db, otherDb)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newPgRedisString("OK"), nil
 }
 
 type clientCommand struct{}
 
-func (cmd *clientCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *clientCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	subcommand := strings.ToUpper(string(command.Get(1)))
 	if subcommand == "SETNAME" {
 		return newPgRedisString("OK"), nil
+	} else if subcommand == "APPENDFSYNC" {
+		// like CONFIG SET appendfsync, but just for this connection. default goes back to the server's.
+		if command.ArgCount() != 3 {
+			return nil, newErr("wrong number of arguments for 'client|appendfsync' command")
+		}
+		value := strings.ToLower(string(command.Get(2)))
+		if value == "default" {
+			value = ""
+		} else if !isAppendfsync(value) {
+			return nil, newSyntaxError()
+		}
+		client.appendfsync = value
+		return newPgRedisString("OK"), nil
 	} else {
-		return nil, errors.New(fmt.Sprintf("Unrecognised client subcommand: %s", subcommand))
+		return nil, newErr("unknown subcommand '%s'", strings.ToLower(subcommand))
 	}
 }
 
-func (cmd *clientCommand) keysToLock(command *redisRequest) []string {
-	return []string{}
-}
-
 type dbsizeCommand struct{}
 
-func (cmd *dbsizeCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
-	count, err := redis.keys.Count(tx)
+func (cmd *dbsizeCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	count, err := redis.keys.Count(tx, client.db)
 	if err != nil {
 		return nil, err
 	}
 	return newPgRedisInt(count), nil
 }
 
-func (cmd *dbsizeCommand) keysToLock(command *redisRequest) []string {
-	return []string{}
+type infoCommand struct{}
+
+type infoSection struct {
+	name  string
+	lines []string
 }
 
-type infoCommand struct{}
+func (cmd *infoCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	keyspace, err := redis.keys.Keyspace(tx)
+	if err != nil {
+		return nil, err
+	}
+	keyspaceLines := []string{}
+	for _, info := range keyspace {
+		keyspaceLines = append(keyspaceLines, fmt.Sprintf("db%d:keys=%d,expires=%d,avg_ttl=0", info.Db, info.Keys, info.Expires))
+	}
+
+	sections := []infoSection{
+		{"Server", []string{"redis_version:" + REDIS_VERSION, "uptime_in_days:0"}},
+		{"Clients", []string{"connected_clients:1"}},
+		{"Memory", []string{"used_memory_human:834.12K", "used_memory_peak_human:834.12K"}},
+		{"Persistence", []string{}},
+		{"Stats", []string{fmt.Sprintf("total_connections_received:%d", redis.connCount)}},
+		{"Replication", []string{}},
+		{"CPU", []string{}},
+		{"Cluster", []string{"cluster_enabled:0"}},
+		{"Keyspace", keyspaceLines},
+	}
+
+	// with no argument (or all, default or everything) every section is returned
+	requested := strings.ToLower(string(command.Get(1)))
+	allSections := requested == "" || requested == "all" || requested == "default" || requested == "everything"
 
-func (cmd *infoCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
 	result := make([]string, 0)
-	result = append(result, "# Server")
-	result = append(result, "redis_version:5.0.5")
-	result = append(result, "uptime_in_days:0")
-	result = append(result, "# Clients")
-	result = append(result, "connected_clients:1")
-	result = append(result, "# Memory")
-	result = append(result, "used_memory_human:834.12K")
-	result = append(result, "used_memory_peak_human:834.12K")
-	result = append(result, "# Persistence")
-	result = append(result, "# Stats")
-	result = append(result, fmt.Sprintf("total_connections_received:%d", redis.connCount))
-	result = append(result, "# Replication")
-	result = append(result, "# CPU")
-	result = append(result, "# Cluster")
-	result = append(result, "cluster_enabled:0")
-	result = append(result, "# Keyspace")
+	for _, section := range sections {
+		if allSections || requested == strings.ToLower(section.name) {
+			result = append(result, "# "+section.name)
+			result = append(result, section.lines...)
+		}
+	}
 	return newPgRedisString(strings.Join(result, "\r\n")), nil
 }
 
-func (cmd *infoCommand) keysToLock(command *redisRequest) []string {
-	return []string{}
+type configCommand struct{}
+
+func (cmd *configCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	subcommand := strings.ToUpper(string(command.Get(1)))
+	argCount := command.ArgCount()
+
+	switch {
+	case subcommand == "GET" && argCount >= 3:
+		return newPgRedisMapOfStrings(redis.config.get(command.Args()[2:])), nil
+	case subcommand == "SET" && argCount >= 4 && argCount%2 == 0:
+		apply, err := redis.config.set(tx, command.Args()[2:])
+		if err != nil {
+			return nil, err
+		}
+		client.onCommit(apply)
+		return newPgRedisString("OK"), nil
+	case subcommand == "GET" || subcommand == "SET":
+		return nil, newErr("wrong number of arguments for 'config|%s' command", strings.ToLower(subcommand))
+	default:
+		return nil, newErr("unknown subcommand '%s'. Try CONFIG HELP.", command.Get(1))
+	}
+}
+
+type commandCommand struct{}
+
+// Client libraries use COMMAND to learn which arguments are keys, so they can route requests in a
+// cluster. The answers all come from the command table.
+func (cmd *commandCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	subcommand := strings.ToUpper(string(command.Get(1)))
+	if command.ArgCount() == 1 {
+		result := []pgRedisValue{}
+		for _, name := range redis.commandNames() {
+			result = append(result, commandInfo(name, redis.commands[name]))
+		}
+		return newPgRedisArray(result), nil
+	} else if subcommand == "COUNT" {
+		return newPgRedisInt(int64(len(redis.commands))), nil
+	} else if subcommand == "INFO" {
+		names := command.Args()[2:]
+		if len(names) == 0 {
+			names = redis.commandNames()
+		}
+		result := []pgRedisValue{}
+		for _, name := range names {
+			definition := redis.commands[strings.ToUpper(name)]
+			if definition == nil {
+				result = append(result, newPgRedisNil())
+			} else {
+				result = append(result, commandInfo(name, definition))
+			}
+		}
+		return newPgRedisArray(result), nil
+	} else if subcommand == "DOCS" {
+		names := command.Args()[2:]
+		if len(names) == 0 {
+			names = redis.commandNames()
+		}
+		result := []pgRedisValue{}
+		for _, name := range names {
+			definition := redis.commands[strings.ToUpper(name)]
+			if definition != nil {
+				result = append(result, newPgRedisString(strings.ToLower(name)))
+				result = append(result, newPgRedisMapOfStrings([]string{"summary", definition.summary, "group", definition.group}))
+			}
+		}
+		return newPgRedisMap(result), nil
+	} else if subcommand == "GETKEYS" {
+		return cmd.getKeys(command, redis)
+	} else {
+		return nil, newErr("unknown subcommand '%s'", strings.ToLower(subcommand))
+	}
+}
+
+// COMMAND GETKEYS command [arg ...]
+func (cmd *commandCommand) getKeys(command *redisRequest, redis *PgRedis) (pgRedisValue, error) {
+	if command.ArgCount() < 3 {
+		return nil, newErr("wrong number of arguments for 'command|getkeys' command")
+	}
+	request := newRequestFromArgs(command.Args()[2:])
+	definition := redis.commands[request.CommandString()]
+	if definition == nil {
+		return nil, newErr("Invalid command specified")
+	} else if !definition.acceptsArgCount(request.ArgCount()) {
+		return nil, newErr("Invalid number of arguments specified for command")
+	}
+	keys := redis.commandKeys(&request)
+	if len(keys) == 0 {
+		return nil, newErr("The command has no key arguments")
+	}
+	return newPgRedisArrayOfStrings(keys), nil
+}
+
+func (redis *PgRedis) commandNames() []string {
+	names := make([]string, 0, len(redis.commands))
+	for name := range redis.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The reply COMMAND INFO has for each command. The last three elements are the tips, key specs and
+// subcommands, which we don't describe yet.
+func commandInfo(name string, definition *commandDefinition) pgRedisValue {
+	categories := []string{}
+	for _, category := range definition.categories() {
+		categories = append(categories, "@"+category)
+	}
+	return newPgRedisArray([]pgRedisValue{
+		newPgRedisString(strings.ToLower(name)),
+		newPgRedisInt(int64(definition.arity)),
+		newPgRedisArrayOfStrings(definition.flags),
+		newPgRedisInt(int64(definition.firstKey)),
+		newPgRedisInt(int64(definition.lastKey)),
+		newPgRedisInt(int64(definition.step)),
+		newPgRedisArrayOfStrings(categories),
+		newPgRedisArray([]pgRedisValue{}),
+		newPgRedisArray([]pgRedisValue{}),
+		newPgRedisArray([]pgRedisValue{}),
+	})
+}
+
+type aclCommand struct{}
+
+func (cmd *aclCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	subcommand := strings.ToUpper(string(command.Get(1)))
+	argCount := command.ArgCount()
+
+	switch {
+	case subcommand == "SETUSER" && argCount >= 3:
+		return cmd.setUser(command, redis, tx)
+	case subcommand == "GETUSER" && argCount == 3:
+		return cmd.getUser(command, redis, tx)
+	case subcommand == "DELUSER" && argCount >= 3:
+		return cmd.delUser(command, redis, tx)
+	case subcommand == "LIST" && argCount == 2:
+		users, err := redis.users.List(tx)
+		if err != nil {
+			return nil, err
+		}
+		result := []string{}
+		for _, user := range users {
+			result = append(result, "user "+user.Name+" "+user.Rules)
+		}
+		return newPgRedisArrayOfStrings(result), nil
+	case subcommand == "USERS" && argCount == 2:
+		users, err := redis.users.List(tx)
+		if err != nil {
+			return nil, err
+		}
+		result := []string{}
+		for _, user := range users {
+			result = append(result, user.Name)
+		}
+		return newPgRedisArrayOfStrings(result), nil
+	case subcommand == "WHOAMI" && argCount == 2:
+		return newPgRedisString(client.user), nil
+	case subcommand == "CAT" && argCount == 2:
+		return newPgRedisArrayOfStrings(ACL_CATEGORIES), nil
+	case subcommand == "CAT" && argCount == 3:
+		category := strings.ToLower(string(command.Get(2)))
+		if !isAclCategory(category) {
+			return nil, newErr("Unknown category '%s'", command.Get(2))
+		}
+		return newPgRedisArrayOfStrings(redis.commandsInCategory(category)), nil
+	case subcommand == "LOG" && argCount <= 3:
+		return cmd.log(command, redis)
+	case subcommand == "SETUSER" || subcommand == "GETUSER" || subcommand == "DELUSER" || subcommand == "LIST" ||
+		subcommand == "USERS" || subcommand == "WHOAMI" || subcommand == "CAT" || subcommand == "LOG":
+		return nil, newErr("wrong number of arguments for 'acl|%s' command", strings.ToLower(subcommand))
+	default:
+		return nil, newErr("unknown subcommand '%s'. Try ACL HELP.", command.Get(1))
+	}
+}
+
+// ACL SETUSER username [rule [rule ...]]
+func (cmd *aclCommand) setUser(command *redisRequest, redis *PgRedis, tx repositories.Querier) (pgRedisValue, error) {
+	name := string(command.Get(2))
+
+	// changes to a user are read-modify-write, so concurrent changes to the same user must queue
+	err := redis.users.Lock(tx, name)
+	if err != nil {
+		return nil, err
+	}
+	user, err := redis.loadUser(tx, name)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		user = newAclUser(name, redis.commands)
+	}
+
+	for _, rule := range command.Args()[3:] {
+		err = user.applyRule(rule)
+		if err != nil {
+			return nil, newErr("Error in ACL SETUSER modifier '%s': %s", rule, err)
+		}
+	}
+
+	err = redis.users.Save(tx, name, user.rules())
+	if err != nil {
+		return nil, err
+	}
+	// other instances hear about the change when the transaction commits, but clients of this
+	// instance shouldn't have to wait for the notification
+	redis.userCache.forget(name)
+	return newPgRedisString("OK"), nil
+}
+
+// ACL GETUSER username
+func (cmd *aclCommand) getUser(command *redisRequest, redis *PgRedis, tx repositories.Querier) (pgRedisValue, error) {
+	user, err := redis.loadUser(tx, string(command.Get(2)))
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return newPgRedisNil(), nil
+	}
+
+	keys := []string{}
+	for _, pattern := range user.keyPatterns {
+		keys = append(keys, "~"+pattern)
+	}
+	channels := []string{}
+	for _, pattern := range user.channelPatterns {
+		channels = append(channels, "&"+pattern)
+	}
+	return newPgRedisMap([]pgRedisValue{
+		newPgRedisString("flags"), newPgRedisArrayOfStrings(user.flags()),
+		newPgRedisString("passwords"), newPgRedisArrayOfStrings(user.passwords),
+		newPgRedisString("commands"), newPgRedisString(strings.Join(user.commandRules, " ")),
+		newPgRedisString("keys"), newPgRedisString(strings.Join(keys, " ")),
+		newPgRedisString("channels"), newPgRedisString(strings.Join(channels, " ")),
+		newPgRedisString("selectors"), newPgRedisArray([]pgRedisValue{}),
+	}), nil
+}
+
+// ACL DELUSER username [username ...]
+func (cmd *aclCommand) delUser(command *redisRequest, redis *PgRedis, tx repositories.Querier) (pgRedisValue, error) {
+	names := command.Args()[2:]
+	for _, name := range names {
+		if name == repositories.DefaultUserName {
+			return nil, newErr("The '%s' user cannot be removed", repositories.DefaultUserName)
+		}
+	}
+
+	count, err := redis.users.Delete(tx, names)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		redis.userCache.forget(name)
+	}
+	return newPgRedisInt(count), nil
+}
+
+// ACL LOG [count | RESET]
+func (cmd *aclCommand) log(command *redisRequest, redis *PgRedis) (pgRedisValue, error) {
+	count := 10
+	if command.ArgCount() == 3 {
+		if strings.ToUpper(string(command.Get(2))) == "RESET" {
+			redis.aclLog.reset()
+			return newPgRedisString("OK"), nil
+		}
+		var err error
+		count, err = parseIntArg(command.Get(2))
+		if err != nil || count < 0 {
+			return nil, newErr("value is out of range, must be positive")
+		}
+	}
+
+	now := time.Now()
+	result := []pgRedisValue{}
+	for _, entry := range redis.aclLog.latest(count) {
+		age := float64(now.Sub(entry.created).Milliseconds()) / 1000
+		result = append(result, newPgRedisMap([]pgRedisValue{
+			newPgRedisString("count"), newPgRedisInt(entry.count),
+			newPgRedisString("reason"), newPgRedisString(entry.reason),
+			newPgRedisString("context"), newPgRedisString(entry.context),
+			newPgRedisString("object"), newPgRedisString(entry.object),
+			newPgRedisString("username"), newPgRedisString(entry.username),
+			newPgRedisString("age-seconds"), newPgRedisDouble(age),
+			newPgRedisString("client-info"), newPgRedisString(entry.clientInfo),
+			newPgRedisString("entry-id"), newPgRedisInt(entry.id),
+			newPgRedisString("timestamp-created"), newPgRedisInt(entry.created.UnixNano() / int64(time.Millisecond)),
+			newPgRedisString("timestamp-last-updated"), newPgRedisInt(entry.updated.UnixNano() / int64(time.Millisecond)),
+		}))
+	}
+	return newPgRedisArray(result), nil
 }
@@ -2,29 +2,25 @@ package pgredis
 
 import (
 	"bytes"
-	"database/sql"
 	"log"
 	"strconv"
 
 	"github.com/32bitkid/bitreader"
+	"github.com/yob/pgredis/internal/repositories"
 )
 
 type appendCommand struct{}
 
-func (cmd *appendCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *appendCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	key := command.Get(1)
 	value := command.Get(2)
-	newValue, err := redis.strings.InsertOrAppend(tx, key, value)
+	newValue, err := redis.strings.InsertOrAppend(tx, client.db, key, value)
 	if err != nil {
 		return nil, err
 	}
 	return newPgRedisInt(int64(len(newValue))), nil
 }
 
-func (cmd *appendCommand) keysToLock(command *redisRequest) []string {
-	return command.Args()[1:2]
-}
-
 type bitcountCommand struct{}
 
 func intOrZero(value string) int {
@@ -39,18 +35,29 @@ func intOrZero(value string) int {
 	}
 }
 
-func (cmd *bitcountCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *bitcountCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	key := command.Get(1)
-	success, result, err := redis.strings.Get(tx, key)
+	start, end := 0, -1
+	if command.ArgCount() == 4 {
+		var err error
+		start, err = parseIntArg(command.Get(2))
+		if err != nil {
+			return nil, err
+		}
+		end, err = parseIntArg(command.Get(3))
+		if err != nil {
+			return nil, err
+		}
+	} else if command.ArgCount() != 2 {
+		return nil, newSyntaxError()
+	}
+	success, result, err := redis.strings.Get(tx, client.db, key)
 
 	if err != nil {
 		log.Println("ERROR: ", err.Error())
 		return newPgRedisInt(0), nil // TODO probbly not right
 	}
 	if success {
-		start, _ := strconv.Atoi(string(command.Get(2)))
-		end, _ := strconv.Atoi(string(command.Get(3)))
-
 		if start < 0 {
 			start = len(result.Value) + start
 		}
@@ -94,15 +101,11 @@ func (cmd *bitcountCommand) Execute(command *redisRequest, redis *PgRedis, tx *s
 	}
 }
 
-func (cmd *bitcountCommand) keysToLock(command *redisRequest) []string {
-	return []string{}
-}
-
 type decrCommand struct{}
 
-func (cmd *decrCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *decrCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	key := command.Get(1)
-	newValue, err := redis.strings.Incr(tx, key, -1)
+	newValue, err := redis.strings.Incr(tx, client.db, key, -1)
 	if err != nil {
 		return nil, err
 	}
@@ -110,16 +113,15 @@ func (cmd *decrCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.T
 	return newPgRedisInt(int64(intValue)), nil
 }
 
-func (cmd *decrCommand) keysToLock(command *redisRequest) []string {
-	return command.Args()[1:2]
-}
-
 type decrbyCommand struct{}
 
-func (cmd *decrbyCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *decrbyCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	key := command.Get(1)
-	by, _ := strconv.Atoi(string(command.Get(2)))
-	newValue, err := redis.strings.Incr(tx, key, by*-1)
+	by, err := parseIntArg(command.Get(2))
+	if err != nil {
+		return nil, err
+	}
+	newValue, err := redis.strings.Incr(tx, client.db, key, by*-1)
 	if err != nil {
 		return nil, err
 	}
@@ -127,14 +129,10 @@ func (cmd *decrbyCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql
 	return newPgRedisInt(int64(intValue)), nil
 }
 
-func (cmd *decrbyCommand) keysToLock(command *redisRequest) []string {
-	return command.Args()[1:2]
-}
-
 type getCommand struct{}
 
-func (cmd *getCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
-	success, resp, err := redis.strings.Get(tx, command.Get(1))
+func (cmd *getCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	success, resp, err := redis.strings.Get(tx, client.db, command.Get(1))
 	if err != nil {
 		return nil, err
 	}
@@ -145,15 +143,14 @@ func (cmd *getCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx
 	}
 }
 
-func (cmd *getCommand) keysToLock(command *redisRequest) []string {
-	return []string{}
-}
-
 type getbitCommand struct{}
 
-func (cmd *getbitCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
-	success, resp, err := redis.strings.Get(tx, command.Get(1))
-	bitPosition, _ := strconv.Atoi(string(command.Get(2)))
+func (cmd *getbitCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	bitPosition, err := parseIntArg(command.Get(2))
+	if err != nil || bitPosition < 0 {
+		return nil, newErr("bit offset is not an integer or out of range")
+	}
+	success, resp, err := redis.strings.Get(tx, client.db, command.Get(1))
 
 	if err != nil {
 		log.Println("ERROR: ", err.Error())
@@ -178,21 +175,17 @@ func (cmd *getbitCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql
 	}
 }
 
-func (cmd *getbitCommand) keysToLock(command *redisRequest) []string {
-	return []string{}
-}
-
 type getsetCommand struct{}
 
-func (cmd *getsetCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *getsetCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	expiry_millis := 0
-	getSuccess, resp, err := redis.strings.Get(tx, command.Get(1))
+	getSuccess, resp, err := redis.strings.Get(tx, client.db, command.Get(1))
 
 	if err != nil {
 		return nil, err
 	}
 
-	insertErr := redis.strings.InsertOrUpdate(tx, command.Get(1), command.Get(2), expiry_millis)
+	insertErr := redis.strings.InsertOrUpdate(tx, client.db, command.Get(1), command.Get(2), expiry_millis)
 	if insertErr != nil {
 		return nil, err
 	}
@@ -203,21 +196,22 @@ func (cmd *getsetCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql
 	}
 }
 
-func (cmd *getsetCommand) keysToLock(command *redisRequest) []string {
-	return command.Args()[1:2]
-}
-
 type getrangeCommand struct{}
 
-func (cmd *getrangeCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
-	success, result, err := redis.strings.Get(tx, command.Get(1))
+func (cmd *getrangeCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	start, err := parseIntArg(command.Get(2))
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseIntArg(command.Get(3))
+	if err != nil {
+		return nil, err
+	}
+	success, result, err := redis.strings.Get(tx, client.db, command.Get(1))
 	if err != nil {
 		return nil, err
 	}
 	if success {
-		start, _ := strconv.Atoi(string(command.Get(2)))
-		end, _ := strconv.Atoi(string(command.Get(3)))
-
 		if start < 0 {
 			start = len(result.Value) + start
 		}
@@ -246,15 +240,11 @@ func (cmd *getrangeCommand) Execute(command *redisRequest, redis *PgRedis, tx *s
 	}
 }
 
-func (cmd *getrangeCommand) keysToLock(command *redisRequest) []string {
-	return []string{}
-}
-
 type incrCommand struct{}
 
-func (cmd *incrCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *incrCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	key := command.Get(1)
-	newValue, err := redis.strings.Incr(tx, key, 1)
+	newValue, err := redis.strings.Incr(tx, client.db, key, 1)
 	if err != nil {
 		return nil, err
 	}
@@ -262,16 +252,15 @@ func (cmd *incrCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.T
 	return newPgRedisInt(int64(intValue)), nil
 }
 
-func (cmd *incrCommand) keysToLock(command *redisRequest) []string {
-	return command.Args()[1:2]
-}
-
 type incrbyCommand struct{}
 
-func (cmd *incrbyCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *incrbyCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	key := command.Get(1)
-	by, _ := strconv.Atoi(string(command.Get(2)))
-	newValue, err := redis.strings.Incr(tx, key, by)
+	by, err := parseIntArg(command.Get(2))
+	if err != nil {
+		return nil, err
+	}
+	newValue, err := redis.strings.Incr(tx, client.db, key, by)
 	if err != nil {
 		return nil, err
 	}
@@ -279,34 +268,29 @@ func (cmd *incrbyCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql
 	return newPgRedisInt(int64(intValue)), nil
 }
 
-func (cmd *incrbyCommand) keysToLock(command *redisRequest) []string {
-	return command.Args()[1:2]
-}
-
 type incrbyfloatCommand struct{}
 
-func (cmd *incrbyfloatCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *incrbyfloatCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	key := command.Get(1)
-	by, _ := strconv.ParseFloat(string(command.Get(2)), 64)
-	newValue, err := redis.strings.IncrDecimal(tx, key, by)
+	by, err := parseFloatArg(command.Get(2))
+	if err != nil {
+		return nil, err
+	}
+	newValue, err := redis.strings.IncrDecimal(tx, client.db, key, by)
 	if err != nil {
 		return nil, err
 	}
 	return newPgRedisString(string(newValue)), nil
 }
 
-func (cmd *incrbyfloatCommand) keysToLock(command *redisRequest) []string {
-	return command.Args()[1:2]
-}
-
 type mgetCommand struct{}
 
-func (cmd *mgetCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *mgetCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	result := make([]pgRedisValue, command.ArgCount()-1)
 	for i := 1; i < command.ArgCount(); i++ {
 		// TODO calling getStrings in a loop like this returns the correct result, but is super
 		//      inefficient
-		success, resp, _ := redis.strings.Get(tx, command.Get(i))
+		success, resp, _ := redis.strings.Get(tx, client.db, command.Get(i))
 		if success {
 			result[i-1] = newPgRedisString(string(resp.Value))
 		} else {
@@ -316,40 +300,25 @@ func (cmd *mgetCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.T
 	return newPgRedisArray(result), nil
 }
 
-func (cmd *mgetCommand) keysToLock(command *redisRequest) []string {
-	return []string{}
-}
-
 type msetCommand struct{}
 
-func (cmd *msetCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *msetCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	// TODO Using string because I can't use byte slices as a map key, but this probably breaks
 	// some compatibility with redis
 	items := make(map[string]string)
 	for i := 1; i < command.ArgCount(); i += 2 {
 		items[string(command.Get(i))] = string(command.Get(i + 1))
 	}
-	err := redis.strings.InsertOrUpdateMultiple(tx, items)
+	err := redis.strings.InsertOrUpdateMultiple(tx, client.db, items)
 	if err != nil {
 		return nil, err
 	}
 	return newPgRedisString("OK"), nil
 }
 
-func (cmd *msetCommand) keysToLock(command *redisRequest) []string {
-	// MSET foo 1 bar 2 => {foo, bar}
-	result := []string{}
-	for i, arg := range command.Args()[1:] {
-		if i%2 == 0 {
-			result = append(result, arg)
-		}
-	}
-	return result
-}
-
 type setCommand struct{}
 
-func (cmd *setCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *setCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	expiry_millis := 0
 	exValue := commandExValueInMillis(command)
 	if exValue > 0 {
@@ -363,7 +332,7 @@ func (cmd *setCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx
 	xxArgProvided := commandHasValue(command, "XX")
 	nxArgProvided := commandHasValue(command, "NX")
 	if xxArgProvided { // only set the key if it already exists
-		updated, err := redis.strings.UpdateOrSkip(tx, command.Get(1), command.Get(2), expiry_millis)
+		updated, err := redis.strings.UpdateOrSkip(tx, client.db, command.Get(1), command.Get(2), expiry_millis)
 		if err != nil {
 			return nil, err
 		}
@@ -373,7 +342,7 @@ func (cmd *setCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx
 			return newPgRedisNil(), nil
 		}
 	} else if nxArgProvided { // only set the key if it doesn't already exists
-		updated, err := redis.strings.InsertOrSkip(tx, command.Get(1), command.Get(2), expiry_millis)
+		updated, err := redis.strings.InsertOrSkip(tx, client.db, command.Get(1), command.Get(2), expiry_millis)
 		if err != nil {
 			return nil, err
 		}
@@ -383,7 +352,7 @@ func (cmd *setCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx
 			return newPgRedisNil(), nil
 		}
 	} else {
-		err := redis.strings.InsertOrUpdate(tx, command.Get(1), command.Get(2), expiry_millis)
+		err := redis.strings.InsertOrUpdate(tx, client.db, command.Get(1), command.Get(2), expiry_millis)
 		if err != nil {
 			return nil, err
 		}
@@ -391,54 +360,54 @@ func (cmd *setCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx
 	}
 }
 
-func (cmd *setCommand) keysToLock(command *redisRequest) []string {
-	return command.Args()[1:2]
-}
-
 type setexCommand struct{}
 
-func (cmd *setexCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *setexCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	key := command.Get(1)
-	expiry_secs, _ := strconv.Atoi(string(command.Get(2)))
+	expiry_secs, err := parseIntArg(command.Get(2))
+	if err != nil {
+		return nil, err
+	}
+	if expiry_secs <= 0 {
+		return nil, newErr("invalid expire time in 'setex' command")
+	}
 	value := command.Get(3)
 	expiry_millis := expiry_secs * 1000
 
-	err := redis.strings.InsertOrUpdate(tx, key, value, expiry_millis)
+	err = redis.strings.InsertOrUpdate(tx, client.db, key, value, expiry_millis)
 	if err != nil {
 		return nil, err
 	}
 	return newPgRedisString("OK"), nil
 }
 
-func (cmd *setexCommand) keysToLock(command *redisRequest) []string {
-	return command.Args()[1:2]
-}
-
 type psetexCommand struct{}
 
-func (cmd *psetexCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *psetexCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	key := command.Get(1)
-	expiry_millis, _ := strconv.Atoi(string(command.Get(2)))
+	expiry_millis, err := parseIntArg(command.Get(2))
+	if err != nil {
+		return nil, err
+	}
+	if expiry_millis <= 0 {
+		return nil, newErr("invalid expire time in 'psetex' command")
+	}
 	value := command.Get(3)
-	err := redis.strings.InsertOrUpdate(tx, key, value, expiry_millis)
+	err = redis.strings.InsertOrUpdate(tx, client.db, key, value, expiry_millis)
 	if err != nil {
 		return nil, err
 	}
 	return newPgRedisString("OK"), nil
 }
 
-func (cmd *psetexCommand) keysToLock(command *redisRequest) []string {
-	return command.Args()[1:2]
-}
-
 type setnxCommand struct{}
 
-func (cmd *setnxCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *setnxCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	key := command.Get(1)
 	value := command.Get(2)
 	expiry_millis := 0
 
-	updated, err := redis.strings.InsertOrSkip(tx, key, value, expiry_millis)
+	updated, err := redis.strings.InsertOrSkip(tx, client.db, key, value, expiry_millis)
 	if err != nil {
 		return nil, err
 	}
@@ -449,14 +418,10 @@ func (cmd *setnxCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.
 	}
 }
 
-func (cmd *setnxCommand) keysToLock(command *redisRequest) []string {
-	return command.Args()[1:2]
-}
-
 type strlenCommand struct{}
 
-func (cmd *strlenCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
-	success, resp, err := redis.strings.Get(tx, command.Get(1))
+func (cmd *strlenCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	success, resp, err := redis.strings.Get(tx, client.db, command.Get(1))
 	if err != nil {
 		return nil, err
 	}
@@ -467,10 +432,6 @@ func (cmd *strlenCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql
 	}
 }
 
-func (cmd *strlenCommand) keysToLock(command *redisRequest) []string {
-	return []string{}
-}
-
 func commandExValueInMillis(command *redisRequest) int {
 	indexOfEx := indexOfValue(command, "EX")
 	if indexOfEx == 0 {
@@ -0,0 +1,13 @@
+package pgredis
+
+import (
+	"github.com/yob/pgredis/internal/repositories"
+)
+
+// UNWATCH is handled by handleRequest when it's sent outside a transaction. Inside MULTI it's
+// queued like any other command, and the watched keys are cleared after EXEC anyway.
+type unwatchCommand struct{}
+
+func (cmd *unwatchCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	return newPgRedisString("OK"), nil
+}
@@ -1,15 +1,53 @@
 package pgredis
 
 import (
-	"database/sql"
-	"errors"
 	"strconv"
-	"strings"
+	"time"
+
+	"github.com/yob/pgredis/internal/repositories"
 )
 
+type bzpopmaxCommand struct{}
+
+func (cmd *bzpopmaxCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	return executeWithoutBlocking(cmd, command, redis, client, tx, newPgRedisNilArray())
+}
+
+func (cmd *bzpopmaxCommand) tryExecute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier, keys []string) (bool, pgRedisValue, error) {
+	return popFromFirstSortedSet(redis, tx, client.db, keys, "desc")
+}
+
+func (cmd *bzpopmaxCommand) keysToWaitOn(command *redisRequest) []string {
+	// BZPOPMAX key [key ...] timeout
+	return command.Args()[1 : command.ArgCount()-1]
+}
+
+func (cmd *bzpopmaxCommand) timeout(command *redisRequest) (time.Duration, error) {
+	return parseTimeout(command.Get(command.ArgCount() - 1))
+}
+
+type bzpopminCommand struct{}
+
+func (cmd *bzpopminCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	return executeWithoutBlocking(cmd, command, redis, client, tx, newPgRedisNilArray())
+}
+
+func (cmd *bzpopminCommand) tryExecute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier, keys []string) (bool, pgRedisValue, error) {
+	return popFromFirstSortedSet(redis, tx, client.db, keys, "asc")
+}
+
+func (cmd *bzpopminCommand) keysToWaitOn(command *redisRequest) []string {
+	// BZPOPMIN key [key ...] timeout
+	return command.Args()[1 : command.ArgCount()-1]
+}
+
+func (cmd *bzpopminCommand) timeout(command *redisRequest) (time.Duration, error) {
+	return parseTimeout(command.Get(command.ArgCount() - 1))
+}
+
 type zaddCommand struct{}
 
-func (cmd *zaddCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *zaddCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	xxArgProvided := false
 	nxArgProvided := false
 	chArgProvided := false
@@ -20,7 +58,10 @@ func (cmd *zaddCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.T
 
 	for i := 2; i < command.ArgCount(); i++ {
 		if lastArg != "" { // the previous arg was a score, so this must be a member
-			score, _ := strconv.ParseFloat(lastArg, 64)
+			score, err := parseFloatArg([]byte(lastArg))
+			if err != nil {
+				return nil, err
+			}
 			values[string(command.Get(i))] = score
 			lastArg = ""
 		} else if string(command.Get(i)) == "XX" {
@@ -37,116 +78,106 @@ func (cmd *zaddCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.T
 	}
 
 	if xxArgProvided {
-		return nil, errors.New("XX arg provided, but not yet supported")
+		return nil, newErr("XX arg provided, but not yet supported")
 	}
 	if nxArgProvided {
-		return nil, errors.New("NX arg provided, but not yet supported")
+		return nil, newErr("NX arg provided, but not yet supported")
 	}
 	if incrArgProvided {
-		return nil, errors.New("INCR arg provided, but not yet supported")
+		return nil, newErr("INCR arg provided, but not yet supported")
 	}
 
-	updated, err := redis.sortedsets.Add(tx, key, values, chArgProvided)
+	updated, err := redis.sortedsets.Add(tx, client.db, key, values, chArgProvided)
 	if err != nil {
 		return nil, err
 	}
 	return newPgRedisInt(updated), nil
 }
 
-func (cmd *zaddCommand) keysToLock(command *redisRequest) []string {
-	return command.Args()[1:2]
-}
-
 type zcardCommand struct{}
 
-func (cmd *zcardCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *zcardCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	key := command.Get(1)
 
-	count, err := redis.sortedsets.Cardinality(tx, key)
+	count, err := redis.sortedsets.Cardinality(tx, client.db, key)
 	if err != nil {
 		return nil, err
 	}
 	return newPgRedisInt(count), nil
 }
 
-func (cmd *zcardCommand) keysToLock(command *redisRequest) []string {
-	return []string{}
-}
-
 type zrangeCommand struct{}
 
-func (cmd *zrangeCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *zrangeCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	key := command.Get(1)
-	start, _ := strconv.Atoi(string(command.Get(2)))
-	end, _ := strconv.Atoi(string(command.Get(3)))
+	start, err := parseIntArg(command.Get(2))
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseIntArg(command.Get(3))
+	if err != nil {
+		return nil, err
+	}
 	includeScores := string(command.Get(4)) == "WITHSCORES"
 
-	items, err := redis.sortedsets.Range(tx, key, start, end, "asc", includeScores)
+	items, err := redis.sortedsets.Range(tx, client.db, key, start, end, "asc", includeScores)
 	if err != nil {
 		return nil, err
 	}
-	return newPgRedisArrayOfStrings(items), nil
-}
-
-func (cmd *zrangeCommand) keysToLock(command *redisRequest) []string {
-	return []string{}
+	return newSortedSetMembersReply(items, includeScores), nil
 }
 
 type zrangebyscoreCommand struct{}
 
-func (cmd *zrangebyscoreCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
-	var min float64
-	var max float64
-	var minExclusive bool
-	var maxExclusive bool
+func (cmd *zrangebyscoreCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	var offset, count int
 
 	key := command.Get(1)
-	minString := string(command.Get(2))
-	maxString := string(command.Get(3))
 	includeScores := commandHasValue(command, "WITHSCORES")
 
-	if strings.HasPrefix(minString, "(") {
-		minExclusive = true
-		min, _ = strconv.ParseFloat(minString[1:len(minString)], 64)
-	} else {
-		minExclusive = false
-		min, _ = strconv.ParseFloat(minString, 64)
+	min, minExclusive, err := parseScoreRangeArg(command.Get(2))
+	if err != nil {
+		return nil, err
 	}
-
-	if strings.HasPrefix(maxString, "(") {
-		maxExclusive = true
-		max, _ = strconv.ParseFloat(maxString[1:len(maxString)], 64)
-	} else {
-		maxExclusive = false
-		max, _ = strconv.ParseFloat(maxString, 64)
+	max, maxExclusive, err := parseScoreRangeArg(command.Get(3))
+	if err != nil {
+		return nil, err
 	}
 
 	if commandHasValue(command, "LIMIT") {
 		offset, count = commandLimitOffsetAndCount(command)
 	}
-	items, err := redis.sortedsets.RangeByScore(tx, key, min, minExclusive, max, maxExclusive, offset, count, includeScores)
+	items, err := redis.sortedsets.RangeByScore(tx, client.db, key, min, minExclusive, max, maxExclusive, offset, count, includeScores)
 	if err != nil {
 		return nil, err
 	}
 
-	return newPgRedisArrayOfStrings(items), nil
+	return newSortedSetMembersReply(items, includeScores), nil
 }
 
-func (cmd *zrangebyscoreCommand) keysToLock(command *redisRequest) []string {
-	return []string{}
+type zscoreCommand struct{}
+
+func (cmd *zscoreCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
+	exists, score, err := redis.sortedsets.Score(tx, client.db, command.Get(1), command.Get(2))
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return newPgRedisNil(), nil
+	}
+	return newPgRedisDouble(score), nil
 }
 
 type zremCommand struct{}
 
-func (cmd *zremCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *zremCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	key := command.Get(1)
 	values := make([][]byte, 0)
 	for i := 2; i < command.ArgCount(); i++ {
 		values = append(values, command.Get(i))
 	}
 
-	updated, err := redis.sortedsets.Remove(tx, key, values)
+	updated, err := redis.sortedsets.Remove(tx, client.db, key, values)
 
 	if err != nil {
 		return nil, err
@@ -154,18 +185,20 @@ func (cmd *zremCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.T
 	return newPgRedisInt(updated), nil
 }
 
-func (cmd *zremCommand) keysToLock(command *redisRequest) []string {
-	return command.Args()[1:2]
-}
-
 type zremrangebyrankCommand struct{}
 
-func (cmd *zremrangebyrankCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *zremrangebyrankCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	key := command.Get(1)
-	start, _ := strconv.Atoi(string(command.Get(2)))
-	end, _ := strconv.Atoi(string(command.Get(3)))
+	start, err := parseIntArg(command.Get(2))
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseIntArg(command.Get(3))
+	if err != nil {
+		return nil, err
+	}
 
-	removed, err := redis.sortedsets.RemoveRangeByRank(tx, key, start, end)
+	removed, err := redis.sortedsets.RemoveRangeByRank(tx, client.db, key, start, end)
 	if err != nil {
 		return nil, err
 	}
@@ -173,39 +206,20 @@ func (cmd *zremrangebyrankCommand) Execute(command *redisRequest, redis *PgRedis
 	return newPgRedisInt(removed), nil
 }
 
-func (cmd *zremrangebyrankCommand) keysToLock(command *redisRequest) []string {
-	return command.Args()[1:2]
-}
-
 type zremrangebyscoreCommand struct{}
 
-func (cmd *zremrangebyscoreCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
-	var min float64
-	var max float64
-	var minExclusive bool
-	var maxExclusive bool
-
+func (cmd *zremrangebyscoreCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	key := command.Get(1)
-	minString := string(command.Get(2))
-	maxString := string(command.Get(3))
-
-	if strings.HasPrefix(minString, "(") {
-		minExclusive = true
-		min, _ = strconv.ParseFloat(minString[1:len(minString)], 64)
-	} else {
-		minExclusive = false
-		min, _ = strconv.ParseFloat(minString, 64)
+	min, minExclusive, err := parseScoreRangeArg(command.Get(2))
+	if err != nil {
+		return nil, err
 	}
-
-	if strings.HasPrefix(maxString, "(") {
-		maxExclusive = true
-		max, _ = strconv.ParseFloat(maxString[1:len(maxString)], 64)
-	} else {
-		maxExclusive = false
-		max, _ = strconv.ParseFloat(maxString, 64)
+	max, maxExclusive, err := parseScoreRangeArg(command.Get(3))
+	if err != nil {
+		return nil, err
 	}
 
-	removed, err := redis.sortedsets.RemoveRangeByScore(tx, key, min, minExclusive, max, maxExclusive)
+	removed, err := redis.sortedsets.RemoveRangeByScore(tx, client.db, key, min, minExclusive, max, maxExclusive)
 	if err != nil {
 		return nil, err
 	}
@@ -213,27 +227,25 @@ func (cmd *zremrangebyscoreCommand) Execute(command *redisRequest, redis *PgRedi
 	return newPgRedisInt(removed), nil
 }
 
-func (cmd *zremrangebyscoreCommand) keysToLock(command *redisRequest) []string {
-	return command.Args()[1:2]
-}
-
 type zrevrangeCommand struct{}
 
-func (cmd *zrevrangeCommand) Execute(command *redisRequest, redis *PgRedis, tx *sql.Tx) (pgRedisValue, error) {
+func (cmd *zrevrangeCommand) Execute(command *redisRequest, redis *PgRedis, client *redisClient, tx repositories.Querier) (pgRedisValue, error) {
 	key := command.Get(1)
-	start, _ := strconv.Atoi(string(command.Get(2)))
-	end, _ := strconv.Atoi(string(command.Get(3)))
+	start, err := parseIntArg(command.Get(2))
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseIntArg(command.Get(3))
+	if err != nil {
+		return nil, err
+	}
 	includeScores := string(command.Get(4)) == "WITHSCORES"
 
-	items, err := redis.sortedsets.Range(tx, key, start, end, "desc", includeScores)
+	items, err := redis.sortedsets.Range(tx, client.db, key, start, end, "desc", includeScores)
 	if err != nil {
 		return nil, err
 	}
-	return newPgRedisArrayOfStrings(items), nil
-}
-
-func (cmd *zrevrangeCommand) keysToLock(command *redisRequest) []string {
-	return []string{}
+	return newSortedSetMembersReply(items, includeScores), nil
 }
 
 func commandLimitOffsetAndCount(command *redisRequest) (int, int) {
@@ -249,3 +261,41 @@ func commandLimitOffsetAndCount(command *redisRequest) (int, int) {
 		return offset, count
 	}
 }
+
+// pop the lowest (asc) or highest (desc) scoring member from the first non-empty sorted set,
+// returning an array of the key, member and score
+func popFromFirstSortedSet(redis *PgRedis, tx repositories.Querier, db int, keys []string, direction string) (bool, pgRedisValue, error) {
+	for _, key := range keys {
+		items, err := redis.sortedsets.Pop(tx, db, []byte(key), direction, 1)
+		if err != nil {
+			return false, nil, err
+		}
+		if len(items) > 0 {
+			score, err := strconv.ParseFloat(items[1], 64)
+			if err != nil {
+				return false, nil, err
+			}
+			result := []pgRedisValue{newPgRedisString(key), newPgRedisString(items[0]), newPgRedisDouble(score)}
+			return true, newPgRedisArray(result), nil
+		}
+	}
+	return false, nil, nil
+}
+
+// The reply for a range of sorted set members. With scores, RESP3 clients get a pair for each
+// member with the score as a double.
+func newSortedSetMembersReply(items []string, withScores bool) pgRedisValue {
+	if !withScores {
+		return newPgRedisArrayOfStrings(items)
+	}
+	values := make([]pgRedisValue, 0, len(items))
+	for idx := 0; idx+1 < len(items); idx += 2 {
+		score, err := strconv.ParseFloat(items[idx+1], 64)
+		if err != nil {
+			// the database only has valid scores, so this shouldn't happen
+			return newPgRedisArrayOfStrings(items)
+		}
+		values = append(values, newPgRedisString(items[idx]), newPgRedisDouble(score))
+	}
+	return newPgRedisPairs(values)
+}
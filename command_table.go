@@ -0,0 +1,619 @@
+package pgredis
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Everything we know about a command, apart from how to execute it. This mirrors the command table
+// in the redis source, and is what the COMMAND command reports to clients.
+//
+// arity is the number of arguments the command takes, including the command name. A negative
+// arity means the command takes at least that many arguments.
+//
+// firstKey, lastKey and step describe which arguments are keys. lastKey may be negative to count
+// back from the last argument, so MSET (keys at 1, 3, 5...) is 1, -1, 2. Commands where the keys
+// can't be described this way have the movablekeys flag and implement movableKeysCommand.
+//
+// Most of a command's ACL categories follow from its flags and group (see categories), and
+// aclCategories lists any others.
+//
+// Commands without an implementation change the state of the connection (like MULTI), and are
+// handled by handleRequest before the command table is consulted.
+type commandDefinition struct {
+	arity          int
+	flags          []string
+	firstKey       int
+	lastKey        int
+	step           int
+	group          string
+	summary        string
+	aclCategories  []string
+	implementation redisCommand
+}
+
+func (definition *commandDefinition) hasFlag(flag string) bool {
+	for _, candidate := range definition.flags {
+		if candidate == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// The ACL categories that follow from a command's flags and group
+var FLAG_ACL_CATEGORIES = map[string][]string{
+	"write":    {"write"},
+	"readonly": {"read"},
+	"admin":    {"admin", "dangerous"},
+	"fast":     {"fast"},
+	"blocking": {"blocking"},
+	"pubsub":   {"pubsub"},
+}
+
+var GROUP_ACL_CATEGORIES = map[string][]string{
+	"bitmap":       {"bitmap"},
+	"connection":   {"connection"},
+	"generic":      {"keyspace"},
+	"hash":         {"hash"},
+	"list":         {"list"},
+	"pubsub":       {"pubsub"},
+	"set":          {"set"},
+	"sorted-set":   {"sortedset"},
+	"string":       {"string"},
+	"transactions": {"transaction"},
+}
+
+// The ACL categories a command belongs to, sorted. Every command is either fast or slow.
+func (definition *commandDefinition) categories() []string {
+	found := map[string]bool{}
+	for _, flag := range definition.flags {
+		for _, category := range FLAG_ACL_CATEGORIES[flag] {
+			found[category] = true
+		}
+	}
+	for _, category := range GROUP_ACL_CATEGORIES[definition.group] {
+		found[category] = true
+	}
+	for _, category := range definition.aclCategories {
+		found[category] = true
+	}
+	if !found["fast"] {
+		found["slow"] = true
+	}
+	return sortedKeys(found)
+}
+
+func (definition *commandDefinition) inCategory(category string) bool {
+	for _, candidate := range definition.categories() {
+		if candidate == category {
+			return true
+		}
+	}
+	return false
+}
+
+// Commands with the movablekeys flag find their keys by parsing their arguments
+type movableKeysCommand interface {
+	getKeys(command *redisRequest) []string
+}
+
+func newCommandTable() map[string]*commandDefinition {
+	return map[string]*commandDefinition{
+		"ACL": {
+			arity: -2, flags: []string{"admin", "noscript", "loading", "stale"},
+			group: "server", summary: "A container for Access List Control commands.",
+			implementation: &aclCommand{},
+		},
+		"APPEND": {
+			arity: 3, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "string", summary: "Appends a string to the value of a key. Creates the key if it doesn't exist.",
+			implementation: &appendCommand{},
+		},
+		"AUTH": {
+			arity: -2, flags: []string{"noscript", "loading", "stale", "fast", "no_auth"},
+			group: "connection", summary: "Authenticates the connection.",
+			implementation: &authCommand{},
+		},
+		"BITCOUNT": {
+			arity: -2, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "bitmap", summary: "Counts the number of set bits (population counting) in a string.",
+			implementation: &bitcountCommand{},
+		},
+		"BLMOVE": {
+			arity: 6, flags: []string{"write", "denyoom", "blocking"}, firstKey: 1, lastKey: 2, step: 1,
+			group: "list", summary: "Pops an element from a list, pushes it to another list and returns it. Blocks until an element is available otherwise.",
+			implementation: &blmoveCommand{},
+		},
+		"BLMPOP": {
+			arity: -5, flags: []string{"write", "blocking", "movablekeys"},
+			group: "list", summary: "Pops the first element from one of multiple lists. Blocks until an element is available otherwise.",
+			implementation: &blmpopCommand{},
+		},
+		"BLPOP": {
+			arity: -3, flags: []string{"write", "blocking"}, firstKey: 1, lastKey: -2, step: 1,
+			group: "list", summary: "Removes and returns the first element in a list. Blocks until an element is available otherwise.",
+			implementation: &blpopCommand{},
+		},
+		"BRPOP": {
+			arity: -3, flags: []string{"write", "blocking"}, firstKey: 1, lastKey: -2, step: 1,
+			group: "list", summary: "Removes and returns the last element in a list. Blocks until an element is available otherwise.",
+			implementation: &brpopCommand{},
+		},
+		"BRPOPLPUSH": {
+			arity: 4, flags: []string{"write", "denyoom", "blocking"}, firstKey: 1, lastKey: 2, step: 1,
+			group: "list", summary: "Pops an element from a list, pushes it to another list and returns it. Blocks until an element is available otherwise.",
+			implementation: &brpoplpushCommand{},
+		},
+		"BZPOPMAX": {
+			arity: -3, flags: []string{"write", "blocking", "fast"}, firstKey: 1, lastKey: -2, step: 1,
+			group: "sorted-set", summary: "Removes and returns the member with the highest score from one or more sorted sets. Blocks until a member is available otherwise.",
+			implementation: &bzpopmaxCommand{},
+		},
+		"BZPOPMIN": {
+			arity: -3, flags: []string{"write", "blocking", "fast"}, firstKey: 1, lastKey: -2, step: 1,
+			group: "sorted-set", summary: "Removes and returns the member with the lowest score from one or more sorted sets. Blocks until a member is available otherwise.",
+			implementation: &bzpopminCommand{},
+		},
+		"CLIENT": {
+			arity: -2, flags: []string{"admin", "noscript", "loading", "stale"},
+			group: "connection", summary: "A container for client connection commands.",
+			implementation: &clientCommand{},
+		},
+		"COMMAND": {
+			arity: -1, flags: []string{"loading", "stale"},
+			group: "server", summary: "Returns detailed information about all commands.",
+			aclCategories:  []string{"connection"},
+			implementation: &commandCommand{},
+		},
+		"CONFIG": {
+			arity: -2, flags: []string{"admin", "noscript", "loading", "stale"},
+			group: "server", summary: "A container for server configuration commands.",
+			implementation: &configCommand{},
+		},
+		"DBSIZE": {
+			arity: 1, flags: []string{"readonly", "fast"},
+			group: "server", summary: "Returns the number of keys in the database.",
+			aclCategories:  []string{"keyspace"},
+			implementation: &dbsizeCommand{},
+		},
+		"DECR": {
+			arity: 2, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "string", summary: "Decrements the integer value of a key by one. Uses 0 as initial value if the key doesn't exist.",
+			implementation: &decrCommand{},
+		},
+		"DECRBY": {
+			arity: 3, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "string", summary: "Decrements a number from the integer value of a key. Uses 0 as initial value if the key doesn't exist.",
+			implementation: &decrbyCommand{},
+		},
+		"DEL": {
+			arity: -2, flags: []string{"write"}, firstKey: 1, lastKey: -1, step: 1,
+			group: "generic", summary: "Deletes one or more keys.",
+			implementation: &delCommand{},
+		},
+		"DISCARD": {
+			arity: 1, flags: []string{"noscript", "loading", "stale", "fast"},
+			group: "transactions", summary: "Discards a transaction.",
+		},
+		"ECHO": {
+			arity: 2, flags: []string{"fast"},
+			group: "connection", summary: "Returns the given string.",
+			implementation: &echoCommand{},
+		},
+		"EXEC": {
+			arity: 1, flags: []string{"noscript", "loading", "stale"},
+			group: "transactions", summary: "Executes all commands in a transaction.",
+		},
+		"EXISTS": {
+			arity: -2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: -1, step: 1,
+			group: "generic", summary: "Determines whether one or more keys exist.",
+			implementation: &existsCommand{},
+		},
+		"EXPIRE": {
+			arity: 3, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "generic", summary: "Sets the expiration time of a key in seconds.",
+			implementation: &expireCommand{},
+		},
+		"FLUSHALL": {
+			arity: -1, flags: []string{"write"},
+			group: "server", summary: "Removes all keys from all databases.",
+			aclCategories:  []string{"keyspace", "dangerous"},
+			implementation: &flushallCommand{},
+		},
+		"FLUSHDB": {
+			arity: -1, flags: []string{"write"},
+			group: "server", summary: "Remove all keys from the current database.",
+			aclCategories:  []string{"keyspace", "dangerous"},
+			implementation: &flushdbCommand{},
+		},
+		"GET": {
+			arity: 2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "string", summary: "Returns the string value of a key.",
+			implementation: &getCommand{},
+		},
+		"GETBIT": {
+			arity: 3, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "bitmap", summary: "Returns a bit value by offset.",
+			implementation: &getbitCommand{},
+		},
+		"GETRANGE": {
+			arity: 4, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "string", summary: "Returns a substring of the string stored at a key.",
+			implementation: &getrangeCommand{},
+		},
+		"GETSET": {
+			arity: 3, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "string", summary: "Returns the previous string value of a key after setting it to a new value.",
+			implementation: &getsetCommand{},
+		},
+		"HELLO": {
+			arity: -1, flags: []string{"noscript", "loading", "stale", "fast", "no_auth"},
+			group: "connection", summary: "Handshakes with the Redis server.",
+			implementation: &helloCommand{},
+		},
+		"HGET": {
+			arity: 3, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "hash", summary: "Returns the value of a field in a hash.",
+			implementation: &hgetCommand{},
+		},
+		"HGETALL": {
+			arity: 2, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "hash", summary: "Returns all fields and values in a hash.",
+			implementation: &hgetallCommand{},
+		},
+		"HMGET": {
+			arity: -3, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "hash", summary: "Returns the values of all fields in a hash.",
+			implementation: &hmgetCommand{},
+		},
+		"HMSET": {
+			arity: -4, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "hash", summary: "Sets the values of multiple fields.",
+			implementation: &hmsetCommand{},
+		},
+		"HSET": {
+			arity: -4, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "hash", summary: "Creates or modifies the value of a field in a hash.",
+			implementation: &hsetCommand{},
+		},
+		"INCR": {
+			arity: 2, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "string", summary: "Increments the integer value of a key by one. Uses 0 as initial value if the key doesn't exist.",
+			implementation: &incrCommand{},
+		},
+		"INCRBY": {
+			arity: 3, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "string", summary: "Increments the integer value of a key by a number. Uses 0 as initial value if the key doesn't exist.",
+			implementation: &incrbyCommand{},
+		},
+		"INCRBYFLOAT": {
+			arity: 3, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "string", summary: "Increment the floating point value of a key by a number. Uses 0 as initial value if the key doesn't exist.",
+			implementation: &incrbyfloatCommand{},
+		},
+		"INFO": {
+			arity: -1, flags: []string{"loading", "stale"},
+			group: "server", summary: "Returns information and statistics about the server.",
+			aclCategories:  []string{"dangerous"},
+			implementation: &infoCommand{},
+		},
+		"KEYS": {
+			arity: 2, flags: []string{"readonly"},
+			group: "generic", summary: "Returns all key names that match a pattern.",
+			aclCategories:  []string{"dangerous"},
+			implementation: &keysCommand{},
+		},
+		"LLEN": {
+			arity: 2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "list", summary: "Returns the length of a list.",
+			implementation: &llenCommand{},
+		},
+		"LPOP": {
+			arity: -2, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "list", summary: "Returns the first elements in a list after removing it. Deletes the list if the last element was popped.",
+			implementation: &lpopCommand{},
+		},
+		"LPUSH": {
+			arity: -3, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "list", summary: "Prepends one or more elements to a list. Creates the key if it doesn't exist.",
+			implementation: &lpushCommand{},
+		},
+		"LRANGE": {
+			arity: 4, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "list", summary: "Returns a range of elements from a list.",
+			implementation: &lrangeCommand{},
+		},
+		"LREM": {
+			arity: 4, flags: []string{"write"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "list", summary: "Removes elements from a list. Deletes the list if the last element was removed.",
+			implementation: &lremCommand{},
+		},
+		"MGET": {
+			arity: -2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: -1, step: 1,
+			group: "string", summary: "Atomically returns the string values of one or more keys.",
+			implementation: &mgetCommand{},
+		},
+		"MOVE": {
+			arity: 3, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "generic", summary: "Moves a key to another database.",
+			implementation: &moveCommand{},
+		},
+		"MSET": {
+			arity: -3, flags: []string{"write", "denyoom"}, firstKey: 1, lastKey: -1, step: 2,
+			group: "string", summary: "Atomically creates or modifies the string values of one or more keys.",
+			implementation: &msetCommand{},
+		},
+		"MULTI": {
+			arity: 1, flags: []string{"noscript", "loading", "stale", "fast"},
+			group: "transactions", summary: "Starts a transaction.",
+		},
+		"PING": {
+			arity: -1, flags: []string{"fast"},
+			group: "connection", summary: "Returns the server's liveliness response.",
+			implementation: &pingCommand{},
+		},
+		"PSETEX": {
+			arity: 4, flags: []string{"write", "denyoom"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "string", summary: "Sets both string value and expiration time in milliseconds of a key. The key is created if it doesn't exist.",
+			implementation: &psetexCommand{},
+		},
+		"PSUBSCRIBE": {
+			arity: -2, flags: []string{"pubsub", "noscript", "loading", "stale"},
+			group: "pubsub", summary: "Listens for messages published to channels that match one or more patterns.",
+		},
+		"PTTL": {
+			arity: 2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "generic", summary: "Returns the expiration time in milliseconds of a key.",
+			implementation: &pttlCommand{},
+		},
+		"PUBLISH": {
+			arity: 3, flags: []string{"pubsub", "loading", "stale", "fast"},
+			group: "pubsub", summary: "Posts a message to a channel.",
+			implementation: &publishCommand{},
+		},
+		"PUBSUB": {
+			arity: -2, flags: []string{"pubsub", "loading", "stale"},
+			group: "pubsub", summary: "A container for Pub/Sub commands.",
+			implementation: &pubsubCommand{},
+		},
+		"PUNSUBSCRIBE": {
+			arity: -1, flags: []string{"pubsub", "noscript", "loading", "stale"},
+			group: "pubsub", summary: "Stops listening to messages published to channels that match one or more patterns.",
+		},
+		"QUIT": {
+			arity: -1, flags: []string{"noscript", "loading", "stale", "fast", "no_auth"},
+			group: "connection", summary: "Closes the connection.",
+			implementation: &quitCommand{},
+		},
+		"READONLY": {
+			arity: 1, flags: []string{"loading", "stale", "fast"},
+			group: "cluster", summary: "Lets read only commands on this connection go to a replica. This is the default.",
+			aclCategories:  []string{"connection"},
+			implementation: &readonlyCommand{},
+		},
+		"READWRITE": {
+			arity: 1, flags: []string{"loading", "stale", "fast"},
+			group: "cluster", summary: "Sends every command on this connection to the primary, so reads see the connection's own writes.",
+			aclCategories:  []string{"connection"},
+			implementation: &readwriteCommand{},
+		},
+		"RPOP": {
+			arity: -2, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "list", summary: "Returns and removes the last elements of a list. Deletes the list if the last element was popped.",
+			implementation: &rpopCommand{},
+		},
+		"RPUSH": {
+			arity: -3, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "list", summary: "Appends one or more elements to a list. Creates the key if it doesn't exist.",
+			implementation: &rpushCommand{},
+		},
+		"SADD": {
+			arity: -3, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "set", summary: "Adds one or more members to a set. Creates the key if it doesn't exist.",
+			implementation: &saddCommand{},
+		},
+		"SCAN": {
+			arity: -2, flags: []string{"readonly"},
+			group: "generic", summary: "Iterates over the key names in the database.",
+			implementation: &scanCommand{},
+		},
+		"SCARD": {
+			arity: 2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "set", summary: "Returns the number of members in a set.",
+			implementation: &scardCommand{},
+		},
+		"SELECT": {
+			arity: 2, flags: []string{"loading", "stale", "fast"},
+			group: "connection", summary: "Changes the selected database.",
+			implementation: &selectCommand{},
+		},
+		"SET": {
+			arity: -3, flags: []string{"write", "denyoom"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "string", summary: "Sets the string value of a key, ignoring its type. The key is created if it doesn't exist.",
+			implementation: &setCommand{},
+		},
+		"SETEX": {
+			arity: 4, flags: []string{"write", "denyoom"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "string", summary: "Sets the string value and expiration time of a key. Creates the key if it doesn't exist.",
+			implementation: &setexCommand{},
+		},
+		"SETNX": {
+			arity: 3, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "string", summary: "Set the string value of a key only when the key doesn't exist.",
+			implementation: &setnxCommand{},
+		},
+		"SHUTDOWN": {
+			arity: -1, flags: []string{"admin", "noscript", "loading", "stale", "no_multi"},
+			group: "server", summary: "Synchronously saves the database(s) to disk and shuts down the Redis server.",
+		},
+		"SMEMBERS": {
+			arity: 2, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "set", summary: "Returns all members of a set.",
+			implementation: &smembersCommand{},
+		},
+		"SREM": {
+			arity: -3, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "set", summary: "Removes one or more members from a set. Deletes the set if the last member was removed.",
+			implementation: &sremCommand{},
+		},
+		"SSCAN": {
+			arity: -3, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "set", summary: "Iterates over members of a set.",
+			implementation: &sscanCommand{},
+		},
+		"STRLEN": {
+			arity: 2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "string", summary: "Returns the length of a string value.",
+			implementation: &strlenCommand{},
+		},
+		"SUBSCRIBE": {
+			arity: -2, flags: []string{"pubsub", "noscript", "loading", "stale"},
+			group: "pubsub", summary: "Listens for messages published to channels.",
+		},
+		"SWAPDB": {
+			arity: 3, flags: []string{"write", "fast"},
+			group: "server", summary: "Swaps two Redis databases.",
+			aclCategories:  []string{"keyspace", "dangerous"},
+			implementation: &swapdbCommand{},
+		},
+		"TTL": {
+			arity: 2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "generic", summary: "Returns the expiration time in seconds of a key.",
+			implementation: &ttlCommand{},
+		},
+		"TYPE": {
+			arity: 2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "generic", summary: "Determines the type of value stored at a key.",
+			implementation: &typeCommand{},
+		},
+		"UNSUBSCRIBE": {
+			arity: -1, flags: []string{"pubsub", "noscript", "loading", "stale"},
+			group: "pubsub", summary: "Stops listening to messages posted to channels.",
+		},
+		"UNWATCH": {
+			arity: 1, flags: []string{"noscript", "loading", "stale", "fast"},
+			group: "transactions", summary: "Forgets about watched keys of a transaction.",
+			implementation: &unwatchCommand{},
+		},
+		"WAIT": {
+			arity: 3, flags: []string{"noscript", "no_multi"},
+			group: "generic", summary: "Blocks until the asynchronous replication of all preceding write commands sent by the connection is completed.",
+			aclCategories: []string{"connection"},
+		},
+		"WAITAOF": {
+			arity: 4, flags: []string{"noscript", "no_multi"},
+			group: "generic", summary: "Blocks until all of the preceding write commands sent by the connection are written to the append-only file of the master and/or replicas.",
+			aclCategories: []string{"connection"},
+		},
+		"WATCH": {
+			arity: -2, flags: []string{"noscript", "loading", "stale", "fast"}, firstKey: 1, lastKey: -1, step: 1,
+			group: "transactions", summary: "Monitors changes to keys to determine the execution of a transaction.",
+		},
+		"ZADD": {
+			arity: -4, flags: []string{"write", "denyoom", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "sorted-set", summary: "Adds one or more members to a sorted set, or updates their scores. Creates the key if it doesn't exist.",
+			implementation: &zaddCommand{},
+		},
+		"ZCARD": {
+			arity: 2, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "sorted-set", summary: "Returns the number of members in a sorted set.",
+			implementation: &zcardCommand{},
+		},
+		"ZRANGE": {
+			arity: -4, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "sorted-set", summary: "Returns members in a sorted set within a range of indexes.",
+			implementation: &zrangeCommand{},
+		},
+		"ZRANGEBYSCORE": {
+			arity: -4, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "sorted-set", summary: "Returns members in a sorted set within a range of scores.",
+			implementation: &zrangebyscoreCommand{},
+		},
+		"ZREM": {
+			arity: -3, flags: []string{"write", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "sorted-set", summary: "Removes one or more members from a sorted set. Deletes the sorted set if all members were removed.",
+			implementation: &zremCommand{},
+		},
+		"ZREMRANGEBYRANK": {
+			arity: 4, flags: []string{"write"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "sorted-set", summary: "Removes members in a sorted set within a range of indexes. Deletes the sorted set if all members were removed.",
+			implementation: &zremrangebyrankCommand{},
+		},
+		"ZREMRANGEBYSCORE": {
+			arity: 4, flags: []string{"write"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "sorted-set", summary: "Removes members in a sorted set within a range of scores. Deletes the sorted set if all members were removed.",
+			implementation: &zremrangebyscoreCommand{},
+		},
+		"ZREVRANGE": {
+			arity: -4, flags: []string{"readonly"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "sorted-set", summary: "Returns members in a sorted set within a range of indexes in reverse order.",
+			implementation: &zrevrangeCommand{},
+		},
+		"ZSCORE": {
+			arity: 3, flags: []string{"readonly", "fast"}, firstKey: 1, lastKey: 1, step: 1,
+			group: "sorted-set", summary: "Returns the score of a member in a sorted set.",
+			implementation: &zscoreCommand{},
+		},
+	}
+}
+
+// Check a request is for a known command with the right number of arguments, before it's executed
+// or queued in a transaction. Returns the error message to send to the client, or an empty string
+// if the request is valid.
+func (redis *PgRedis) validateRequest(request *redisRequest) string {
+	definition := redis.commands[request.CommandString()]
+	if definition == nil {
+		args := []string{}
+		for _, arg := range request.Args()[1:] {
+			args = append(args, fmt.Sprintf("'%s' ", arg))
+		}
+		return fmt.Sprintf("ERR unknown command '%s', with args beginning with: %s", request.Get(0), strings.Join(args, ""))
+	}
+
+	if !definition.acceptsArgCount(request.ArgCount()) {
+		return fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(request.CommandString()))
+	}
+	return ""
+}
+
+func (definition *commandDefinition) acceptsArgCount(argCount int) bool {
+	if definition.arity > 0 {
+		return argCount == definition.arity
+	}
+	return argCount >= -definition.arity
+}
+
+// The keys in a request, based on the key positions in the command table
+func (redis *PgRedis) commandKeys(request *redisRequest) []string {
+	definition := redis.commands[request.CommandString()]
+	if definition == nil {
+		return []string{}
+	}
+	if movable, ok := definition.implementation.(movableKeysCommand); ok {
+		return movable.getKeys(request)
+	}
+
+	keys := []string{}
+	if definition.firstKey == 0 {
+		return keys
+	}
+	lastKey := definition.lastKey
+	if lastKey < 0 {
+		lastKey = request.ArgCount() + lastKey
+	}
+	for i := definition.firstKey; i <= lastKey && i < request.ArgCount(); i += definition.step {
+		keys = append(keys, string(request.Get(i)))
+	}
+	return keys
+}
+
+// The keys a request must lock before it's executed. Only commands that write take locks, so
+// reads never wait for a write to finish.
+func (redis *PgRedis) keysToLock(request *redisRequest) []string {
+	definition := redis.commands[request.CommandString()]
+	if definition == nil || !definition.hasFlag("write") {
+		return []string{}
+	}
+	return redis.commandKeys(request)
+}
@@ -0,0 +1,235 @@
+package pgredis
+
+import (
+	"database/sql"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq"
+	"github.com/yob/pgredis/internal/repositories"
+)
+
+// The values of appendfsync. Every transaction is written to the postgres WAL, which works like
+// an append only file that's always on, so appendfsync decides whether we wait for it to reach
+// the disk.
+//
+// always is the default, and waits for the WAL to be flushed before replying, like fsync after
+// every write. It uses the database's synchronous_commit. everysec and no reply before the WAL is
+// flushed, with synchronous_commit off. Postgres flushes the WAL within a few hundred milliseconds
+// (3 x wal_writer_delay), so a crash can lose the most recent writes, but never leaves the data
+// inconsistent.
+const (
+	APPENDFSYNC_ALWAYS   = "always"
+	APPENDFSYNC_EVERYSEC = "everysec"
+	APPENDFSYNC_NO       = "no"
+)
+
+func isAppendfsync(value string) bool {
+	return value == APPENDFSYNC_ALWAYS || value == APPENDFSYNC_EVERYSEC || value == APPENDFSYNC_NO
+}
+
+// The flags of notify-keyspace-events, and the classes of keyspace event they enable. A is an
+// alias for every class except m and n.
+var KEYSPACE_EVENT_FLAGS = map[rune]int{
+	'K': repositories.NotifyKeyspace,
+	'E': repositories.NotifyKeyevent,
+	'g': repositories.NotifyGeneric,
+	'$': repositories.NotifyString,
+	'l': repositories.NotifyList,
+	's': repositories.NotifySet,
+	'h': repositories.NotifyHash,
+	'z': repositories.NotifyZset,
+	'x': repositories.NotifyExpired,
+	'e': repositories.NotifyEvicted,
+	't': repositories.NotifyStream,
+	'm': repositories.NotifyKeyMiss,
+	'd': repositories.NotifyModule,
+	'n': repositories.NotifyNew,
+}
+
+const KEYSPACE_EVENTS_ALL = repositories.NotifyGeneric | repositories.NotifyString | repositories.NotifyList |
+	repositories.NotifySet | repositories.NotifyHash | repositories.NotifyZset | repositories.NotifyExpired |
+	repositories.NotifyEvicted | repositories.NotifyStream | repositories.NotifyModule
+
+// Parse the value of notify-keyspace-events, like "KEA". Returns false if there's a character
+// that isn't a flag.
+func parseKeyspaceEvents(value string) (int, bool) {
+	flags := 0
+	for _, char := range value {
+		if char == 'A' {
+			flags |= KEYSPACE_EVENTS_ALL
+		} else if flag, ok := KEYSPACE_EVENT_FLAGS[char]; ok {
+			flags |= flag
+		} else {
+			return 0, false
+		}
+	}
+	return flags, true
+}
+
+// Format keyspace event flags the way redis does, with the classes first and A when they're all set
+func formatKeyspaceEvents(flags int) string {
+	result := ""
+	if flags&KEYSPACE_EVENTS_ALL == KEYSPACE_EVENTS_ALL {
+		result += "A"
+	} else {
+		for _, char := range "g$lshzxetdn" {
+			if flags&KEYSPACE_EVENT_FLAGS[char] != 0 {
+				result += string(char)
+			}
+		}
+	}
+	for _, char := range "KEm" {
+		if flags&KEYSPACE_EVENT_FLAGS[char] != 0 {
+			result += string(char)
+		}
+	}
+	return result
+}
+
+// The parameters for CONFIG GET and CONFIG SET. Like redis, a change to appendfsync only applies
+// to this instance until it restarts.
+//
+// notify-keyspace-events decides which writes publish events, and subscribers on any instance can
+// receive them, so it has to be the same everywhere. It's saved in the database, and every
+// instance reloads it when it changes.
+type serverConfig struct {
+	mutex       sync.RWMutex
+	appendfsync string
+
+	db             *sql.DB
+	settings       *repositories.ConfigRepository
+	keyspaceEvents *repositories.KeyspaceEvents
+}
+
+func newServerConfig(appendfsync string, db *sql.DB, keyspaceEvents *repositories.KeyspaceEvents) *serverConfig {
+	if appendfsync == "" {
+		appendfsync = APPENDFSYNC_ALWAYS
+	}
+	return &serverConfig{
+		appendfsync:    appendfsync,
+		db:             db,
+		settings:       repositories.NewConfigRepository(),
+		keyspaceEvents: keyspaceEvents,
+	}
+}
+
+// Load the parameters that are saved in the database
+func (config *serverConfig) load(tx repositories.Querier) error {
+	found, value, err := config.settings.Get(tx, "notify-keyspace-events")
+	if err != nil || !found {
+		return err
+	}
+	flags, _ := parseKeyspaceEvents(value)
+	config.keyspaceEvents.SetFlags(flags)
+	return nil
+}
+
+// Handle a notification that has the name of a changed parameter as the payload. If the listening
+// connection was lost we may have missed some changes, so everything is reloaded.
+func (config *serverConfig) handleNotification(notification *pq.Notification) {
+	go func() {
+		err := config.load(config.db)
+		if err != nil {
+			log.Println("Error reloading config: ", err)
+		}
+	}()
+}
+
+func (config *serverConfig) getAppendfsync() string {
+	config.mutex.RLock()
+	defer config.mutex.RUnlock()
+	return config.appendfsync
+}
+
+// The parameters matching any of the glob patterns, and their values, sorted by name
+func (config *serverConfig) get(patterns []string) []string {
+	config.mutex.RLock()
+	parameters := map[string]string{
+		"appendfsync":            config.appendfsync,
+		"appendonly":             "yes",
+		"databases":              strconv.Itoa(DATABASE_COUNT),
+		"notify-keyspace-events": formatKeyspaceEvents(config.keyspaceEvents.Flags()),
+	}
+	config.mutex.RUnlock()
+
+	names := []string{}
+	for name := range parameters {
+		for _, pattern := range patterns {
+			if globMatch(strings.ToLower(pattern), name) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+
+	result := []string{}
+	for _, name := range names {
+		result = append(result, name, parameters[name])
+	}
+	return result
+}
+
+// Set one or more parameters. Like redis, either all of them are set or none are. Parameters that
+// are saved in the database are saved within tx, and every instance reloads them once it commits.
+//
+// Returns the function that applies the change to this instance, which must only be called once
+// tx has committed, so a rollback can't leave this instance with a change nobody else has.
+func (config *serverConfig) set(tx repositories.Querier, pairs []string) (func(), error) {
+	appendfsync := ""
+	keyspaceEvents := -1
+	for idx := 0; idx+1 < len(pairs); idx += 2 {
+		name, value := strings.ToLower(pairs[idx]), pairs[idx+1]
+		switch name {
+		case "appendfsync":
+			if !isAppendfsync(strings.ToLower(value)) {
+				return nil, newErr("CONFIG SET failed (possibly related to argument '%s') - argument(s) must be one of the following: always, everysec, no", name)
+			}
+			appendfsync = strings.ToLower(value)
+		case "notify-keyspace-events":
+			flags, ok := parseKeyspaceEvents(value)
+			if !ok {
+				return nil, newErr("CONFIG SET failed (possibly related to argument '%s') - Invalid event class character. Use 'Ag$lshzxeKEtmdn'.", name)
+			}
+			keyspaceEvents = flags
+		case "appendonly", "databases":
+			return nil, newErr("CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", name)
+		default:
+			return nil, newErr("Unknown option or number of arguments for CONFIG SET - '%s'", name)
+		}
+	}
+
+	if keyspaceEvents >= 0 {
+		err := config.settings.Save(tx, "notify-keyspace-events", formatKeyspaceEvents(keyspaceEvents))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	apply := func() {
+		if keyspaceEvents >= 0 {
+			config.keyspaceEvents.SetFlags(keyspaceEvents)
+		}
+
+		config.mutex.Lock()
+		defer config.mutex.Unlock()
+		if appendfsync != "" {
+			config.appendfsync = appendfsync
+		}
+	}
+	return apply, nil
+}
+
+// Whether the client's transactions wait for the WAL to be flushed before they reply. Clients use
+// the server's appendfsync unless they've chosen their own with CLIENT APPENDFSYNC.
+func (redis *PgRedis) synchronousCommit(client *redisClient) bool {
+	appendfsync := redis.config.getAppendfsync()
+	if client != nil && client.appendfsync != "" {
+		appendfsync = client.appendfsync
+	}
+	return appendfsync == APPENDFSYNC_ALWAYS
+}
@@ -0,0 +1,117 @@
+package pgredis
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/yob/pgredis/internal/repositories"
+)
+
+// The error codes redis uses to prefix its error replies. Clients use them to decide how to handle
+// an error, for example by retrying a command that failed with TRYAGAIN.
+const (
+	ERR_PREFIX       = "ERR"
+	WRONGTYPE_PREFIX = "WRONGTYPE"
+	BUSY_PREFIX      = "BUSY"
+	TRYAGAIN_PREFIX  = "TRYAGAIN"
+	EXECABORT_PREFIX = "EXECABORT"
+	NOAUTH_PREFIX    = "NOAUTH"
+	NOPERM_PREFIX    = "NOPERM"
+	WRONGPASS_PREFIX = "WRONGPASS"
+	NOPROTO_PREFIX   = "NOPROTO"
+	READONLY_PREFIX  = "READONLY"
+)
+
+// Every prefix above. Errors from elsewhere that start with one of these are passed on with it.
+var ERROR_PREFIXES = []string{
+	ERR_PREFIX, WRONGTYPE_PREFIX, BUSY_PREFIX, TRYAGAIN_PREFIX, EXECABORT_PREFIX, NOAUTH_PREFIX,
+	NOPERM_PREFIX, WRONGPASS_PREFIX, NOPROTO_PREFIX, READONLY_PREFIX,
+}
+
+// An error that's returned to the client. Commands should return these for any problem caused by
+// the request, and the message is sent to the client as-is.
+type redisError struct {
+	prefix  string
+	message string
+}
+
+func (err *redisError) Error() string {
+	return err.prefix + " " + err.message
+}
+
+func newRedisError(prefix string, message string) *redisError {
+	return &redisError{
+		prefix:  prefix,
+		message: message,
+	}
+}
+
+// A generic error, with the ERR prefix
+func newErr(format string, args ...interface{}) *redisError {
+	return newRedisError(ERR_PREFIX, fmt.Sprintf(format, args...))
+}
+
+// Redis uses the ERR prefix for syntax errors, so we do too
+func newSyntaxError() *redisError {
+	return newErr("syntax error")
+}
+
+func newWrongTypeError() *redisError {
+	return newRedisError(WRONGTYPE_PREFIX, "Operation against a key holding the wrong kind of value")
+}
+
+// Convert any error into one we can send to the client.
+//
+// Postgres errors caused by contention between clients are mapped to the codes redis uses for
+// errors that are worth retrying. Anything else we didn't expect is returned with the ERR prefix.
+func toRedisError(err error) *redisError {
+	if err == repositories.ErrWrongType {
+		return newWrongTypeError()
+	}
+
+	switch typedErr := err.(type) {
+	case *redisError:
+		return typedErr
+	case *pq.Error:
+		switch typedErr.Code.Name() {
+		case "lock_not_available":
+			return newRedisError(TRYAGAIN_PREFIX, "timed out waiting for a lock, the key is busy")
+		case "deadlock_detected":
+			return newRedisError(TRYAGAIN_PREFIX, "deadlock detected")
+		case "serialization_failure":
+			return newRedisError(TRYAGAIN_PREFIX, "could not serialize access due to a concurrent update")
+		case "query_canceled":
+			return newRedisError(BUSY_PREFIX, "statement timeout exceeded, the database is busy")
+		default:
+			return newErr("%s", typedErr.Message)
+		}
+	default:
+		message := err.Error()
+		if hasErrorPrefix(message) {
+			parts := strings.SplitN(message, " ", 2)
+			return newRedisError(parts[0], parts[1])
+		}
+		return newErr("%s", message)
+	}
+}
+
+// Whether message starts with one of the prefixes redis uses, rather than a word that just
+// happens to be in capitals (like "SQL" or "UTF8" in a message from postgres)
+func hasErrorPrefix(message string) bool {
+	parts := strings.SplitN(message, " ", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	for _, prefix := range ERROR_PREFIXES {
+		if parts[0] == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// The reply to send to a client when a command fails
+func newPgRedisErrorFromError(err error) pgRedisValue {
+	return newPgRedisError(toRedisError(err).Error())
+}
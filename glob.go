@@ -0,0 +1,154 @@
+package pgredis
+
+import (
+	"strings"
+
+	"github.com/yob/pgredis/internal/repositories"
+)
+
+// Match str against a redis-style glob pattern, as used by PSUBSCRIBE, KEYS and friends. This
+// follows the rules of stringmatchlen() in the redis source. A star matches any number of
+// characters, a question mark matches a single character, brackets match one of the characters
+// they contain ([abc], [^abc] or [a-z]) and a backslash escapes the following character.
+//
+// Matching is byte-wise and case sensitive.
+func globMatch(pattern string, str string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			// collapse consecutive stars
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(str); i++ {
+				if globMatch(pattern[1:], str[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(str) == 0 {
+				return false
+			}
+			str = str[1:]
+			pattern = pattern[1:]
+		case '[':
+			if len(str) == 0 {
+				return false
+			}
+			var matched bool
+			matched, pattern = matchBracket(pattern[1:], str[0])
+			if !matched {
+				return false
+			}
+			str = str[1:]
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(str) == 0 || pattern[0] != str[0] {
+				return false
+			}
+			str = str[1:]
+			pattern = pattern[1:]
+		}
+	}
+	return len(str) == 0
+}
+
+// Match a single character against a bracket expression. pattern starts just after the opening
+// bracket, and the remainder of the pattern after the closing bracket is returned.
+func matchBracket(pattern string, char byte) (bool, string) {
+	negate := len(pattern) > 0 && pattern[0] == '^'
+	if negate {
+		pattern = pattern[1:]
+	}
+
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		if pattern[0] == '\\' && len(pattern) >= 2 {
+			if pattern[1] == char {
+				matched = true
+			}
+			pattern = pattern[2:]
+		} else if len(pattern) >= 3 && pattern[1] == '-' && pattern[2] != ']' {
+			start, end := pattern[0], pattern[2]
+			if start > end {
+				start, end = end, start
+			}
+			if char >= start && char <= end {
+				matched = true
+			}
+			pattern = pattern[3:]
+		} else {
+			if pattern[0] == char {
+				matched = true
+			}
+			pattern = pattern[1:]
+		}
+	}
+	// skip the closing bracket, if there is one
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+
+	if negate {
+		matched = !matched
+	}
+	return matched, pattern
+}
+
+// Translate a glob pattern for keys into a filter, so postgres does as much of the matching as it
+// can. The literal characters at the start of the pattern become a prefix, which limits the keys
+// to a range of the primary key, and a pattern without brackets becomes a LIKE pattern.
+//
+// Returns false if the keys the filter finds still have to be checked with globMatch, because the
+// pattern has brackets that LIKE can't express.
+func globKeyFilter(pattern string) (repositories.KeyFilter, bool) {
+	filter := repositories.KeyFilter{}
+	if pattern != "" && strings.Trim(pattern, "*") == "" {
+		return filter, true
+	}
+
+	prefix, like := []byte{}, []byte{}
+	literal := true
+	exact := true
+	for idx := 0; idx < len(pattern); idx++ {
+		char := pattern[idx]
+		switch {
+		case char == '*':
+			literal = false
+			like = append(like, '%')
+		case char == '?':
+			literal = false
+			like = append(like, '_')
+		case char == '[':
+			literal = false
+			exact = false
+		default:
+			// a backslash escapes the next character, unless it's the last one
+			if char == '\\' && idx+1 < len(pattern) {
+				idx++
+				char = pattern[idx]
+			}
+			if literal {
+				prefix = append(prefix, char)
+			}
+			if char == '%' || char == '_' || char == '\\' {
+				like = append(like, '\\')
+			}
+			like = append(like, char)
+		}
+	}
+
+	filter.Prefix = prefix
+	if exact {
+		filter.Like = like
+	}
+	return filter, exact
+}
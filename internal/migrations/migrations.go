@@ -0,0 +1,416 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/yob/pgredis/internal/repositories"
+)
+
+// Migrations are run with the two argument form of pg_advisory_xact_lock, like keys and users. Keys
+// use the number of their database as the first argument, users use -2 and the expiry reaper -3.
+const migrationLockSpace = -4
+
+// A change to the schema. Migrations are applied in order of Version, and each version is recorded
+// in the redismigrations table once it's applied.
+//
+// Statements are plain SQL, so a dry run can print exactly what will run. The first few migrations
+// create the schema that earlier versions of pgredis created on every start, so they use IF NOT
+// EXISTS to leave those databases as they are.
+//
+// Some statements can't run in a transaction, like CREATE INDEX CONCURRENTLY (which builds an
+// index without blocking writes to the table). A migration with OutsideTransaction runs each of
+// its statements on their own, once the migrations before it have been committed.
+type Migration struct {
+	Version            int
+	Description        string
+	Statements         []string
+	OutsideTransaction bool
+}
+
+// Every migration, in the order they're applied. New migrations go on the end, and a migration
+// should never change once it has been released.
+var All = []Migration{
+	{
+		Version:     1,
+		Description: "create the tables for keys, lists, sets, sorted sets and hashes",
+		Statements: []string{
+			"create table if not exists redisdata (db integer not null default 0, key bytea not null, type bytea not null, value bytea not null, expires_at timestamp with time zone NULL, PRIMARY KEY(db, key))",
+			upgradeForDatabases(),
+			"create table if not exists redislists (db integer not null default 0, key bytea not null, idx integer, value bytea not null, PRIMARY KEY(db, key, idx), FOREIGN KEY (db, key) REFERENCES redisdata (db, key) ON DELETE CASCADE ON UPDATE CASCADE)",
+			"create table if not exists redissets (db integer not null default 0, key bytea not null, value bytea not null, PRIMARY KEY(db, key, value), FOREIGN KEY (db, key) REFERENCES redisdata (db, key) ON DELETE CASCADE ON UPDATE CASCADE)",
+			"create table if not exists rediszsets (db integer not null default 0, key bytea not null, value bytea not null, score decimal not null, PRIMARY KEY(db, key, value), FOREIGN KEY (db, key) REFERENCES redisdata (db, key) ON DELETE CASCADE ON UPDATE CASCADE)",
+			"create table if not exists redishashes (db integer not null default 0, key bytea not null, field bytea not null, value bytea not null, PRIMARY KEY(db, key, field), FOREIGN KEY (db, key) REFERENCES redisdata (db, key) ON DELETE CASCADE ON UPDATE CASCADE)",
+		},
+	},
+	{
+		// clients blocked on a key (eg. BRPOP) queue here, so the longest waiting client is served first
+		Version:     2,
+		Description: "create the queue of blocked clients",
+		Statements: []string{
+			"create unlogged table if not exists redisblocked (ticket bigint not null, db integer not null, key bytea not null, expires_at timestamp with time zone not null, PRIMARY KEY(ticket, db, key))",
+			"create index if not exists redisblocked_db_key_ticket on redisblocked (db, key, ticket)",
+			"create sequence if not exists redisblocked_ticket_seq",
+		},
+	},
+	{
+		// every write to a key assigns it a new version, so WATCH can tell when a key has changed
+		Version:     3,
+		Description: "add a version to each key",
+		Statements: []string{
+			"create sequence if not exists redisdata_version_seq",
+			"alter table redisdata add column if not exists version bigint not null default nextval('redisdata_version_seq')",
+		},
+	},
+	{
+		// ACL users are shared by every instance, and stored as the rules ACL LIST prints
+		Version:     4,
+		Description: "create the ACL users table and the default user",
+		Statements: []string{
+			"create table if not exists redisusers (name text PRIMARY KEY, rules text not null)",
+			fmt.Sprintf("insert into redisusers (name, rules) values (%s, %s) on conflict do nothing", pq.QuoteLiteral(repositories.DefaultUserName), pq.QuoteLiteral(repositories.DefaultUserRules)),
+		},
+	},
+	{
+		// the expiry reaper looks for expired keys, and most keys never expire. redisdata can be big
+		// by now, so the index is built without blocking writes. A build that fails part way leaves
+		// an invalid index behind, so any index left by an earlier attempt is dropped first.
+		Version:            5,
+		Description:        "index keys that expire",
+		OutsideTransaction: true,
+		Statements: []string{
+			"drop index concurrently if exists redisdata_expires_at",
+			"create index concurrently redisdata_expires_at on redisdata (expires_at) where expires_at is not null",
+		},
+	},
+	{
+		Version:     6,
+		Description: "create the table of config parameters shared by every instance",
+		Statements: []string{
+			"create table if not exists redisconfig (name text PRIMARY KEY, value text not null)",
+		},
+	},
+	{
+		// SCAN's cursors are numbers, so the key each one continues from is saved here
+		Version:     7,
+		Description: "create the table of SCAN cursors",
+		Statements: []string{
+			"create sequence if not exists rediscursors_id_seq",
+			"create unlogged table if not exists rediscursors (id bigint PRIMARY KEY default nextval('rediscursors_id_seq'), key bytea not null, expires_at timestamp with time zone not null)",
+			"create index if not exists rediscursors_expires_at on rediscursors (expires_at)",
+		},
+	},
+	{
+		// pubsub messages that are too big for a NOTIFY payload are passed on in here
+		Version:     8,
+		Description: "create the table of large pubsub messages",
+		Statements: []string{
+			"create sequence if not exists redismessages_id_seq",
+			"create unlogged table if not exists redismessages (id bigint PRIMARY KEY default nextval('redismessages_id_seq'), channel bytea not null, message bytea not null, created_at timestamp with time zone not null default now())",
+			"create index if not exists redismessages_created_at on redismessages (created_at)",
+		},
+	},
+	{
+		// SCAN's cursors now hold the key they continue from themselves
+		Version:     9,
+		Description: "drop the table of SCAN cursors",
+		Statements: []string{
+			"drop table if exists rediscursors",
+			"drop sequence if exists rediscursors_id_seq",
+		},
+	},
+	{
+		// a key that's deleted keeps a version here, so WATCH can tell it was deleted even if it
+		// didn't exist when it was watched. Every way of deleting a key ends up here through the
+		// trigger, apart from FLUSHALL, which truncates redisdata.
+		Version:     10,
+		Description: "record the version of deleted keys",
+		Statements: []string{
+			"create table redisdeleted (db integer not null, key bytea not null, version bigint not null, deleted_at timestamp with time zone not null default now(), PRIMARY KEY(db, key))",
+			"create index redisdeleted_deleted_at on redisdeleted (deleted_at)",
+			"create function redisdata_deleted() returns trigger language plpgsql as $$\n" +
+				"BEGIN\n" +
+				"  -- an expired key has already gone as far as WATCH is concerned\n" +
+				"  IF OLD.expires_at IS NOT NULL AND OLD.expires_at <= now() THEN\n" +
+				"    RETURN NULL;\n" +
+				"  END IF;\n" +
+				"  IF TG_OP = 'UPDATE' THEN\n" +
+				"    IF NEW.db = OLD.db AND NEW.key = OLD.key THEN\n" +
+				"      RETURN NULL;\n" +
+				"    END IF;\n" +
+				"  END IF;\n" +
+				"  INSERT INTO redisdeleted (db, key, version) VALUES (OLD.db, OLD.key, nextval('redisdata_version_seq'))\n" +
+				"    ON CONFLICT (db, key) DO UPDATE SET version = excluded.version, deleted_at = now();\n" +
+				"  RETURN NULL;\n" +
+				"END $$",
+			"create trigger redisdata_deleted after delete or update of db, key on redisdata for each row execute procedure redisdata_deleted()",
+		},
+	},
+}
+
+// Before we supported SELECT, every table was keyed on the redis key alone. Databases created by
+// those versions get a db column on each table, and all existing data ends up in database 0.
+func upgradeForDatabases() string {
+	// the primary key of each child table, minus the db column
+	childTables := []struct {
+		name       string
+		primaryKey string
+	}{
+		{"redislists", "key, idx"},
+		{"redissets", "key, value"},
+		{"rediszsets", "key, value"},
+		{"redishashes", "key, field"},
+	}
+
+	statements := []string{}
+	for _, table := range childTables {
+		statements = append(statements, fmt.Sprintf("alter table if exists %s drop constraint if exists %s_key_fkey", table.name, table.name))
+	}
+	statements = append(statements,
+		"alter table redisdata add column db integer not null default 0",
+		"alter table redisdata drop constraint redisdata_pkey, add PRIMARY KEY(db, key)",
+	)
+	for _, table := range childTables {
+		statements = append(statements,
+			fmt.Sprintf("alter table if exists %s add column db integer not null default 0", table.name),
+			fmt.Sprintf("alter table if exists %s drop constraint %s_pkey, add PRIMARY KEY(db, %s)", table.name, table.name, table.primaryKey),
+			fmt.Sprintf("alter table if exists %s add FOREIGN KEY (db, key) REFERENCES redisdata (db, key) ON DELETE CASCADE ON UPDATE CASCADE", table.name),
+		)
+	}
+	// only clients waiting right now have rows in here, so it's simpler to start again
+	statements = append(statements, "drop table if exists redisblocked")
+
+	return "DO $$ BEGIN\n" +
+		"  IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = 'redisdata' AND column_name = 'db') THEN\n" +
+		"    " + strings.Join(statements, ";\n    ") + ";\n" +
+		"  END IF;\n" +
+		"END $$"
+}
+
+// The statements that start a migration run. The lock makes any other instance that's migrating
+// at the same time wait, and then find there's nothing left to do. Migrations outside a
+// transaction commit part way through a run, so the lock is held by the session until the run is
+// over. Migrations can take longer than the timeouts pgredis uses for commands, so they're turned
+// off.
+//
+// With a schema, the connection's search_path already points at it, so once it exists the tables
+// are created there.
+func preamble(schema string) []string {
+	statements := []string{
+		"SET statement_timeout = 0",
+		"SET lock_timeout = 0",
+		fmt.Sprintf("SELECT pg_advisory_lock(%d, 0)", migrationLockSpace),
+	}
+	if schema != "" {
+		statements = append(statements, "create schema if not exists "+pq.QuoteIdentifier(schema))
+	}
+	return append(statements, "create table if not exists redismigrations (version integer PRIMARY KEY, description text not null, applied_at timestamp with time zone not null default now())")
+}
+
+// The statement that ends a migration run
+func postamble() string {
+	return fmt.Sprintf("SELECT pg_advisory_unlock(%d, 0)", migrationLockSpace)
+}
+
+// The statements that apply a migration and record it
+func (migration Migration) statements() []string {
+	record := fmt.Sprintf("insert into redismigrations (version, description) values (%d, %s)", migration.Version, pq.QuoteLiteral(migration.Description))
+	return append(append([]string{}, migration.Statements...), record)
+}
+
+// Split migrations into the batches they're applied in. Consecutive migrations share a
+// transaction, and a migration that runs outside a transaction is a batch of its own.
+func batches(migrations []Migration) [][]Migration {
+	result := [][]Migration{}
+	for idx, migration := range migrations {
+		if idx == 0 || migration.OutsideTransaction || migrations[idx-1].OutsideTransaction {
+			result = append(result, []Migration{})
+		}
+		result[len(result)-1] = append(result[len(result)-1], migration)
+	}
+	return result
+}
+
+// A migration, and when it was applied. AppliedAt is nil if it hasn't been.
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Every migration, and whether it has been applied
+func Statuses(db *sql.DB) ([]Status, error) {
+	applied, err := appliedAt(db)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []Status{}
+	for _, migration := range All {
+		status := Status{Migration: migration}
+		if at, ok := applied[migration.Version]; ok {
+			status.AppliedAt = &at
+		}
+		result = append(result, status)
+	}
+	return result, nil
+}
+
+// The migrations that haven't been applied yet, in order
+func Pending(db *sql.DB) ([]Migration, error) {
+	applied, err := appliedAt(db)
+	if err != nil {
+		return nil, err
+	}
+	return pending(applied), nil
+}
+
+func pending(applied map[int]time.Time) []Migration {
+	result := []Migration{}
+	for _, migration := range All {
+		if _, ok := applied[migration.Version]; !ok {
+			result = append(result, migration)
+		}
+	}
+	return result
+}
+
+// The script that Up would run to apply migrations, for a dry run
+func Script(schema string, migrations []Migration) string {
+	lines := []string{}
+	for _, statement := range preamble(schema) {
+		lines = append(lines, statement+";")
+	}
+	for _, batch := range batches(migrations) {
+		if !batch[0].OutsideTransaction {
+			lines = append(lines, "", "BEGIN;")
+		}
+		for _, migration := range batch {
+			lines = append(lines, "", fmt.Sprintf("-- %d: %s", migration.Version, migration.Description))
+			for _, statement := range migration.statements() {
+				lines = append(lines, statement+";")
+			}
+		}
+		if !batch[0].OutsideTransaction {
+			lines = append(lines, "", "COMMIT;")
+		}
+	}
+	lines = append(lines, "", postamble()+";")
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Apply every pending migration, returning the ones that were applied. Each batch of migrations
+// (see batches) is applied in a single transaction, so if any migration in it fails, none of the
+// batch is applied. Batches before it stay applied.
+//
+// The run holds a connection of its own, as the lock and the settings in the preamble belong to
+// its session. The timeouts are put back before it returns to the pool.
+func Up(db *sql.DB, schema string) ([]Migration, error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var statementTimeout, lockTimeout string
+	err = conn.QueryRowContext(ctx, "SELECT current_setting('statement_timeout'), current_setting('lock_timeout')").Scan(&statementTimeout, &lockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.ExecContext(ctx, "SELECT set_config('statement_timeout', $1, false), set_config('lock_timeout', $2, false)", statementTimeout, lockTimeout)
+	defer conn.ExecContext(ctx, postamble())
+
+	for _, statement := range preamble(schema) {
+		_, err = conn.ExecContext(ctx, statement)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// now we hold the lock, another instance can't be applying the same migrations
+	applied, err := queryAppliedAt(func(query string, args ...interface{}) (*sql.Rows, error) {
+		return conn.QueryContext(ctx, query, args...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := []Migration{}
+	for _, batch := range batches(pending(applied)) {
+		err = applyBatch(ctx, conn, batch)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, batch...)
+	}
+	return result, nil
+}
+
+func applyBatch(ctx context.Context, conn *sql.Conn, batch []Migration) error {
+	if batch[0].OutsideTransaction {
+		return apply(ctx, conn, batch)
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = apply(ctx, tx, batch)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// A connection or a transaction to apply migrations with
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func apply(ctx context.Context, db execer, migrations []Migration) error {
+	for _, migration := range migrations {
+		for _, statement := range migration.statements() {
+			_, err := db.ExecContext(ctx, statement)
+			if err != nil {
+				return fmt.Errorf("migration %d (%s) failed: %v", migration.Version, migration.Description, err)
+			}
+		}
+	}
+	return nil
+}
+
+// When each applied migration was applied. A database that has never been migrated has no
+// redismigrations table, and nothing applied.
+func appliedAt(db *sql.DB) (map[int]time.Time, error) {
+	var exists bool
+	err := db.QueryRow("SELECT to_regclass('redismigrations') IS NOT NULL").Scan(&exists)
+	if err != nil || !exists {
+		return map[int]time.Time{}, err
+	}
+	return queryAppliedAt(db.Query)
+}
+
+func queryAppliedAt(query func(string, ...interface{}) (*sql.Rows, error)) (map[int]time.Time, error) {
+	result := map[int]time.Time{}
+	rows, err := query("SELECT version, applied_at FROM redismigrations")
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		var at time.Time
+		err = rows.Scan(&version, &at)
+		if err != nil {
+			return result, err
+		}
+		result[version] = at
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,128 @@
+package repositories
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Clients blocked on a key (eg. BRPOP, BZPOPMIN) can LISTEN on this channel to be notified when the
+// key might have a value for them. The payload is the database number and the key's digest (see
+// KeyDigest), separated by a colon. Keys can be much longer than a notification payload allows,
+// and a woken client checks the key again anyway, so the digest is enough.
+const KeyReadyChannel = "pgredis_key_ready"
+
+// Blocked clients on every pgredis instance are recorded in a shared queue, so that when a value
+// arrives the client that has been waiting the longest gets it, just like real redis.
+//
+// Each blocked client is assigned a ticket from a sequence, and has one row per key it's waiting
+// on. The rows have a lease that the client refreshes while it waits, so a client on an instance
+// that disappears stops holding its place in the queue once the lease expires.
+type BlockedClientRepository struct{}
+
+func NewBlockedClientRepository() *BlockedClientRepository {
+	return &BlockedClientRepository{}
+}
+
+func (repo *BlockedClientRepository) Register(tx Querier, db int, keys []string, lease time.Duration) (ticket int64, err error) {
+	sqlStat := "SELECT nextval('redisblocked_ticket_seq')"
+	err = tx.QueryRow(sqlStat).Scan(&ticket)
+	if err != nil {
+		return 0, err
+	}
+
+	interval := fmt.Sprintf("%d milliseconds", lease.Milliseconds())
+	for _, key := range keys {
+		sqlStat = "INSERT INTO redisblocked(ticket, db, key, expires_at) VALUES ($1, $2, $3, now() + cast($4 as interval)) ON CONFLICT (ticket, db, key) DO NOTHING"
+		_, err = tx.Exec(sqlStat, ticket, db, []byte(key), interval)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return ticket, nil
+}
+
+func (repo *BlockedClientRepository) Refresh(tx Querier, ticket int64, lease time.Duration) error {
+	sqlStat := "UPDATE redisblocked SET expires_at = now() + cast($2 as interval) WHERE ticket = $1"
+	interval := fmt.Sprintf("%d milliseconds", lease.Milliseconds())
+	_, err := tx.Exec(sqlStat, ticket, interval)
+	return err
+}
+
+// Remove a client from the queue. Any other clients waiting on the same keys are notified, as
+// they may have been holding back for us.
+func (repo *BlockedClientRepository) Unregister(tx Querier, ticket int64) error {
+	sqlStat := "DELETE FROM redisblocked WHERE ticket = $1 RETURNING db, key"
+	rows, err := tx.Query(sqlStat, ticket)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var db int
+	keys := [][]byte{}
+	for rows.Next() {
+		var key []byte
+		err = rows.Scan(&db, &key)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		err = notifyKeyReady(tx, db, key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns true if a client with a lower ticket is still waiting on key
+func (repo *BlockedClientRepository) HasEarlierWaiter(tx Querier, db int, key []byte, ticket int64) (bool, error) {
+	var exists bool
+
+	sqlStat := "SELECT EXISTS (SELECT 1 FROM redisblocked WHERE db = $1 AND key = $2 AND ticket < $3 AND expires_at > now())"
+	err := tx.QueryRow(sqlStat, db, key, ticket).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+// wake any blocked clients (on any pgredis instance) that are waiting on key. Postgres delays
+// delivery until the transaction commits, so they won't wake before the new value is visible
+func notifyKeyReady(tx Querier, db int, key []byte) error {
+	sqlStat := "SELECT pg_notify(current_setting('pgredis.channel_prefix') || $1, $2 || ':' || md5($3))"
+	_, err := tx.Exec(sqlStat, KeyReadyChannel, strconv.Itoa(db), key)
+	return err
+}
+
+// The digest of a key in KeyReadyChannel payloads, which is the md5 of the key in hex like
+// postgres's md5()
+func KeyDigest(key []byte) string {
+	digest := md5.Sum(key)
+	return hex.EncodeToString(digest[:])
+}
+
+// Decode the payload of a notification received on KeyReadyChannel
+func DecodeKeyReadyPayload(payload string) (db int, digest string, err error) {
+	parts := strings.SplitN(payload, ":", 2)
+	if len(parts) != 2 {
+		return 0, "", errors.New("invalid key ready payload")
+	}
+	db, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", err
+	}
+	return db, parts[1], nil
+}
@@ -0,0 +1,45 @@
+package repositories
+
+import (
+	"database/sql"
+)
+
+// Every pgredis instance LISTENs on this channel, so it can reload a config parameter when it's
+// changed by another instance. The payload is the name of the parameter.
+const ConfigChangedChannel = "pgredis_config"
+
+// Most config parameters only apply to the instance they're set on, but a few need to be the same
+// on every instance, so they're stored in the database.
+type ConfigRepository struct{}
+
+func NewConfigRepository() *ConfigRepository {
+	return &ConfigRepository{}
+}
+
+// The value of a parameter, if it has been set
+func (repo *ConfigRepository) Get(tx Querier, name string) (bool, string, error) {
+	var value string
+	sqlStat := "SELECT value FROM redisconfig WHERE name = $1"
+	err := tx.QueryRow(sqlStat, name).Scan(&value)
+	switch {
+	case err == sql.ErrNoRows:
+		return false, "", nil
+	case err != nil:
+		return false, "", err
+	default:
+		return true, value, nil
+	}
+}
+
+// Set a parameter. Every instance is told about the change once the transaction commits.
+func (repo *ConfigRepository) Save(tx Querier, name string, value string) error {
+	sqlStat := "INSERT INTO redisconfig (name, value) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value"
+	_, err := tx.Exec(sqlStat, name, value)
+	if err != nil {
+		return err
+	}
+
+	sqlStat = "SELECT pg_notify(current_setting('pgredis.channel_prefix') || $1, $2)"
+	_, err = tx.Exec(sqlStat, ConfigChangedChannel, name)
+	return err
+}
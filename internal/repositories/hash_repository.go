@@ -4,23 +4,29 @@ import (
 	"database/sql"
 )
 
-type HashRepository struct{}
+type HashRepository struct {
+	events *KeyspaceEvents
+}
 
-func NewHashRepository() *HashRepository {
-	return &HashRepository{}
+func NewHashRepository(events *KeyspaceEvents) *HashRepository {
+	return &HashRepository{events: events}
 }
 
-func (repo *HashRepository) Get(tx *sql.Tx, key []byte, field []byte) (success bool, value []byte, err error) {
+func (repo *HashRepository) Get(tx Querier, db int, key []byte, field []byte) (success bool, value []byte, err error) {
+	if err := checkType(tx, db, key, "hash"); err != nil {
+		return false, nil, err
+	}
 
 	sqlStat := `
 			SELECT redishashes.value
-			FROM redisdata INNER JOIN redishashes ON redisdata.key = redishashes.key
-			WHERE redisdata.key = $1 AND
-				redishashes.field = $2 AND
+			FROM redisdata INNER JOIN redishashes ON redisdata.db = redishashes.db AND redisdata.key = redishashes.key
+			WHERE redisdata.db = $1 AND
+				redisdata.key = $2 AND
+				redishashes.field = $3 AND
 				(redisdata.expires_at > now() OR expires_at IS NULL)
 	`
 
-	row := tx.QueryRow(sqlStat, key, field)
+	row := tx.QueryRow(sqlStat, db, key, field)
 
 	switch err := row.Scan(&value); err {
 	case sql.ErrNoRows:
@@ -32,16 +38,21 @@ func (repo *HashRepository) Get(tx *sql.Tx, key []byte, field []byte) (success b
 	}
 }
 
-func (repo *HashRepository) GetAll(tx *sql.Tx, key []byte) (fields_and_values []string, err error) {
+func (repo *HashRepository) GetAll(tx Querier, db int, key []byte) (fields_and_values []string, err error) {
+	if err := checkType(tx, db, key, "hash"); err != nil {
+		return nil, err
+	}
+
 	fields_and_values = []string{}
 	sqlStat := `
 			SELECT redishashes.field, redishashes.value
-			FROM redisdata INNER JOIN redishashes ON redisdata.key = redishashes.key
-			WHERE redisdata.key = $1 AND
+			FROM redisdata INNER JOIN redishashes ON redisdata.db = redishashes.db AND redisdata.key = redishashes.key
+			WHERE redisdata.db = $1 AND
+				redisdata.key = $2 AND
 				(redisdata.expires_at > now() OR expires_at IS NULL)
 	`
 
-	rows, err := tx.Query(sqlStat, key)
+	rows, err := tx.Query(sqlStat, db, key)
 	if err != nil {
 		return fields_and_values, err
 	}
@@ -63,34 +74,37 @@ func (repo *HashRepository) GetAll(tx *sql.Tx, key []byte) (fields_and_values []
 	return fields_and_values, nil
 }
 
-func (repo *HashRepository) Set(tx *sql.Tx, key []byte, field []byte, value []byte) (inserted int64, err error) {
+func (repo *HashRepository) Set(tx Querier, db int, key []byte, field []byte, value []byte) (inserted int64, err error) {
 
 	// delete any expired rows in the db with this key
-	sqlStat := "DELETE FROM redisdata WHERE key=$1 AND expires_at < now()"
-	_, err = tx.Exec(sqlStat, key)
+	err = deleteExpired(tx, repo.events, db, key)
 	if err != nil {
 		return 0, err
 	}
 
-	// ensure the db has a current key
-	sqlStat = "INSERT INTO redisdata(key, type, value, expires_at) VALUES ($1, 'hash', '', NULL) ON CONFLICT (key) DO NOTHING"
-	_, err = tx.Exec(sqlStat, key)
+	// ensure the db has a current key, and check it holds the right type
+	var keyType string
+	sqlStat := "INSERT INTO redisdata(db, key, type, value, expires_at) VALUES ($1, $2, 'hash', '', NULL) ON CONFLICT (db, key) DO UPDATE SET version = nextval('redisdata_version_seq') RETURNING type"
+	err = tx.QueryRow(sqlStat, db, key).Scan(&keyType)
 
 	if err != nil {
 		return 0, err
 	}
+	if keyType != "hash" {
+		return 0, ErrWrongType
+	}
 
 	// now lock that key so no one else can change it
-	sqlStat = "SELECT key FROM redisdata WHERE redisdata.key = $1 AND (redisdata.expires_at > now() OR expires_at IS NULL) FOR UPDATE"
-	_, err = tx.Exec(sqlStat, key)
+	sqlStat = "SELECT key FROM redisdata WHERE redisdata.db = $1 AND redisdata.key = $2 AND (redisdata.expires_at > now() OR expires_at IS NULL) FOR UPDATE"
+	_, err = tx.Exec(sqlStat, db, key)
 
 	if err != nil {
 		return 0, err
 	}
 
 	// first, try and update an existing field
-	sqlStat = "UPDATE redishashes SET value = $3 WHERE key = $1 and field = $2"
-	res, err := tx.Exec(sqlStat, key, field, value)
+	sqlStat = "UPDATE redishashes SET value = $4 WHERE db = $1 and key = $2 and field = $3"
+	res, err := tx.Exec(sqlStat, db, key, field, value)
 	if err != nil {
 		return 0, err
 	}
@@ -98,37 +112,45 @@ func (repo *HashRepository) Set(tx *sql.Tx, key []byte, field []byte, value []by
 
 	// no updates, so should be safe to insert
 	if rowCount == 0 {
-		sqlStat = "INSERT INTO redishashes (key, field, value) values ($1, $2, $3)"
-		res, err := tx.Exec(sqlStat, key, field, value)
+		sqlStat = "INSERT INTO redishashes (db, key, field, value) values ($1, $2, $3, $4)"
+		res, err := tx.Exec(sqlStat, db, key, field, value)
 		if err != nil {
 			return 0, err
 		}
 		inserted, _ = res.RowsAffected()
 	}
 
+	err = repo.events.notify(tx, NotifyHash, "hset", db, key)
+	if err != nil {
+		return 0, err
+	}
+
 	return inserted, nil
 }
 
-func (repo *HashRepository) SetMultiple(tx *sql.Tx, key string, fields_and_values map[string]string) (err error) {
+func (repo *HashRepository) SetMultiple(tx Querier, db int, key string, fields_and_values map[string]string) (err error) {
 
 	// delete any expired rows in the db with this key
-	sqlStat := "DELETE FROM redisdata WHERE key=$1 AND expires_at < now()"
-	_, err = tx.Exec(sqlStat, key)
+	err = deleteExpired(tx, repo.events, db, []byte(key))
 	if err != nil {
 		return err
 	}
 
-	// ensure the db has a current key
-	sqlStat = "INSERT INTO redisdata(key, type, value, expires_at) VALUES ($1, 'hash', '', NULL) ON CONFLICT (key) DO NOTHING"
-	_, err = tx.Exec(sqlStat, key)
+	// ensure the db has a current key, and check it holds the right type
+	var keyType string
+	sqlStat := "INSERT INTO redisdata(db, key, type, value, expires_at) VALUES ($1, $2, 'hash', '', NULL) ON CONFLICT (db, key) DO UPDATE SET version = nextval('redisdata_version_seq') RETURNING type"
+	err = tx.QueryRow(sqlStat, db, key).Scan(&keyType)
 
 	if err != nil {
 		return err
 	}
+	if keyType != "hash" {
+		return ErrWrongType
+	}
 
 	// now lock that key so no one else can change it
-	sqlStat = "SELECT key FROM redisdata WHERE redisdata.key = $1 AND (redisdata.expires_at > now() OR expires_at IS NULL) FOR UPDATE"
-	_, err = tx.Exec(sqlStat, key)
+	sqlStat = "SELECT key FROM redisdata WHERE redisdata.db = $1 AND redisdata.key = $2 AND (redisdata.expires_at > now() OR expires_at IS NULL) FOR UPDATE"
+	_, err = tx.Exec(sqlStat, db, key)
 
 	if err != nil {
 		return err
@@ -136,12 +158,12 @@ func (repo *HashRepository) SetMultiple(tx *sql.Tx, key string, fields_and_value
 
 	for field, value := range fields_and_values {
 		// TODO could we do this in a single SQL statement?
-		sqlStat = "INSERT INTO redishashes (key, field, value) values ($1, $2, $3) ON CONFLICT (key, field) DO UPDATE SET value=$3"
-		_, err := tx.Exec(sqlStat, key, field, value)
+		sqlStat = "INSERT INTO redishashes (db, key, field, value) values ($1, $2, $3, $4) ON CONFLICT (db, key, field) DO UPDATE SET value=$4"
+		_, err := tx.Exec(sqlStat, db, key, field, value)
 		if err != nil {
 			return err
 		}
 	}
 
-	return nil
+	return repo.events.notify(tx, NotifyHash, "hset", db, []byte(key))
 }
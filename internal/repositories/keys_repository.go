@@ -6,56 +6,68 @@ import (
 	"fmt"
 	"github.com/lib/pq"
 	"sort"
+	"strings"
 	"time"
 )
 
-type KeyRepository struct{}
+// Returned when a command is used against a key that holds a different type of data, like LPUSH
+// against a string.
+var ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
 
-func NewKeyRepository() *KeyRepository {
-	return &KeyRepository{}
+type KeyRepository struct {
+	events *KeyspaceEvents
 }
 
-func (repo *KeyRepository) LockKeys(tx *sql.Tx, keys []string) (error) {
+func NewKeyRepository(events *KeyspaceEvents) *KeyRepository {
+	return &KeyRepository{events: events}
+}
+
+// Keys are locked within a database, so the same key in two databases can be changed at once.
+// Each schema has keys of its own, so the schema is part of the lock too.
+func (repo *KeyRepository) LockKeys(tx Querier, db int, keys []string) error {
 	if len(keys) == 0 {
 		return nil
 	}
 
-	// take an exclusive lock for each key, in sorted order to avoid deadlocks
-	// TODO we should probably remove dupe keys here
-	sort.Strings(keys)
+	// take an exclusive lock for each key, in sorted order to avoid deadlocks. The locks are all
+	// taken in one statement, and unnest returns the keys in the order we give them.
+	unique := map[string]bool{}
+	sortedKeys := []string{}
 	for _, key := range keys {
-		sqlStat := "SELECT pg_advisory_xact_lock(hashtext($1))"
-		_, err := tx.Exec(sqlStat, key)
-		if err != nil {
-			return err
+		if !unique[key] {
+			unique[key] = true
+			sortedKeys = append(sortedKeys, key)
 		}
 	}
-	return nil
+	sort.Strings(sortedKeys)
+
+	sqlStat := "SELECT pg_advisory_xact_lock($1, hashtext(current_schema() || key)) FROM unnest($2::text[]) AS key"
+	_, err := tx.Exec(sqlStat, db, pq.Array(sortedKeys))
+	return err
 }
 
-func (repo *KeyRepository) Count(tx *sql.Tx) (int64, error) {
+func (repo *KeyRepository) Count(tx Querier, db int) (int64, error) {
 	var count int64
 
-	sqlStat := "SELECT count(*) FROM redisdata WHERE redisdata.expires_at > now() OR expires_at IS NULL"
-	err := tx.QueryRow(sqlStat).Scan(&count)
+	sqlStat := "SELECT count(*) FROM redisdata WHERE db = $1 AND (redisdata.expires_at > now() OR expires_at IS NULL)"
+	err := tx.QueryRow(sqlStat, db).Scan(&count)
 	if err != nil {
 		return 0, err
 	}
 	return count, nil
 }
 
-func (repo *KeyRepository) Delete(tx *sql.Tx, key []byte) (updated bool, err error) {
+func (repo *KeyRepository) Delete(tx Querier, db int, key []byte) (updated bool, err error) {
 
 	// delete any expired rows in the db with this key
 	// we do this first so the count we return at the end doesn't include these rows
-	sqlStat := "DELETE FROM redisdata WHERE key=$1 AND expires_at < now()"
-	_, err = tx.Exec(sqlStat, key)
+	err = deleteExpired(tx, repo.events, db, key)
 	if err != nil {
 		return false, err
 	}
 
-	sqlStat = "DELETE FROM redisdata WHERE key=$1"
-	res, err := tx.Exec(sqlStat, key)
+	sqlStat := "DELETE FROM redisdata WHERE db = $1 AND key = $2"
+	res, err := tx.Exec(sqlStat, db, key)
 	if err != nil {
 		return false, err
 	}
@@ -65,47 +77,57 @@ func (repo *KeyRepository) Delete(tx *sql.Tx, key []byte) (updated bool, err err
 		return false, err
 	}
 
+	if count > 0 {
+		err = repo.events.notify(tx, NotifyGeneric, "del", db, key)
+		if err != nil {
+			return false, err
+		}
+	}
+
 	return count > 0, nil
 }
 
-func (repo *KeyRepository) Exist(tx *sql.Tx, key []byte) (bool, error) {
+func (repo *KeyRepository) Exist(tx Querier, db int, key []byte) (bool, error) {
 	var count int
 
-	sqlStat := "SELECT count(*) FROM redisdata WHERE redisdata.key = $1 AND (redisdata.expires_at > now() OR expires_at IS NULL)"
-	err := tx.QueryRow(sqlStat, key).Scan(&count)
+	sqlStat := "SELECT count(*) FROM redisdata WHERE redisdata.db = $1 AND redisdata.key = $2 AND (redisdata.expires_at > now() OR expires_at IS NULL)"
+	err := tx.QueryRow(sqlStat, db, key).Scan(&count)
 	if err != nil {
 		return false, err
 	}
 	return count > 0, nil
 }
 
-func (repo *KeyRepository) SetExpire(tx *sql.Tx, key []byte, expiry_secs int) (updated bool, err error) {
+func (repo *KeyRepository) SetExpire(tx Querier, db int, key []byte, expiry_secs int) (updated bool, err error) {
 	if expiry_secs <= 0 {
 		return false, errors.New("expiry_secs must be 1s or more")
 	} else if expiry_secs > 1000000000 {
 		return false, errors.New("expiry_secs must be 1,000,000,000 or lower") // that's over 31 years
 	}
 
-	sqlStat := "UPDATE redisdata SET expires_at=(now() + cast($2 as interval)) WHERE key=$1 AND (expires_at > now() OR expires_at IS NULL)"
+	sqlStat := "UPDATE redisdata SET expires_at=(now() + cast($3 as interval)), version = nextval('redisdata_version_seq') WHERE db = $1 AND key = $2 AND (expires_at > now() OR expires_at IS NULL)"
 	interval := fmt.Sprintf("%d seconds", expiry_secs)
-	res, err := tx.Exec(sqlStat, key, interval)
+	res, err := tx.Exec(sqlStat, db, key, interval)
 	if err != nil {
 		return false, err
 	}
 	count, _ := res.RowsAffected()
 	updated = count > 0
 
-	if err != nil {
-		return false, err
+	if updated {
+		err = repo.events.notify(tx, NotifyGeneric, "expire", db, key)
+		if err != nil {
+			return false, err
+		}
 	}
 	return updated, nil
 }
 
-func (repo *KeyRepository) TTLInMillis(tx *sql.Tx, key []byte) (bool, int64, error) {
+func (repo *KeyRepository) TTLInMillis(tx Querier, db int, key []byte) (bool, int64, error) {
 	var expiresAt pq.NullTime
 
-	sqlStat := "SELECT expires_at FROM redisdata WHERE key = $1 AND (expires_at > now() OR expires_at IS NULL)"
-	row := tx.QueryRow(sqlStat, key)
+	sqlStat := "SELECT expires_at FROM redisdata WHERE db = $1 AND key = $2 AND (expires_at > now() OR expires_at IS NULL)"
+	row := tx.QueryRow(sqlStat, db, key)
 
 	switch err := row.Scan(&expiresAt); err {
 	case sql.ErrNoRows:
@@ -122,11 +144,11 @@ func (repo *KeyRepository) TTLInMillis(tx *sql.Tx, key []byte) (bool, int64, err
 	}
 }
 
-func (repo *KeyRepository) Type(tx *sql.Tx, key []byte) (string, error) {
+func (repo *KeyRepository) Type(tx Querier, db int, key []byte) (string, error) {
 	var keyType string
 
-	sqlStat := "SELECT type FROM redisdata WHERE redisdata.key = $1 AND (redisdata.expires_at > now() OR expires_at IS NULL)"
-	row := tx.QueryRow(sqlStat, key)
+	sqlStat := "SELECT type FROM redisdata WHERE redisdata.db = $1 AND redisdata.key = $2 AND (redisdata.expires_at > now() OR expires_at IS NULL)"
+	row := tx.QueryRow(sqlStat, db, key)
 
 	switch err := row.Scan(&keyType); err {
 	case sql.ErrNoRows:
@@ -138,11 +160,361 @@ func (repo *KeyRepository) Type(tx *sql.Tx, key []byte) (string, error) {
 	}
 }
 
-func (repo *KeyRepository) FlushAll(tx *sql.Tx) error {
-	sqlStat := "TRUNCATE redisdata CASCADE"
+// How long the version of a deleted key is kept. WATCH can't tell if a key that didn't exist was
+// created and deleted again after this, so EXEC aborts transactions that have watched keys for
+// longer.
+const DeletedKeyLifetime = 24 * time.Hour
+
+// Every write to a key assigns it a new version from a shared sequence, so WATCH can detect when
+// a key changes. Deleting a key assigns a version to the key that's gone, in redisdeleted. Keys
+// that have never existed (or not since DeletedKeyLifetime) are version 0.
+func (repo *KeyRepository) Version(tx Querier, db int, key []byte) (int64, error) {
+	var version int64
+
+	sqlStat := "SELECT coalesce((SELECT version FROM redisdata WHERE db = $1 AND key = $2 AND (expires_at > now() OR expires_at IS NULL)), (SELECT version FROM redisdeleted WHERE db = $1 AND key = $2), 0)"
+	err := tx.QueryRow(sqlStat, db, key).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// Forget the versions of up to limit keys that were deleted more than DeletedKeyLifetime ago
+func (repo *KeyRepository) DeleteOldVersions(tx Querier, limit int) error {
+	sqlStat := "DELETE FROM redisdeleted WHERE (db, key) IN (SELECT db, key FROM redisdeleted WHERE deleted_at < now() - cast($1 as interval) LIMIT $2)"
+	interval := fmt.Sprintf("%d seconds", int64(DeletedKeyLifetime.Seconds()))
+	_, err := tx.Exec(sqlStat, interval, limit)
+	return err
+}
+
+func (repo *KeyRepository) FlushAll(tx Querier) error {
+	// TRUNCATE doesn't fire the trigger that records the versions of deleted keys, so they're
+	// recorded first
+	sqlStat := "INSERT INTO redisdeleted (db, key, version) SELECT db, key, nextval('redisdata_version_seq') FROM redisdata WHERE expires_at > now() OR expires_at IS NULL ON CONFLICT (db, key) DO UPDATE SET version = excluded.version, deleted_at = now()"
 	_, err := tx.Exec(sqlStat)
 	if err != nil {
 		return err
 	}
+
+	sqlStat = "TRUNCATE redisdata CASCADE"
+	_, err = tx.Exec(sqlStat)
+	if err != nil {
+		return err
+	}
 	return nil
 }
+
+// Delete every key in a single database. The rows in the child tables are removed by the
+// cascading foreign keys.
+func (repo *KeyRepository) FlushDb(tx Querier, db int) error {
+	sqlStat := "DELETE FROM redisdata WHERE db = $1"
+	_, err := tx.Exec(sqlStat, db)
+	return err
+}
+
+// Move key to another database, unless the key already exists there. Returns true if the key was
+// moved. The rows in the child tables follow it via the cascading foreign keys.
+func (repo *KeyRepository) Move(tx Querier, db int, key []byte, toDb int) (bool, error) {
+	err := deleteExpired(tx, repo.events, db, key)
+	if err != nil {
+		return false, err
+	}
+	err = deleteExpired(tx, repo.events, toDb, key)
+	if err != nil {
+		return false, err
+	}
+
+	sqlStat := "UPDATE redisdata SET db = $3, version = nextval('redisdata_version_seq') WHERE db = $1 AND key = $2 AND NOT EXISTS (SELECT 1 FROM redisdata WHERE db = $3 AND key = $2)"
+	res, err := tx.Exec(sqlStat, db, key, toDb)
+	if err != nil {
+		return false, err
+	}
+	count, _ := res.RowsAffected()
+	if count == 0 {
+		return false, nil
+	}
+
+	err = repo.events.notifyAll(tx, []keyspaceEvent{
+		{class: NotifyGeneric, name: "move_from", db: db, key: key},
+		{class: NotifyGeneric, name: "move_to", db: toDb, key: key},
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Swap the contents of two databases. Primary keys can't be deferred, so the keys in the first
+// database are parked in db -1 while the second database moves across.
+func (repo *KeyRepository) SwapDb(tx Querier, db int, otherDb int) error {
+	statements := []struct {
+		from int
+		to   int
+	}{{db, -1}, {otherDb, db}, {-1, otherDb}}
+
+	for _, statement := range statements {
+		sqlStat := "UPDATE redisdata SET db = $2, version = nextval('redisdata_version_seq') WHERE db = $1"
+		_, err := tx.Exec(sqlStat, statement.from, statement.to)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Which keys SCAN and KEYS return. Prefix limits them to a range of the primary key, so the index
+// can be used, and Like is a LIKE pattern the whole key must match. Type is a type like "string".
+// Empty fields match every key.
+type KeyFilter struct {
+	Prefix []byte
+	Like   []byte
+	Type   string
+}
+
+// The conditions that limit a query to the range of keys starting with the prefix. arg adds an
+// argument to the query and returns its placeholder.
+func (filter KeyFilter) rangeConditions(arg func(interface{}) string) []string {
+	if len(filter.Prefix) == 0 {
+		return nil
+	}
+	conditions := []string{"key >= " + arg(filter.Prefix)}
+	if end := prefixEnd(filter.Prefix); end != nil {
+		conditions = append(conditions, "key < "+arg(end))
+	}
+	return conditions
+}
+
+// The conditions a key in the range must also meet. Expired keys never match.
+func (filter KeyFilter) matchConditions(arg func(interface{}) string) []string {
+	conditions := []string{"(expires_at > now() OR expires_at IS NULL)"}
+	if filter.Like != nil {
+		conditions = append(conditions, "key LIKE "+arg(filter.Like))
+	}
+	if filter.Type != "" {
+		conditions = append(conditions, "type = "+arg(filter.Type))
+	}
+	return conditions
+}
+
+// The smallest key that's greater than every key starting with prefix, or nil if there isn't one
+// because prefix is all 0xff bytes
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for idx := len(end) - 1; idx >= 0; idx-- {
+		if end[idx] < 0xff {
+			end[idx]++
+			return end[:idx+1]
+		}
+	}
+	return nil
+}
+
+// Look at up to count keys in a database, in order, starting after the key after, or from the
+// start if after is nil. Returns the keys that match filter, and the last key looked at, which is
+// nil once every key has been looked at.
+//
+// Like redis, count limits the work done rather than the number of keys returned, so a page can
+// have fewer keys than count, or none, and the scan still isn't done.
+func (repo *KeyRepository) Scan(tx Querier, db int, after []byte, filter KeyFilter, count int) ([][]byte, []byte, error) {
+	args := []interface{}{db}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	where := []string{"db = $1"}
+	if after != nil {
+		where = append(where, "key > "+arg(after))
+	}
+	where = append(where, filter.rangeConditions(arg)...)
+	matched := filter.matchConditions(arg)
+
+	sqlStat := fmt.Sprintf("SELECT key, %s FROM (SELECT key, type, expires_at FROM redisdata WHERE %s ORDER BY key LIMIT %s) AS page ORDER BY key",
+		strings.Join(matched, " AND "), strings.Join(where, " AND "), arg(count))
+	rows, err := tx.Query(sqlStat, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	result := [][]byte{}
+	var last []byte
+	examined := 0
+	for rows.Next() {
+		var key []byte
+		var match bool
+		err = rows.Scan(&key, &match)
+		if err != nil {
+			return nil, nil, err
+		}
+		if match {
+			result = append(result, key)
+		}
+		last = key
+		examined++
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if examined < count {
+		return result, nil, nil
+	}
+	return result, last, nil
+}
+
+// Every key in a database that matches filter, in order
+func (repo *KeyRepository) Keys(tx Querier, db int, filter KeyFilter) ([][]byte, error) {
+	args := []interface{}{db}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	where := append([]string{"db = $1"}, filter.rangeConditions(arg)...)
+	where = append(where, filter.matchConditions(arg)...)
+
+	sqlStat := "SELECT key FROM redisdata WHERE " + strings.Join(where, " AND ") + " ORDER BY key"
+	rows, err := tx.Query(sqlStat, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := [][]byte{}
+	for rows.Next() {
+		var key []byte
+		err = rows.Scan(&key)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, key)
+	}
+	return result, rows.Err()
+}
+
+type KeyspaceInfo struct {
+	Db      int
+	Keys    int64
+	Expires int64
+}
+
+// Count the keys in each database that has any, for INFO keyspace
+func (repo *KeyRepository) Keyspace(tx Querier) ([]KeyspaceInfo, error) {
+	result := []KeyspaceInfo{}
+
+	sqlStat := "SELECT db, count(*), count(expires_at) FROM redisdata WHERE expires_at > now() OR expires_at IS NULL GROUP BY db ORDER BY db"
+	rows, err := tx.Query(sqlStat)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var info KeyspaceInfo
+		err = rows.Scan(&info.Db, &info.Keys, &info.Expires)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, info)
+	}
+	return result, rows.Err()
+}
+
+// Assign a key a new version without otherwise changing it. Used when a write only touches the
+// rows for a key in one of the child tables.
+func touchKey(tx Querier, db int, key []byte) error {
+	sqlStat := "UPDATE redisdata SET version = nextval('redisdata_version_seq') WHERE db = $1 AND key = $2"
+	_, err := tx.Exec(sqlStat, db, key)
+	return err
+}
+
+// Delete up to limit keys that have expired, in any database, along with their rows in the child
+// tables. Keys that are locked by a write are skipped, and will be picked up by a later batch.
+func (repo *KeyRepository) DeleteExpiredBatch(tx Querier, limit int) (int64, error) {
+	sqlStat := "DELETE FROM redisdata WHERE (db, key) IN (SELECT db, key FROM redisdata WHERE expires_at < now() LIMIT $1 FOR UPDATE SKIP LOCKED) RETURNING db, key"
+	rows, err := tx.Query(sqlStat, limit)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	expired := []keyspaceEvent{}
+	for rows.Next() {
+		event := keyspaceEvent{class: NotifyExpired, name: "expired"}
+		err = rows.Scan(&event.db, &event.key)
+		if err != nil {
+			return 0, err
+		}
+		expired = append(expired, event)
+	}
+	err = rows.Err()
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(expired)), repo.events.notifyAll(tx, expired)
+}
+
+// Delete key if it has expired, along with its rows in the child tables. Writes call this first,
+// so they don't add to a key that should no longer exist.
+func deleteExpired(tx Querier, events *KeyspaceEvents, db int, key []byte) error {
+	sqlStat := "DELETE FROM redisdata WHERE db = $1 AND key = $2 AND expires_at < now()"
+	res, err := tx.Exec(sqlStat, db, key)
+	if err != nil {
+		return err
+	}
+	count, _ := res.RowsAffected()
+	if count > 0 {
+		return events.notify(tx, NotifyExpired, "expired", db, key)
+	}
+	return nil
+}
+
+// Delete key, along with its rows in the child tables. Used when a write removes the last item
+// from a list, set or sorted set.
+func deleteKey(tx Querier, events *KeyspaceEvents, db int, key []byte) error {
+	sqlStat := "DELETE FROM redisdata WHERE db = $1 AND key = $2"
+	res, err := tx.Exec(sqlStat, db, key)
+	if err != nil {
+		return err
+	}
+	count, _ := res.RowsAffected()
+	if count > 0 {
+		return events.notify(tx, NotifyGeneric, "del", db, key)
+	}
+	return nil
+}
+
+// Return ErrWrongType if key exists and holds a type other than keyType. Commands that read or
+// remove data call this first, and commands that add data check the type when they ensure the key
+// exists.
+func checkType(tx Querier, db int, key []byte, keyType string) error {
+	var currentType string
+
+	sqlStat := "SELECT type FROM redisdata WHERE db = $1 AND key = $2 AND (expires_at > now() OR expires_at IS NULL)"
+	err := tx.QueryRow(sqlStat, db, key).Scan(&currentType)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if currentType != keyType {
+		return ErrWrongType
+	}
+	return nil
+}
+
+// Delete key if it holds a type other than keyType, along with its rows in the child tables.
+// Commands like SET replace a key of any type. Returns true if a key was deleted.
+func deleteOtherType(tx Querier, db int, key []byte, keyType string) (bool, error) {
+	sqlStat := "DELETE FROM redisdata WHERE db = $1 AND key = $2 AND type <> $3"
+	res, err := tx.Exec(sqlStat, db, key, keyType)
+	if err != nil {
+		return false, err
+	}
+	count, _ := res.RowsAffected()
+	return count > 0, nil
+}
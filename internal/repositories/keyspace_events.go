@@ -0,0 +1,90 @@
+package repositories
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// The classes of keyspace event, which are chosen with the flags of redis's notify-keyspace-events.
+// NotifyKeyspace and NotifyKeyevent choose the channels events are published to, and the rest
+// choose which events are published.
+const (
+	NotifyKeyspace = 1 << iota // K
+	NotifyKeyevent             // E
+	NotifyGeneric              // g
+	NotifyString               // $
+	NotifyList                 // l
+	NotifySet                  // s
+	NotifyHash                 // h
+	NotifyZset                 // z
+	NotifyExpired              // x
+	NotifyEvicted              // e
+	NotifyStream               // t
+	NotifyKeyMiss              // m
+	NotifyModule               // d
+	NotifyNew                  // n
+)
+
+// Keyspace events are published like messages sent with PUBLISH, so subscribers on every pgredis
+// instance receive them after the write's transaction commits. The repositories publish them as
+// they write, and the flags decide which events are published, if any.
+type KeyspaceEvents struct {
+	flags int32
+}
+
+func NewKeyspaceEvents() *KeyspaceEvents {
+	return &KeyspaceEvents{}
+}
+
+func (events *KeyspaceEvents) Flags() int {
+	return int(atomic.LoadInt32(&events.flags))
+}
+
+func (events *KeyspaceEvents) SetFlags(flags int) {
+	atomic.StoreInt32(&events.flags, int32(flags))
+}
+
+// An event that happened to a key, like "set" or "lpush"
+type keyspaceEvent struct {
+	class int
+	name  string
+	db    int
+	key   []byte
+}
+
+// Publish an event, if its class is enabled
+func (events *KeyspaceEvents) notify(tx Querier, class int, name string, db int, key []byte) error {
+	return events.notifyAll(tx, []keyspaceEvent{{class: class, name: name, db: db, key: key}})
+}
+
+// Publish a list of events in a single statement. Like redis, each event is published to
+// __keyspace@<db>__:<key> with the event as the message, then __keyevent@<db>__:<event> with the
+// key as the message.
+func (events *KeyspaceEvents) notifyAll(tx Querier, batch []keyspaceEvent) error {
+	if events == nil {
+		return nil
+	}
+	flags := events.Flags()
+	if flags&(NotifyKeyspace|NotifyKeyevent) == 0 {
+		return nil
+	}
+
+	messages := []pubsubMessage{}
+	for _, event := range batch {
+		if flags&event.class == 0 {
+			continue
+		}
+		if flags&NotifyKeyspace != 0 {
+			channel := append([]byte(fmt.Sprintf("__keyspace@%d__:", event.db)), event.key...)
+			messages = append(messages, pubsubMessage{channel: channel, message: []byte(event.name)})
+		}
+		if flags&NotifyKeyevent != 0 {
+			channel := []byte(fmt.Sprintf("__keyevent@%d__:%s", event.db, event.name))
+			messages = append(messages, pubsubMessage{channel: channel, message: event.key})
+		}
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	return publishAll(tx, messages)
+}
@@ -4,41 +4,56 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"sort"
 
 	_ "github.com/lib/pq"
 )
 
-type ListRepository struct{}
+type ListRepository struct {
+	events *KeyspaceEvents
+}
 
-func NewListRepository() *ListRepository {
-	return &ListRepository{}
+func NewListRepository(events *KeyspaceEvents) *ListRepository {
+	return &ListRepository{events: events}
 }
 
-func (repo *ListRepository) Length(tx *sql.Tx, key []byte) (int, error) {
+func (repo *ListRepository) Length(tx Querier, db int, key []byte) (int, error) {
+	if err := checkType(tx, db, key, "list"); err != nil {
+		return 0, err
+	}
+
 	var count int
 
-	sqlStat := "SELECT count(*) FROM redisdata INNER JOIN redislists ON redisdata.key = redislists.key WHERE redisdata.key = $1 AND (redisdata.expires_at > now() OR expires_at IS NULL)"
-	err := tx.QueryRow(sqlStat, key).Scan(&count)
+	sqlStat := "SELECT count(*) FROM redisdata INNER JOIN redislists ON redisdata.db = redislists.db AND redisdata.key = redislists.key WHERE redisdata.db = $1 AND redisdata.key = $2 AND (redisdata.expires_at > now() OR expires_at IS NULL)"
+	err := tx.QueryRow(sqlStat, db, key).Scan(&count)
 	if err != nil {
 		return 0, err
 	}
 	return count, nil
 }
 
-func (repo *ListRepository) LeftPop(tx *sql.Tx, key []byte) (bool, []byte, error) {
-	return repo.pop(tx, key, "left")
+func (repo *ListRepository) LeftPop(tx Querier, db int, key []byte) (bool, []byte, error) {
+	return repo.pop(tx, db, key, "left")
 }
 
-func (repo *ListRepository) LeftPush(tx *sql.Tx, key []byte, values [][]byte) (int, error) {
-	return repo.push(tx, key, "left", values)
+func (repo *ListRepository) LeftPopCount(tx Querier, db int, key []byte, count int) ([][]byte, error) {
+	return repo.popCount(tx, db, key, "left", count)
 }
 
-func (repo *ListRepository) Lrange(tx *sql.Tx, key []byte, start int, end int) ([]string, error) {
+func (repo *ListRepository) LeftPush(tx Querier, db int, key []byte, values [][]byte) (int, error) {
+	return repo.push(tx, db, key, "left", values)
+}
+
+func (repo *ListRepository) Lrange(tx Querier, db int, key []byte, start int, end int) ([]string, error) {
+	if err := checkType(tx, db, key, "list"); err != nil {
+		return nil, err
+	}
+
 	var listLength int
 	result := make([]string, 0)
 
-	sqlStat := "SELECT count(*) FROM redisdata INNER JOIN redislists ON redisdata.key = redislists.key WHERE redisdata.key = $1 AND (redisdata.expires_at > now() OR expires_at IS NULL)"
-	err := tx.QueryRow(sqlStat, key).Scan(&listLength)
+	sqlStat := "SELECT count(*) FROM redisdata INNER JOIN redislists ON redisdata.db = redislists.db AND redisdata.key = redislists.key WHERE redisdata.db = $1 AND redisdata.key = $2 AND (redisdata.expires_at > now() OR expires_at IS NULL)"
+	err := tx.QueryRow(sqlStat, db, key).Scan(&listLength)
 	if err != nil {
 		return result, err
 	}
@@ -61,16 +76,17 @@ func (repo *ListRepository) Lrange(tx *sql.Tx, key []byte, start int, end int) (
 		WITH sublist AS (
 			SELECT redislists.value,
 			ROW_NUMBER () OVER (ORDER BY idx)-1 as row
-			FROM redisdata INNER JOIN redislists ON redisdata.key = redislists.key
-			WHERE redisdata.key = $1 AND
+			FROM redisdata INNER JOIN redislists ON redisdata.db = redislists.db AND redisdata.key = redislists.key
+			WHERE redisdata.db = $1 AND
+				redisdata.key = $2 AND
 				(redisdata.expires_at > now() OR expires_at IS NULL)
 			)
 		SELECT value
 		FROM sublist
-		WHERE (row BETWEEN $2 AND $3)
+		WHERE (row BETWEEN $3 AND $4)
 		ORDER BY row
 	`
-	rows, err := tx.Query(sqlStat, key, start, end)
+	rows, err := tx.Query(sqlStat, db, key, start, end)
 	if err != nil {
 		return result, err
 	}
@@ -92,20 +108,23 @@ func (repo *ListRepository) Lrange(tx *sql.Tx, key []byte, start int, end int) (
 	return result, nil
 }
 
-func (repo *ListRepository) LeftRemove(tx *sql.Tx, key []byte, count int, value []byte) (int64, error) {
+func (repo *ListRepository) LeftRemove(tx Querier, db int, key []byte, count int, value []byte) (int64, error) {
+	if err := checkType(tx, db, key, "list"); err != nil {
+		return 0, err
+	}
+
 	var removedCount int64
 	var maxIdx sql.NullInt64
 
 	// delete any expired rows in the db with this key
-	sqlStat := "DELETE FROM redisdata WHERE key=$1 AND expires_at < now()"
-	_, err := tx.Exec(sqlStat, key)
+	err := deleteExpired(tx, repo.events, db, key)
 	if err != nil {
 		return 0, err
 	}
 
 	// determine the maximum index that has a matching value
-	sqlStat = "SELECT max(idx) FROM (SELECT idx FROM redisdata INNER JOIN redislists ON redisdata.key = redislists.key WHERE redisdata.key = $1 AND (redisdata.expires_at > now() OR expires_at IS NULL) AND redislists.value = $2 ORDER BY idx limit $3) t"
-	err = tx.QueryRow(sqlStat, key, value, count).Scan(&maxIdx)
+	sqlStat := "SELECT max(idx) FROM (SELECT idx FROM redisdata INNER JOIN redislists ON redisdata.db = redislists.db AND redisdata.key = redislists.key WHERE redisdata.db = $1 AND redisdata.key = $2 AND (redisdata.expires_at > now() OR expires_at IS NULL) AND redislists.value = $3 ORDER BY idx limit $4) t"
+	err = tx.QueryRow(sqlStat, db, key, value, count).Scan(&maxIdx)
 
 	if err != nil {
 		return 0, err
@@ -115,130 +134,225 @@ func (repo *ListRepository) LeftRemove(tx *sql.Tx, key []byte, count int, value
 	}
 
 	// delete the list items
-	sqlStat = "DELETE FROM redislists WHERE key=$1 AND idx <= $2 AND value = $3"
-	res, err := tx.Exec(sqlStat, key, maxIdx, value)
+	sqlStat = "DELETE FROM redislists WHERE db = $1 AND key = $2 AND idx <= $3 AND value = $4"
+	res, err := tx.Exec(sqlStat, db, key, maxIdx, value)
 	if err != nil {
 		return 0, err
 	}
 	removedCount, _ = res.RowsAffected()
 
+	if removedCount > 0 {
+		err = touchKey(tx, db, key)
+		if err != nil {
+			return 0, err
+		}
+		err = repo.events.notify(tx, NotifyList, "lrem", db, key)
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	return removedCount, nil
 }
 
-func (repo *ListRepository) RightPop(tx *sql.Tx, key []byte) (bool, []byte, error) {
-	return repo.pop(tx, key, "right")
+func (repo *ListRepository) RightPop(tx Querier, db int, key []byte) (bool, []byte, error) {
+	return repo.pop(tx, db, key, "right")
+}
+
+func (repo *ListRepository) RightPopCount(tx Querier, db int, key []byte, count int) ([][]byte, error) {
+	return repo.popCount(tx, db, key, "right", count)
 }
 
-func (repo *ListRepository) RightPush(tx *sql.Tx, key []byte, values [][]byte) (int, error) {
-	return repo.push(tx, key, "right", values)
+func (repo *ListRepository) RightPush(tx Querier, db int, key []byte, values [][]byte) (int, error) {
+	return repo.push(tx, db, key, "right", values)
 }
 
-func (repo *ListRepository) pop(tx *sql.Tx, key []byte, direction string) (bool, []byte, error) {
-	var value []byte
+// Atomically pop a value from one end of source and push it onto one end of destination. source
+// and destination may be the same list, in which case it's rotated.
+func (repo *ListRepository) Move(tx Querier, db int, source []byte, destination []byte, from string, to string) (bool, []byte, error) {
+	success, value, err := repo.pop(tx, db, source, from)
+	if err != nil || !success {
+		return false, value, err
+	}
+
+	_, err = repo.push(tx, db, destination, to, [][]byte{value})
+	if err != nil {
+		return false, value, err
+	}
+	return true, value, nil
+}
+
+func (repo *ListRepository) pop(tx Querier, db int, key []byte, direction string) (bool, []byte, error) {
+	values, err := repo.popCount(tx, db, key, direction, 1)
+	if err != nil || len(values) == 0 {
+		return false, nil, err
+	}
+	return true, values[0], nil
+}
+
+// pop up to count values from one end of a list, in the order they were removed
+func (repo *ListRepository) popCount(tx Querier, db int, key []byte, direction string, count int) ([][]byte, error) {
+	if err := checkType(tx, db, key, "list"); err != nil {
+		return nil, err
+	}
+
+	values := make([][]byte, 0)
 
 	if direction != "left" && direction != "right" {
-		return false, value, errors.New("direction must be left or right")
+		return values, errors.New("direction must be left or right")
 	}
 
 	// delete any expired rows in the db with this key
-	sqlStat := "DELETE FROM redisdata WHERE key=$1 AND expires_at < now()"
-	_, err := tx.Exec(sqlStat, key)
+	err := deleteExpired(tx, repo.events, db, key)
 	if err != nil {
-		return false, value, err
+		return values, err
 	}
 
 	// delete the list items
-	sqlStat = `
+	sqlStat := `
 		WITH sublist AS (
-			SELECT redislists.key, redislists.idx, redislists.value
-			FROM redisdata INNER JOIN redislists ON redisdata.key = redislists.key
-			WHERE redisdata.key = $1 AND
+			SELECT redislists.idx
+			FROM redisdata INNER JOIN redislists ON redisdata.db = redislists.db AND redisdata.key = redislists.key
+			WHERE redisdata.db = $1 AND
+				redisdata.key = $2 AND
 				(redisdata.expires_at > now() OR expires_at IS NULL)
 			ORDER BY redislists.idx %s
-			LIMIT 1
+			LIMIT $3
 		)
 		DELETE
 		FROM redislists
-		WHERE key IN (SELECT key FROM sublist) AND idx IN (SELECT idx FROM sublist) AND value IN (SELECT value FROM sublist)
-		RETURNING value
+		WHERE db = $1 AND key = $2 AND idx IN (SELECT idx FROM sublist)
+		RETURNING idx, value
 	`
 	if direction == "left" {
 		sqlStat = fmt.Sprintf(sqlStat, "asc")
 	} else {
 		sqlStat = fmt.Sprintf(sqlStat, "desc")
 	}
-	err = tx.QueryRow(sqlStat, key).Scan(&value)
-	if err == sql.ErrNoRows {
-		return false, value, nil
-	} else if err != nil {
-		return false, value, err
+	rows, err := tx.Query(sqlStat, db, key, count)
+	if err != nil {
+		return values, err
+	}
+	defer rows.Close()
+
+	// RETURNING doesn't guarantee any order, so sort the values back into the order we removed them
+	indexedValues := map[int][]byte{}
+	indexes := []int{}
+	for rows.Next() {
+		var idx int
+		var value []byte
+		err = rows.Scan(&idx, &value)
+		if err != nil {
+			return values, err
+		}
+		indexedValues[idx] = value
+		indexes = append(indexes, idx)
+	}
+	err = rows.Err()
+	if err != nil {
+		return values, err
+	}
+	if len(indexes) == 0 {
+		return values, nil
+	}
+	if direction == "left" {
+		sort.Ints(indexes)
+	} else {
+		sort.Sort(sort.Reverse(sort.IntSlice(indexes)))
+	}
+	for _, idx := range indexes {
+		values = append(values, indexedValues[idx])
+	}
+
+	// redis names the event after the end of the list, like LPOP or RPOP
+	err = repo.events.notify(tx, NotifyList, direction[:1]+"pop", db, key)
+	if err != nil {
+		return values, err
 	}
 
 	// if the list is now empty, delete it
 	var remainingItems int64
-	sqlStat = "SELECT count(*) FROM redisdata INNER JOIN redislists ON redisdata.key = redislists.key WHERE redisdata.key = $1"
-	err = tx.QueryRow(sqlStat, key).Scan(&remainingItems)
+	sqlStat = "SELECT count(*) FROM redisdata INNER JOIN redislists ON redisdata.db = redislists.db AND redisdata.key = redislists.key WHERE redisdata.db = $1 AND redisdata.key = $2"
+	err = tx.QueryRow(sqlStat, db, key).Scan(&remainingItems)
 
 	if err != nil {
-		return false, value, err
+		return values, err
 	}
 
 	if remainingItems == 0 {
-		sqlStat = "DELETE FROM redisdata WHERE key=$1"
-		_, err := tx.Exec(sqlStat, key)
+		err = deleteKey(tx, repo.events, db, key)
 		if err != nil {
-			return false, value, err
+			return values, err
+		}
+	} else {
+		// the key still exists, so bump its version for any clients watching it
+		err = touchKey(tx, db, key)
+		if err != nil {
+			return values, err
 		}
 	}
 
-	return true, value, nil
+	return values, nil
 }
 
-func (repo *ListRepository) push(tx *sql.Tx, key []byte, direction string, values [][]byte) (int, error) {
+func (repo *ListRepository) push(tx Querier, db int, key []byte, direction string, values [][]byte) (int, error) {
 	if direction != "left" && direction != "right" {
 		return 0, errors.New("direction must be left or right")
 	}
 	var newLength int
 
 	// delete any expired rows in the db with this key
-	sqlStat := "DELETE FROM redisdata WHERE key=$1 AND expires_at < now()"
-	_, err := tx.Exec(sqlStat, key)
+	err := deleteExpired(tx, repo.events, db, key)
 	if err != nil {
 		return 0, err
 	}
 
-	// ensure the db has a current key
-	sqlStat = "INSERT INTO redisdata(key, type, value, expires_at) VALUES ($1, 'list', '', NULL) ON CONFLICT (key) DO NOTHING"
-	_, err = tx.Exec(sqlStat, key)
+	// ensure the db has a current key, and check it holds the right type
+	var keyType string
+	sqlStat := "INSERT INTO redisdata(db, key, type, value, expires_at) VALUES ($1, $2, 'list', '', NULL) ON CONFLICT (db, key) DO UPDATE SET version = nextval('redisdata_version_seq') RETURNING type"
+	err = tx.QueryRow(sqlStat, db, key).Scan(&keyType)
 
 	if err != nil {
 		return 0, err
 	}
+	if keyType != "list" {
+		return 0, ErrWrongType
+	}
 
 	// now lock that key so no one else can change it
-	sqlStat = "SELECT key FROM redisdata WHERE redisdata.key = $1 AND (redisdata.expires_at > now() OR expires_at IS NULL) FOR UPDATE"
-	_, err = tx.Exec(sqlStat, key)
+	sqlStat = "SELECT key FROM redisdata WHERE redisdata.db = $1 AND redisdata.key = $2 AND (redisdata.expires_at > now() OR expires_at IS NULL) FOR UPDATE"
+	_, err = tx.Exec(sqlStat, db, key)
 
 	if err != nil {
 		return 0, err
 	}
 
 	if direction == "left" {
-		sqlStat = "INSERT INTO redislists(key, idx, value) VALUES ($1, (select coalesce(min(idx),0) from redislists where key = $2)-1, $3)"
+		sqlStat = "INSERT INTO redislists(db, key, idx, value) VALUES ($1, $2, (select coalesce(min(idx),0) from redislists where db = $1 and key = $2)-1, $3)"
 	} else {
-		sqlStat = "INSERT INTO redislists(key, idx, value) VALUES ($1, (select coalesce(max(idx),0) from redislists where key = $2)+1, $3)"
+		sqlStat = "INSERT INTO redislists(db, key, idx, value) VALUES ($1, $2, (select coalesce(max(idx),0) from redislists where db = $1 and key = $2)+1, $3)"
 	}
 	// append our new values
 	for _, value := range values {
-		_, err = tx.Exec(sqlStat, key, key, value)
+		_, err = tx.Exec(sqlStat, db, key, value)
 
 		if err != nil {
 			return 0, err
 		}
 	}
 
-	sqlStat = "SELECT count(*) FROM redisdata INNER JOIN redislists ON redisdata.key = redislists.key WHERE redisdata.key = $1"
-	err = tx.QueryRow(sqlStat, key).Scan(&newLength)
+	sqlStat = "SELECT count(*) FROM redisdata INNER JOIN redislists ON redisdata.db = redislists.db AND redisdata.key = redislists.key WHERE redisdata.db = $1 AND redisdata.key = $2"
+	err = tx.QueryRow(sqlStat, db, key).Scan(&newLength)
+	if err != nil {
+		return 0, err
+	}
+
+	err = repo.events.notify(tx, NotifyList, direction[:1]+"push", db, key)
+	if err != nil {
+		return 0, err
+	}
+
+	err = notifyKeyReady(tx, db, key)
 	if err != nil {
 		return 0, err
 	}
@@ -0,0 +1,131 @@
+package repositories
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/lib/pq"
+)
+
+// Every pgredis instance LISTENs on this channel, and delivers the messages published to it to
+// any matching subscribers. The payload is the base64 encoded pubsub channel and message, and a
+// sequence number, separated by colons.
+//
+// Postgres drops a notification that's identical to one already sent in the same transaction,
+// but the same message can be published more than once in a MULTI or pipeline. The sequence
+// number keeps them apart.
+//
+// Payloads are limited to 8000 bytes, so a message that's too big is saved in the redismessages
+// table, and the payload is a # followed by the id of its row.
+const PubSubChannel = "pgredis_pubsub"
+
+// The longest payload postgres accepts for a notification
+const maxNotifyPayloadLength = 7999
+
+// Every instance reads a saved message as soon as the notification arrives, so they're only kept
+// long enough for a slow instance to catch up.
+const savedMessageLifetime = "1 minute"
+
+var notificationSequence uint64
+
+type PubSubRepository struct{}
+
+func NewPubSubRepository() *PubSubRepository {
+	return &PubSubRepository{}
+}
+
+// Publish a message to a pubsub channel. Postgres delays delivery until the transaction commits,
+// so a message published in a transaction that's rolled back is never seen.
+func (repo *PubSubRepository) Publish(tx Querier, channel []byte, message []byte) error {
+	return publishAll(tx, []pubsubMessage{{channel: channel, message: message}})
+}
+
+// Decode the payload of a notification received on PubSubChannel. Messages that were too big for
+// the payload are read from the database.
+func (repo *PubSubRepository) Decode(tx Querier, payload string) (channel []byte, message []byte, err error) {
+	if strings.HasPrefix(payload, "#") {
+		return loadMessage(tx, payload[1:])
+	}
+
+	parts := strings.SplitN(payload, ":", 3)
+	if len(parts) < 2 {
+		return nil, nil, errors.New("invalid pubsub payload")
+	}
+	channel, err = base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	message, err = base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	return channel, message, nil
+}
+
+type pubsubMessage struct {
+	channel []byte
+	message []byte
+}
+
+// Publish a list of messages in a single statement, in order
+func publishAll(tx Querier, messages []pubsubMessage) error {
+	payloads := []string{}
+	for _, message := range messages {
+		sequence := strconv.FormatUint(atomic.AddUint64(&notificationSequence, 1), 10)
+		payload := base64.StdEncoding.EncodeToString(message.channel) + ":" + base64.StdEncoding.EncodeToString(message.message) + ":" + sequence
+		if len(payload) > maxNotifyPayloadLength {
+			id, err := saveMessage(tx, message)
+			if err != nil {
+				return err
+			}
+			payload = "#" + strconv.FormatInt(id, 10)
+		}
+		payloads = append(payloads, payload)
+	}
+
+	sqlStat := "SELECT pg_notify(current_setting('pgredis.channel_prefix') || $1, payload) FROM unnest($2::text[]) AS payload"
+	_, err := tx.Exec(sqlStat, PubSubChannel, pq.Array(payloads))
+	return err
+}
+
+// Save a message that's too big for a notification payload, returning its id. Saved messages that
+// have outlived savedMessageLifetime are removed at the same time.
+func saveMessage(tx Querier, message pubsubMessage) (int64, error) {
+	var id int64
+
+	sqlStat := "DELETE FROM redismessages WHERE created_at < now() - cast($1 as interval)"
+	_, err := tx.Exec(sqlStat, savedMessageLifetime)
+	if err != nil {
+		return 0, err
+	}
+
+	sqlStat = "INSERT INTO redismessages (channel, message) VALUES ($1, $2) RETURNING id"
+	err = tx.QueryRow(sqlStat, message.channel, message.message).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func loadMessage(tx Querier, idString string) ([]byte, []byte, error) {
+	var channel, message []byte
+
+	id, err := strconv.ParseInt(idString, 10, 64)
+	if err != nil {
+		return nil, nil, errors.New("invalid pubsub payload")
+	}
+
+	sqlStat := "SELECT channel, message FROM redismessages WHERE id = $1"
+	err = tx.QueryRow(sqlStat, id).Scan(&channel, &message)
+	if err == sql.ErrNoRows {
+		return nil, nil, fmt.Errorf("saved pubsub message %d has been removed", id)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return channel, message, nil
+}
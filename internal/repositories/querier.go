@@ -0,0 +1,16 @@
+package repositories
+
+import (
+	"database/sql"
+)
+
+// Querier runs SQL. The repositories accept one rather than a *sql.Tx, so the transaction can
+// belong to a connection from the pool or to a session pinned to a single client.
+//
+// Every connection pgredis opens sets pgredis.channel_prefix, and the repositories add it to the
+// names of the channels they notify. It's empty unless the tables are in their own schema.
+type Querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
@@ -1,37 +1,38 @@
 package repositories
 
-import (
-	"database/sql"
-)
-
-type SetRepository struct{}
+type SetRepository struct {
+	events *KeyspaceEvents
+}
 
-func NewSetRepository() *SetRepository {
-	return &SetRepository{}
+func NewSetRepository(events *KeyspaceEvents) *SetRepository {
+	return &SetRepository{events: events}
 }
 
-func (repo *SetRepository) Add(tx *sql.Tx, key []byte, values [][]byte) (updated int64, err error) {
+func (repo *SetRepository) Add(tx Querier, db int, key []byte, values [][]byte) (updated int64, err error) {
 	count := int64(0)
 
 	// delete any expired rows in the db with this key
 	// we do this first so the count we return at the end doesn't include these rows
-	sqlStat := "DELETE FROM redisdata WHERE key=$1 AND expires_at < now()"
-	_, err = tx.Exec(sqlStat, key)
+	err = deleteExpired(tx, repo.events, db, key)
 	if err != nil {
 		return 0, err
 	}
 
-	// ensure the db has a current key
-	sqlStat = "INSERT INTO redisdata(key, type, value, expires_at) VALUES ($1, 'set', '', NULL) ON CONFLICT (key) DO NOTHING"
-	_, err = tx.Exec(sqlStat, key)
+	// ensure the db has a current key, and check it holds the right type
+	var keyType string
+	sqlStat := "INSERT INTO redisdata(db, key, type, value, expires_at) VALUES ($1, $2, 'set', '', NULL) ON CONFLICT (db, key) DO UPDATE SET version = nextval('redisdata_version_seq') RETURNING type"
+	err = tx.QueryRow(sqlStat, db, key).Scan(&keyType)
 
 	if err != nil {
 		return 0, err
 	}
+	if keyType != "set" {
+		return 0, ErrWrongType
+	}
 
 	for _, value := range values {
-		sqlStat = "INSERT INTO redissets(key, value) VALUES ($1, $2) ON CONFLICT (key, value) DO NOTHING"
-		res, err := tx.Exec(sqlStat, key, value)
+		sqlStat = "INSERT INTO redissets(db, key, value) VALUES ($1, $2, $3) ON CONFLICT (db, key, value) DO NOTHING"
+		res, err := tx.Exec(sqlStat, db, key, value)
 		if err != nil {
 			return 0, err
 		}
@@ -39,23 +40,37 @@ func (repo *SetRepository) Add(tx *sql.Tx, key []byte, values [][]byte) (updated
 		count += rowCount
 	}
 
+	if count > 0 {
+		err = repo.events.notify(tx, NotifySet, "sadd", db, key)
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	return count, nil
 }
 
-func (repo *SetRepository) Cardinality(tx *sql.Tx, key []byte) (count int64, err error) {
-	sqlStat := "SELECT count(*) FROM redisdata INNER JOIN redissets ON redisdata.key = redissets.key WHERE redisdata.key = $1 AND (redisdata.expires_at > now() OR expires_at IS NULL)"
-	err = tx.QueryRow(sqlStat, key).Scan(&count)
+func (repo *SetRepository) Cardinality(tx Querier, db int, key []byte) (count int64, err error) {
+	if err := checkType(tx, db, key, "set"); err != nil {
+		return 0, err
+	}
+
+	sqlStat := "SELECT count(*) FROM redisdata INNER JOIN redissets ON redisdata.db = redissets.db AND redisdata.key = redissets.key WHERE redisdata.db = $1 AND redisdata.key = $2 AND (redisdata.expires_at > now() OR expires_at IS NULL)"
+	err = tx.QueryRow(sqlStat, db, key).Scan(&count)
 	if err != nil {
 		return 0, err
 	}
 	return count, nil
 }
 
-func (repo *SetRepository) Remove(tx *sql.Tx, key []byte, values [][]byte) (count int64, err error) {
+func (repo *SetRepository) Remove(tx Querier, db int, key []byte, values [][]byte) (count int64, err error) {
+	if err := checkType(tx, db, key, "set"); err != nil {
+		return 0, err
+	}
+
 	// delete any expired rows in the db with this key
 	// we do this first so the count we return at the end doesn't include these rows
-	sqlStat := "DELETE FROM redisdata WHERE key=$1 AND expires_at < now()"
-	_, err = tx.Exec(sqlStat, key)
+	err = deleteExpired(tx, repo.events, db, key)
 	if err != nil {
 		return 0, err
 	}
@@ -63,8 +78,8 @@ func (repo *SetRepository) Remove(tx *sql.Tx, key []byte, values [][]byte) (coun
 	// Delete each member
 	// TODO presumably there's a way to do this in a single SQL statement?
 	for _, value := range values {
-		sqlStat = "DELETE FROM redissets WHERE key=$1 AND value = $2"
-		res, err := tx.Exec(sqlStat, key, value)
+		sqlStat := "DELETE FROM redissets WHERE db = $1 AND key = $2 AND value = $3"
+		res, err := tx.Exec(sqlStat, db, key, value)
 		if err != nil {
 			return 0, err
 		}
@@ -72,18 +87,30 @@ func (repo *SetRepository) Remove(tx *sql.Tx, key []byte, values [][]byte) (coun
 		count += rowCount
 	}
 
+	if count > 0 {
+		err = repo.events.notify(tx, NotifySet, "srem", db, key)
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	// if the set is now empty, delete it
 	var remainingMembers int64
-	sqlStat = "SELECT count(*) FROM redisdata INNER JOIN redissets ON redisdata.key = redissets.key WHERE redisdata.key = $1"
-	err = tx.QueryRow(sqlStat, key).Scan(&remainingMembers)
+	sqlStat := "SELECT count(*) FROM redisdata INNER JOIN redissets ON redisdata.db = redissets.db AND redisdata.key = redissets.key WHERE redisdata.db = $1 AND redisdata.key = $2"
+	err = tx.QueryRow(sqlStat, db, key).Scan(&remainingMembers)
 
 	if err != nil {
 		return 0, err
 	}
 
 	if remainingMembers == 0 {
-		sqlStat = "DELETE FROM redisdata WHERE key=$1"
-		_, err := tx.Exec(sqlStat, key)
+		err = deleteKey(tx, repo.events, db, key)
+		if err != nil {
+			return 0, err
+		}
+	} else if count > 0 {
+		// the key still exists, so bump its version for any clients watching it
+		err = touchKey(tx, db, key)
 		if err != nil {
 			return 0, err
 		}
@@ -92,16 +119,21 @@ func (repo *SetRepository) Remove(tx *sql.Tx, key []byte, values [][]byte) (coun
 	return count, nil
 }
 
-func (repo *SetRepository) Members(tx *sql.Tx, key []byte) (values []string, err error) {
+func (repo *SetRepository) Members(tx Querier, db int, key []byte) (values []string, err error) {
+	if err := checkType(tx, db, key, "set"); err != nil {
+		return nil, err
+	}
+
 	result := make([]string, 0)
 
 	sqlStat := `
 			SELECT redissets.value
-			FROM redisdata INNER JOIN redissets ON redisdata.key = redissets.key
-			WHERE redisdata.key = $1 AND
+			FROM redisdata INNER JOIN redissets ON redisdata.db = redissets.db AND redisdata.key = redissets.key
+			WHERE redisdata.db = $1 AND
+				redisdata.key = $2 AND
 				(redisdata.expires_at > now() OR expires_at IS NULL)
 	`
-	rows, err := tx.Query(sqlStat, key)
+	rows, err := tx.Query(sqlStat, db, key)
 	if err != nil {
 		return result, err
 	}
@@ -5,77 +5,238 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"sort"
+	"strconv"
 )
 
-type SortedSetRepository struct{}
+type SortedSetRepository struct {
+	events *KeyspaceEvents
+}
 
-func NewSortedSetRepository() *SortedSetRepository {
-	return &SortedSetRepository{}
+func NewSortedSetRepository(events *KeyspaceEvents) *SortedSetRepository {
+	return &SortedSetRepository{events: events}
 }
 
-func (repo *SortedSetRepository) Add(tx *sql.Tx, key []byte, values map[string]float64, chArgProvided bool) (updated int64, err error) {
+func (repo *SortedSetRepository) Add(tx Querier, db int, key []byte, values map[string]float64, chArgProvided bool) (updated int64, err error) {
 	count := int64(0)
+	changed := false
 
 	// delete any expired rows in the db with this key
 	// we do this first so the count we return at the end doesn't include these rows
-	sqlStat := "DELETE FROM redisdata WHERE key=$1 AND expires_at < now()"
-	_, err = tx.Exec(sqlStat, key)
+	err = deleteExpired(tx, repo.events, db, key)
 	if err != nil {
 		return 0, err
 	}
 
-	// ensure the db has a current key
-	sqlStat = "INSERT INTO redisdata(key, type, value, expires_at) VALUES ($1, 'zset', '', NULL) ON CONFLICT (key) DO NOTHING"
-	_, err = tx.Exec(sqlStat, key)
+	// ensure the db has a current key, and check it holds the right type
+	var keyType string
+	sqlStat := "INSERT INTO redisdata(db, key, type, value, expires_at) VALUES ($1, $2, 'zset', '', NULL) ON CONFLICT (db, key) DO UPDATE SET version = nextval('redisdata_version_seq') RETURNING type"
+	err = tx.QueryRow(sqlStat, db, key).Scan(&keyType)
 
 	if err != nil {
 		return 0, err
 	}
+	if keyType != "zset" {
+		return 0, ErrWrongType
+	}
 
 	for value, score := range values {
-		sqlStat = "INSERT INTO rediszsets(key, value, score) VALUES ($1, $2, $3) ON CONFLICT (key, value) DO NOTHING"
-		res, err := tx.Exec(sqlStat, key, value, score)
+		sqlStat = "INSERT INTO rediszsets(db, key, value, score) VALUES ($1, $2, $3, $4) ON CONFLICT (db, key, value) DO NOTHING"
+		res, err := tx.Exec(sqlStat, db, key, value, score)
 		if err != nil {
 			return 0, err
 		}
 		rowCount, _ := res.RowsAffected()
 		if rowCount == 0 {
 			// the set must already have this member, update it with a new score if necessary
-			sqlStat = "UPDATE rediszsets SET score = $3 WHERE key = $1 AND value = $2 AND score <> $4"
-			res, err := tx.Exec(sqlStat, key, value, score, score)
+			sqlStat = "UPDATE rediszsets SET score = $4 WHERE db = $1 AND key = $2 AND value = $3 AND score <> $5"
+			res, err := tx.Exec(sqlStat, db, key, value, score, score)
 			if err != nil {
 				return 0, err
 			}
+			updatedCount, _ := res.RowsAffected()
+			changed = changed || updatedCount > 0
 			if chArgProvided {
-				updatedCount, _ := res.RowsAffected()
 				count += updatedCount
 			}
 		} else {
+			changed = true
 			count += rowCount
 		}
 	}
 
+	if changed {
+		err = repo.events.notify(tx, NotifyZset, "zadd", db, key)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = notifyKeyReady(tx, db, key)
+	if err != nil {
+		return 0, err
+	}
+
 	return count, nil
 }
 
-func (repo *SortedSetRepository) Cardinality(tx *sql.Tx, key []byte) (count int64, err error) {
-	sqlStat := "SELECT count(*) FROM redisdata INNER JOIN rediszsets ON redisdata.key = rediszsets.key WHERE redisdata.key = $1 AND (redisdata.expires_at > now() OR expires_at IS NULL)"
-	err = tx.QueryRow(sqlStat, key).Scan(&count)
+func (repo *SortedSetRepository) Cardinality(tx Querier, db int, key []byte) (count int64, err error) {
+	if err := checkType(tx, db, key, "zset"); err != nil {
+		return 0, err
+	}
+
+	sqlStat := "SELECT count(*) FROM redisdata INNER JOIN rediszsets ON redisdata.db = rediszsets.db AND redisdata.key = rediszsets.key WHERE redisdata.db = $1 AND redisdata.key = $2 AND (redisdata.expires_at > now() OR expires_at IS NULL)"
+	err = tx.QueryRow(sqlStat, db, key).Scan(&count)
 	if err != nil {
 		return 0, err
 	}
 	return count, nil
 }
 
-func (repo *SortedSetRepository) Range(tx *sql.Tx, key []byte, start int, end int, direction string, withScores bool) ([]string, error) {
+// The score of a member, if the member exists
+func (repo *SortedSetRepository) Score(tx Querier, db int, key []byte, member []byte) (bool, float64, error) {
+	if err := checkType(tx, db, key, "zset"); err != nil {
+		return false, 0, err
+	}
+
+	var score float64
+	sqlStat := "SELECT score FROM redisdata INNER JOIN rediszsets ON redisdata.db = rediszsets.db AND redisdata.key = rediszsets.key WHERE redisdata.db = $1 AND redisdata.key = $2 AND rediszsets.value = $3 AND (redisdata.expires_at > now() OR expires_at IS NULL)"
+	err := tx.QueryRow(sqlStat, db, key, member).Scan(&score)
+	switch {
+	case err == sql.ErrNoRows:
+		return false, 0, nil
+	case err != nil:
+		return false, 0, err
+	default:
+		return true, score, nil
+	}
+}
+
+// Remove and return up to count members with the lowest (asc) or highest (desc) scores. The
+// result alternates between members and their scores.
+func (repo *SortedSetRepository) Pop(tx Querier, db int, key []byte, direction string, count int) ([]string, error) {
+	if err := checkType(tx, db, key, "zset"); err != nil {
+		return nil, err
+	}
+
+	if direction != "asc" && direction != "desc" {
+		return nil, errors.New("direction must be 'asc' or 'desc'")
+	}
+	result := make([]string, 0)
+
+	// delete any expired rows in the db with this key
+	err := deleteExpired(tx, repo.events, db, key)
+	if err != nil {
+		return result, err
+	}
+
+	sqlStat := `
+		WITH subset AS (
+			SELECT rediszsets.value
+			FROM redisdata INNER JOIN rediszsets ON redisdata.db = rediszsets.db AND redisdata.key = rediszsets.key
+			WHERE redisdata.db = $1 AND
+				redisdata.key = $2 AND
+				(redisdata.expires_at > now() OR expires_at IS NULL)
+			ORDER BY score %s, rediszsets.value %s
+			LIMIT $3
+		)
+		DELETE FROM rediszsets
+		WHERE db = $1 AND key = $2 AND value IN (SELECT value FROM subset)
+		RETURNING value, score
+	`
+	sqlStat = fmt.Sprintf(sqlStat, direction, direction)
+	rows, err := tx.Query(sqlStat, db, key, count)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	members := []sortedSetMember{}
+	for rows.Next() {
+		var member sortedSetMember
+		err = rows.Scan(&member.value, &member.score)
+		if err != nil {
+			return result, err
+		}
+		members = append(members, member)
+	}
+	err = rows.Err()
+	if err != nil {
+		return result, err
+	}
+	if len(members) == 0 {
+		return result, nil
+	}
+
+	// RETURNING doesn't guarantee any order, so put the members back in score order
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].score == members[j].score {
+			return members[i].value < members[j].value
+		}
+		return members[i].score < members[j].score
+	})
+	if direction == "desc" {
+		for i, j := 0, len(members)-1; i < j; i, j = i+1, j-1 {
+			members[i], members[j] = members[j], members[i]
+		}
+	}
+	for _, member := range members {
+		result = append(result, member.value, strconv.FormatFloat(member.score, 'f', -1, 64))
+	}
+
+	// redis names the event after the command, ZPOPMIN or ZPOPMAX
+	event := "zpopmin"
+	if direction == "desc" {
+		event = "zpopmax"
+	}
+	err = repo.events.notify(tx, NotifyZset, event, db, key)
+	if err != nil {
+		return result, err
+	}
+
+	// if the set is now empty, delete it
+	var remainingMembers int64
+	sqlStat = "SELECT count(*) FROM redisdata INNER JOIN rediszsets ON redisdata.db = rediszsets.db AND redisdata.key = rediszsets.key WHERE redisdata.db = $1 AND redisdata.key = $2"
+	err = tx.QueryRow(sqlStat, db, key).Scan(&remainingMembers)
+
+	if err != nil {
+		return result, err
+	}
+
+	if remainingMembers == 0 {
+		err = deleteKey(tx, repo.events, db, key)
+		if err != nil {
+			return result, err
+		}
+	} else {
+		// the key still exists, so bump its version for any clients watching it
+		err = touchKey(tx, db, key)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+type sortedSetMember struct {
+	value string
+	score float64
+}
+
+func (repo *SortedSetRepository) Range(tx Querier, db int, key []byte, start int, end int, direction string, withScores bool) ([]string, error) {
+	if err := checkType(tx, db, key, "zset"); err != nil {
+		return nil, err
+	}
+
 	if direction != "asc" && direction != "desc" {
 		return nil, errors.New("direction must be 'asc' or 'desc'")
 	}
 	var setLength int
 	result := make([]string, 0)
 
-	sqlStat := "SELECT count(*) FROM redisdata INNER JOIN rediszsets ON redisdata.key = rediszsets.key WHERE redisdata.key = $1 AND (redisdata.expires_at > now() OR expires_at IS NULL)"
-	err := tx.QueryRow(sqlStat, key).Scan(&setLength)
+	sqlStat := "SELECT count(*) FROM redisdata INNER JOIN rediszsets ON redisdata.db = rediszsets.db AND redisdata.key = rediszsets.key WHERE redisdata.db = $1 AND redisdata.key = $2 AND (redisdata.expires_at > now() OR expires_at IS NULL)"
+	err := tx.QueryRow(sqlStat, db, key).Scan(&setLength)
 	if err != nil {
 		return result, err
 	}
@@ -98,17 +259,18 @@ func (repo *SortedSetRepository) Range(tx *sql.Tx, key []byte, start int, end in
 		WITH subset AS (
 			SELECT rediszsets.value, score,
 			ROW_NUMBER () OVER (ORDER BY score %s,rediszsets.value %s)-1 as row
-			FROM redisdata INNER JOIN rediszsets ON redisdata.key = rediszsets.key
-			WHERE redisdata.key = $1 AND
+			FROM redisdata INNER JOIN rediszsets ON redisdata.db = rediszsets.db AND redisdata.key = rediszsets.key
+			WHERE redisdata.db = $1 AND
+				redisdata.key = $2 AND
 				(redisdata.expires_at > now() OR expires_at IS NULL)
 		)
 		SELECT value, score
 		FROM subset
-		WHERE (row BETWEEN $2 AND $3)
+		WHERE (row BETWEEN $3 AND $4)
 		ORDER BY row
 	`
 	sqlStat = fmt.Sprintf(sqlStat, direction, direction)
-	rows, err := tx.Query(sqlStat, key, start, end)
+	rows, err := tx.Query(sqlStat, db, key, start, end)
 	if err != nil {
 		return result, err
 	}
@@ -134,7 +296,11 @@ func (repo *SortedSetRepository) Range(tx *sql.Tx, key []byte, start int, end in
 	return result, nil
 }
 
-func (repo *SortedSetRepository) RangeByScore(tx *sql.Tx, key []byte, min float64, minExclusive bool, max float64, maxExclusive bool, offset int, count int, withScores bool) ([]string, error) {
+func (repo *SortedSetRepository) RangeByScore(tx Querier, db int, key []byte, min float64, minExclusive bool, max float64, maxExclusive bool, offset int, count int, withScores bool) ([]string, error) {
+	if err := checkType(tx, db, key, "zset"); err != nil {
+		return nil, err
+	}
+
 	var result []string
 	var minOperator string
 	var maxOperator string
@@ -165,17 +331,17 @@ func (repo *SortedSetRepository) RangeByScore(tx *sql.Tx, key []byte, min float6
 	// The start and end values we have assume a zero-indexed set, but in the database we don't store an index
 	// This uses a CTE to select the set values and assign an in-memory zero-index that we can select on
 	if math.IsInf(min, 0) && math.IsInf(max, 0) {
-		sqlStat := "SELECT rediszsets.value, score FROM redisdata INNER JOIN rediszsets ON redisdata.key = rediszsets.key WHERE redisdata.key = $1 AND (redisdata.expires_at > now() OR expires_at IS NULL) ORDER BY rediszsets.score, rediszsets.value" + sqlLimit
-		rows, err = tx.Query(sqlStat, key)
+		sqlStat := "SELECT rediszsets.value, score FROM redisdata INNER JOIN rediszsets ON redisdata.db = rediszsets.db AND redisdata.key = rediszsets.key WHERE redisdata.db = $1 AND redisdata.key = $2 AND (redisdata.expires_at > now() OR expires_at IS NULL) ORDER BY rediszsets.score, rediszsets.value" + sqlLimit
+		rows, err = tx.Query(sqlStat, db, key)
 	} else if !math.IsInf(min, 0) && !math.IsInf(max, 0) {
-		sqlStat := fmt.Sprintf("SELECT rediszsets.value, score FROM redisdata INNER JOIN rediszsets ON redisdata.key = rediszsets.key WHERE redisdata.key = $1 AND score %s $2 AND score %s $3 AND (redisdata.expires_at > now() OR expires_at IS NULL) ORDER BY rediszsets.score, rediszsets.value", minOperator, maxOperator) + sqlLimit
-		rows, err = tx.Query(sqlStat, key, min, max)
+		sqlStat := fmt.Sprintf("SELECT rediszsets.value, score FROM redisdata INNER JOIN rediszsets ON redisdata.db = rediszsets.db AND redisdata.key = rediszsets.key WHERE redisdata.db = $1 AND redisdata.key = $2 AND score %s $3 AND score %s $4 AND (redisdata.expires_at > now() OR expires_at IS NULL) ORDER BY rediszsets.score, rediszsets.value", minOperator, maxOperator) + sqlLimit
+		rows, err = tx.Query(sqlStat, db, key, min, max)
 	} else if math.IsInf(min, 0) {
-		sqlStat := fmt.Sprintf("SELECT rediszsets.value, score FROM redisdata INNER JOIN rediszsets ON redisdata.key = rediszsets.key WHERE redisdata.key = $1 AND score %s $2 AND (redisdata.expires_at > now() OR expires_at IS NULL) ORDER BY rediszsets.score, rediszsets.value", maxOperator) + sqlLimit
-		rows, err = tx.Query(sqlStat, key, max)
+		sqlStat := fmt.Sprintf("SELECT rediszsets.value, score FROM redisdata INNER JOIN rediszsets ON redisdata.db = rediszsets.db AND redisdata.key = rediszsets.key WHERE redisdata.db = $1 AND redisdata.key = $2 AND score %s $3 AND (redisdata.expires_at > now() OR expires_at IS NULL) ORDER BY rediszsets.score, rediszsets.value", maxOperator) + sqlLimit
+		rows, err = tx.Query(sqlStat, db, key, max)
 	} else if math.IsInf(max, 0) {
-		sqlStat := fmt.Sprintf("SELECT rediszsets.value,score FROM redisdata INNER JOIN rediszsets ON redisdata.key = rediszsets.key WHERE redisdata.key = $1 AND score %s $2 AND (redisdata.expires_at > now() OR expires_at IS NULL) ORDER BY rediszsets.score, rediszsets.value", minOperator) + sqlLimit
-		rows, err = tx.Query(sqlStat, key, min)
+		sqlStat := fmt.Sprintf("SELECT rediszsets.value,score FROM redisdata INNER JOIN rediszsets ON redisdata.db = rediszsets.db AND redisdata.key = rediszsets.key WHERE redisdata.db = $1 AND redisdata.key = $2 AND score %s $3 AND (redisdata.expires_at > now() OR expires_at IS NULL) ORDER BY rediszsets.score, rediszsets.value", minOperator) + sqlLimit
+		rows, err = tx.Query(sqlStat, db, key, min)
 	}
 
 	if err != nil {
@@ -203,11 +369,14 @@ func (repo *SortedSetRepository) RangeByScore(tx *sql.Tx, key []byte, min float6
 	return result, nil
 }
 
-func (repo *SortedSetRepository) Remove(tx *sql.Tx, key []byte, values [][]byte) (count int64, err error) {
+func (repo *SortedSetRepository) Remove(tx Querier, db int, key []byte, values [][]byte) (count int64, err error) {
+	if err := checkType(tx, db, key, "zset"); err != nil {
+		return 0, err
+	}
+
 	// delete any expired rows in the db with this key
 	// we do this first so the count we return at the end doesn't include these rows
-	sqlStat := "DELETE FROM redisdata WHERE key=$1 AND expires_at < now()"
-	_, err = tx.Exec(sqlStat, key)
+	err = deleteExpired(tx, repo.events, db, key)
 	if err != nil {
 		return 0, err
 	}
@@ -215,8 +384,8 @@ func (repo *SortedSetRepository) Remove(tx *sql.Tx, key []byte, values [][]byte)
 	// Delete each member
 	// TODO presumably there's a way to do this in a single SQL statement?
 	for _, value := range values {
-		sqlStat = "DELETE FROM rediszsets WHERE key=$1 AND value = $2"
-		res, err := tx.Exec(sqlStat, key, value)
+		sqlStat := "DELETE FROM rediszsets WHERE db = $1 AND key = $2 AND value = $3"
+		res, err := tx.Exec(sqlStat, db, key, value)
 		if err != nil {
 			return 0, err
 		}
@@ -224,18 +393,30 @@ func (repo *SortedSetRepository) Remove(tx *sql.Tx, key []byte, values [][]byte)
 		count += rowCount
 	}
 
+	if count > 0 {
+		err = repo.events.notify(tx, NotifyZset, "zrem", db, key)
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	// if the set is now empty, delete it
 	var remainingMembers int64
-	sqlStat = "SELECT count(*) FROM redisdata INNER JOIN rediszsets ON redisdata.key = rediszsets.key WHERE redisdata.key = $1"
-	err = tx.QueryRow(sqlStat, key).Scan(&remainingMembers)
+	sqlStat := "SELECT count(*) FROM redisdata INNER JOIN rediszsets ON redisdata.db = rediszsets.db AND redisdata.key = rediszsets.key WHERE redisdata.db = $1 AND redisdata.key = $2"
+	err = tx.QueryRow(sqlStat, db, key).Scan(&remainingMembers)
 
 	if err != nil {
 		return 0, err
 	}
 
 	if remainingMembers == 0 {
-		sqlStat = "DELETE FROM redisdata WHERE key=$1"
-		_, err := tx.Exec(sqlStat, key)
+		err = deleteKey(tx, repo.events, db, key)
+		if err != nil {
+			return 0, err
+		}
+	} else if count > 0 {
+		// the key still exists, so bump its version for any clients watching it
+		err = touchKey(tx, db, key)
 		if err != nil {
 			return 0, err
 		}
@@ -244,19 +425,22 @@ func (repo *SortedSetRepository) Remove(tx *sql.Tx, key []byte, values [][]byte)
 	return count, nil
 }
 
-func (repo *SortedSetRepository) RemoveRangeByRank(tx *sql.Tx, key []byte, start int, end int) (count int64, err error) {
+func (repo *SortedSetRepository) RemoveRangeByRank(tx Querier, db int, key []byte, start int, end int) (count int64, err error) {
+	if err := checkType(tx, db, key, "zset"); err != nil {
+		return 0, err
+	}
+
 	var setLength int
 
 	// delete any expired rows in the db with this key
 	// we do this first so the count we return at the end doesn't include these rows
-	sqlStat := "DELETE FROM redisdata WHERE key=$1 AND expires_at < now()"
-	_, err = tx.Exec(sqlStat, key)
+	err = deleteExpired(tx, repo.events, db, key)
 	if err != nil {
 		return 0, err
 	}
 
-	sqlStat = "SELECT count(*) FROM redisdata INNER JOIN rediszsets ON redisdata.key = rediszsets.key WHERE redisdata.key = $1 AND (redisdata.expires_at > now() OR expires_at IS NULL)"
-	err = tx.QueryRow(sqlStat, key).Scan(&setLength)
+	sqlStat := "SELECT count(*) FROM redisdata INNER JOIN rediszsets ON redisdata.db = rediszsets.db AND redisdata.key = rediszsets.key WHERE redisdata.db = $1 AND redisdata.key = $2 AND (redisdata.expires_at > now() OR expires_at IS NULL)"
+	err = tx.QueryRow(sqlStat, db, key).Scan(&setLength)
 	if err != nil {
 		return 0, err
 	}
@@ -279,34 +463,47 @@ func (repo *SortedSetRepository) RemoveRangeByRank(tx *sql.Tx, key []byte, start
 		WITH subset AS (
 			SELECT rediszsets.ctid, rediszsets.value, score,
 			ROW_NUMBER () OVER (ORDER BY score,rediszsets.value)-1 as row
-			FROM redisdata INNER JOIN rediszsets ON redisdata.key = rediszsets.key
-			WHERE redisdata.key = $1 AND
+			FROM redisdata INNER JOIN rediszsets ON redisdata.db = rediszsets.db AND redisdata.key = rediszsets.key
+			WHERE redisdata.db = $1 AND
+				redisdata.key = $2 AND
 				(redisdata.expires_at > now() OR expires_at IS NULL)
 		)
 		DELETE FROM rediszsets
-		WHERE key = $1 AND ctid IN (
-			SELECT ctid from subset WHERE row >= $2 AND row <= $3
+		WHERE db = $1 AND key = $2 AND ctid IN (
+			SELECT ctid from subset WHERE row >= $3 AND row <= $4
 		)
 	`
-	res, err := tx.Exec(sqlStat, key, start, end)
+	res, err := tx.Exec(sqlStat, db, key, start, end)
 	if err != nil {
 		return 0, err
 	}
 	rowCount, _ := res.RowsAffected()
 	count += rowCount
 
+	if count > 0 {
+		err = repo.events.notify(tx, NotifyZset, "zremrangebyrank", db, key)
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	// if the set is now empty, delete it
 	var remainingMembers int64
-	sqlStat = "SELECT count(*) FROM redisdata INNER JOIN rediszsets ON redisdata.key = rediszsets.key WHERE redisdata.key = $1"
-	err = tx.QueryRow(sqlStat, key).Scan(&remainingMembers)
+	sqlStat = "SELECT count(*) FROM redisdata INNER JOIN rediszsets ON redisdata.db = rediszsets.db AND redisdata.key = rediszsets.key WHERE redisdata.db = $1 AND redisdata.key = $2"
+	err = tx.QueryRow(sqlStat, db, key).Scan(&remainingMembers)
 
 	if err != nil {
 		return 0, err
 	}
 
 	if remainingMembers == 0 {
-		sqlStat = "DELETE FROM redisdata WHERE key=$1"
-		_, err := tx.Exec(sqlStat, key)
+		err = deleteKey(tx, repo.events, db, key)
+		if err != nil {
+			return 0, err
+		}
+	} else if count > 0 {
+		// the key still exists, so bump its version for any clients watching it
+		err = touchKey(tx, db, key)
 		if err != nil {
 			return 0, err
 		}
@@ -315,8 +512,13 @@ func (repo *SortedSetRepository) RemoveRangeByRank(tx *sql.Tx, key []byte, start
 	return count, nil
 }
 
-func (repo *SortedSetRepository) RemoveRangeByScore(tx *sql.Tx, key []byte, min float64, minExclusive bool, max float64, maxExclusive bool) (count int64, err error) {
+func (repo *SortedSetRepository) RemoveRangeByScore(tx Querier, db int, key []byte, min float64, minExclusive bool, max float64, maxExclusive bool) (count int64, err error) {
+	if err := checkType(tx, db, key, "zset"); err != nil {
+		return 0, err
+	}
+
 	var res sql.Result
+	var sqlStat string
 	var minOperator string
 	var maxOperator string
 
@@ -334,8 +536,7 @@ func (repo *SortedSetRepository) RemoveRangeByScore(tx *sql.Tx, key []byte, min
 
 	// delete any expired rows in the db with this key
 	// we do this first so the count we return at the end doesn't include these rows
-	sqlStat := "DELETE FROM redisdata WHERE key=$1 AND expires_at < now()"
-	_, err = tx.Exec(sqlStat, key)
+	err = deleteExpired(tx, repo.events, db, key)
 	if err != nil {
 		return 0, err
 	}
@@ -343,17 +544,17 @@ func (repo *SortedSetRepository) RemoveRangeByScore(tx *sql.Tx, key []byte, min
 	// The start and end values we have assume a zero-indexed set, but in the database we don't store an index
 	// This uses a CTE to select the set values and assign an in-memory zero-index that we can select on
 	if math.IsInf(min, 0) && math.IsInf(max, 0) {
-		sqlStat = "DELETE FROM rediszsets WHERE key = $1"
-		res, err = tx.Exec(sqlStat, key)
+		sqlStat = "DELETE FROM rediszsets WHERE db = $1 AND key = $2"
+		res, err = tx.Exec(sqlStat, db, key)
 	} else if !math.IsInf(min, 0) && !math.IsInf(max, 0) {
-		sqlStat = fmt.Sprintf("DELETE FROM rediszsets WHERE key = $1 AND score %s $2 AND score %s $3", minOperator, maxOperator)
-		res, err = tx.Exec(sqlStat, key, min, max)
+		sqlStat = fmt.Sprintf("DELETE FROM rediszsets WHERE db = $1 AND key = $2 AND score %s $3 AND score %s $4", minOperator, maxOperator)
+		res, err = tx.Exec(sqlStat, db, key, min, max)
 	} else if math.IsInf(min, 0) {
-		sqlStat = fmt.Sprintf("DELETE FROM rediszsets WHERE key = $1 AND score %s $2", maxOperator)
-		res, err = tx.Exec(sqlStat, key, max)
+		sqlStat = fmt.Sprintf("DELETE FROM rediszsets WHERE db = $1 AND key = $2 AND score %s $3", maxOperator)
+		res, err = tx.Exec(sqlStat, db, key, max)
 	} else if math.IsInf(max, 0) {
-		sqlStat = fmt.Sprintf("DELETE FROM rediszsets WHERE key = $1 AND score %s $2", minOperator)
-		res, err = tx.Exec(sqlStat, key, min)
+		sqlStat = fmt.Sprintf("DELETE FROM rediszsets WHERE db = $1 AND key = $2 AND score %s $3", minOperator)
+		res, err = tx.Exec(sqlStat, db, key, min)
 	}
 	if err != nil {
 		return 0, err
@@ -361,18 +562,30 @@ func (repo *SortedSetRepository) RemoveRangeByScore(tx *sql.Tx, key []byte, min
 	rowCount, _ := res.RowsAffected()
 	count += rowCount
 
+	if count > 0 {
+		err = repo.events.notify(tx, NotifyZset, "zremrangebyscore", db, key)
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	// if the set is now empty, delete it
 	var remainingMembers int64
-	sqlStat = "SELECT count(*) FROM redisdata INNER JOIN rediszsets ON redisdata.key = rediszsets.key WHERE redisdata.key = $1"
-	err = tx.QueryRow(sqlStat, key).Scan(&remainingMembers)
+	sqlStat = "SELECT count(*) FROM redisdata INNER JOIN rediszsets ON redisdata.db = rediszsets.db AND redisdata.key = rediszsets.key WHERE redisdata.db = $1 AND redisdata.key = $2"
+	err = tx.QueryRow(sqlStat, db, key).Scan(&remainingMembers)
 
 	if err != nil {
 		return 0, err
 	}
 
 	if remainingMembers == 0 {
-		sqlStat = "DELETE FROM redisdata WHERE key=$1"
-		_, err := tx.Exec(sqlStat, key)
+		err = deleteKey(tx, repo.events, db, key)
+		if err != nil {
+			return 0, err
+		}
+	} else if count > 0 {
+		// the key still exists, so bump its version for any clients watching it
+		err = touchKey(tx, db, key)
 		if err != nil {
 			return 0, err
 		}
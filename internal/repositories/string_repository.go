@@ -31,18 +31,24 @@ func (str *RedisString) WillExpire() bool {
 	}
 }
 
-type StringRepository struct{}
+type StringRepository struct {
+	events *KeyspaceEvents
+}
 
-func NewStringRepository() *StringRepository {
-	return &StringRepository{}
+func NewStringRepository(events *KeyspaceEvents) *StringRepository {
+	return &StringRepository{events: events}
 }
 
-func (repo *StringRepository) Get(tx *sql.Tx, key []byte) (bool, RedisString, error) {
+func (repo *StringRepository) Get(tx Querier, db int, key []byte) (bool, RedisString, error) {
+	if err := checkType(tx, db, key, "string"); err != nil {
+		return false, RedisString{}, err
+	}
+
 	result := RedisString{}
 	var expiresAt pq.NullTime
 
-	sqlStat := "SELECT key, value, expires_at FROM redisdata WHERE key = $1 AND (expires_at > now() OR expires_at IS NULL)"
-	row := tx.QueryRow(sqlStat, key)
+	sqlStat := "SELECT key, value, expires_at FROM redisdata WHERE db = $1 AND key = $2 AND (expires_at > now() OR expires_at IS NULL)"
+	row := tx.QueryRow(sqlStat, db, key)
 
 	switch err := row.Scan(&result.Key, &result.Value, &expiresAt); err {
 	case sql.ErrNoRows:
@@ -57,57 +63,70 @@ func (repo *StringRepository) Get(tx *sql.Tx, key []byte) (bool, RedisString, er
 	}
 }
 
-func (repo *StringRepository) InsertOrUpdate(tx *sql.Tx, key []byte, value []byte, expiry_millis int) (err error) {
+func (repo *StringRepository) InsertOrUpdate(tx Querier, db int, key []byte, value []byte, expiry_millis int) (err error) {
 	// TODO consider merging this into InsertOrUpdateMultiple. Insterting one thing is just a specical
 	// case of inserting many things
+
+	// SET replaces a key of any type
+	_, err = deleteOtherType(tx, db, key, "string")
+	if err != nil {
+		return err
+	}
+
 	if expiry_millis == 0 {
-		sqlStat := "INSERT INTO redisdata(key, type, value, expires_at) VALUES ($1, 'string', $2, NULL) ON CONFLICT (key) DO UPDATE SET type='string', value = EXCLUDED.value, expires_at = NULL"
-		_, err = tx.Exec(sqlStat, key, value)
+		sqlStat := "INSERT INTO redisdata(db, key, type, value, expires_at) VALUES ($1, $2, 'string', $3, NULL) ON CONFLICT (db, key) DO UPDATE SET type='string', value = EXCLUDED.value, expires_at = NULL, version = nextval('redisdata_version_seq')"
+		_, err = tx.Exec(sqlStat, db, key, value)
 	} else {
-		sqlStat := "INSERT INTO redisdata(key, type, value, expires_at) VALUES ($1, 'string', $2, now() + cast($3 as interval)) ON CONFLICT (key) DO UPDATE SET type='string', value = EXCLUDED.value, expires_at = EXCLUDED.expires_at"
+		sqlStat := "INSERT INTO redisdata(db, key, type, value, expires_at) VALUES ($1, $2, 'string', $3, now() + cast($4 as interval)) ON CONFLICT (db, key) DO UPDATE SET type='string', value = EXCLUDED.value, expires_at = EXCLUDED.expires_at, version = nextval('redisdata_version_seq')"
 		interval := fmt.Sprintf("%d milliseconds", expiry_millis)
-		_, err = tx.Exec(sqlStat, key, value, interval)
+		_, err = tx.Exec(sqlStat, db, key, value, interval)
 	}
 	if err != nil {
 		return err
 	}
-	return nil
+	return repo.notifySet(tx, db, key, expiry_millis)
 }
 
-func (repo *StringRepository) InsertOrUpdateMultiple(tx *sql.Tx, items map[string]string) (err error) {
+func (repo *StringRepository) InsertOrUpdateMultiple(tx Querier, db int, items map[string]string) (err error) {
 	// with deadlock-avoiding sorted locks in plac, now it's safe to modify
 	// values in user-provided order
+	events := []keyspaceEvent{}
 	for key, value := range items {
 		// TODO could we do this in a single SQL statement?
-		sqlStat := "INSERT INTO redisdata(key, type, value, expires_at) VALUES ($1, 'string', $2, NULL) ON CONFLICT (key) DO UPDATE SET type='string', value = EXCLUDED.value, expires_at = NULL"
-		_, err = tx.Exec(sqlStat, key, value)
+		_, err = deleteOtherType(tx, db, []byte(key), "string")
 		if err != nil {
 			return err
 		}
+
+		sqlStat := "INSERT INTO redisdata(db, key, type, value, expires_at) VALUES ($1, $2, 'string', $3, NULL) ON CONFLICT (db, key) DO UPDATE SET type='string', value = EXCLUDED.value, expires_at = NULL, version = nextval('redisdata_version_seq')"
+		_, err = tx.Exec(sqlStat, db, key, value)
+		if err != nil {
+			return err
+		}
+		events = append(events, keyspaceEvent{class: NotifyString, name: "set", db: db, key: []byte(key)})
 	}
 
-	return nil
+	return repo.events.notifyAll(tx, events)
 }
 
-func (repo *StringRepository) InsertOrSkip(tx *sql.Tx, key []byte, value []byte, expiry_millis int) (inserted bool, err error) {
+func (repo *StringRepository) InsertOrSkip(tx Querier, db int, key []byte, value []byte, expiry_millis int) (inserted bool, err error) {
 
 	// delete any expired rows in the db with this key
-	sqlStat := "DELETE FROM redisdata WHERE key=$1 AND expires_at < now()"
-	_, err = tx.Exec(sqlStat, key)
+	err = deleteExpired(tx, repo.events, db, key)
 	if err != nil {
 		return false, err
 	}
 
 	var res sql.Result
 	if expiry_millis == 0 {
-		sqlStat := "INSERT INTO redisdata(key, type, value, expires_at) VALUES ($1, 'string', $2, NULL) ON CONFLICT (key) DO NOTHING"
-		res, err = tx.Exec(sqlStat, key, value)
+		sqlStat := "INSERT INTO redisdata(db, key, type, value, expires_at) VALUES ($1, $2, 'string', $3, NULL) ON CONFLICT (db, key) DO NOTHING"
+		res, err = tx.Exec(sqlStat, db, key, value)
 		count, _ := res.RowsAffected()
 		inserted = count > 0
 	} else {
-		sqlStat := "INSERT INTO redisdata(key, type, value, expires_at) VALUES ($1, 'string', $2, now() + cast($3 as interval)) ON CONFLICT DO NOTHING"
+		sqlStat := "INSERT INTO redisdata(db, key, type, value, expires_at) VALUES ($1, $2, 'string', $3, now() + cast($4 as interval)) ON CONFLICT DO NOTHING"
 		interval := fmt.Sprintf("%d milliseconds", expiry_millis)
-		res, err = tx.Exec(sqlStat, key, value, interval)
+		res, err = tx.Exec(sqlStat, db, key, value, interval)
 		count, _ := res.RowsAffected()
 		inserted = count > 0
 	}
@@ -115,28 +134,42 @@ func (repo *StringRepository) InsertOrSkip(tx *sql.Tx, key []byte, value []byte,
 		return false, err
 	}
 
+	if inserted {
+		err = repo.notifySet(tx, db, key, expiry_millis)
+		if err != nil {
+			return false, err
+		}
+	}
 	return inserted, nil
 }
 
-func (repo *StringRepository) UpdateOrSkip(tx *sql.Tx, key []byte, value []byte, expiry_millis int) (updated bool, err error) {
+func (repo *StringRepository) UpdateOrSkip(tx Querier, db int, key []byte, value []byte, expiry_millis int) (updated bool, err error) {
 
 	// delete any expired rows in the db with this key
-	sqlStat := "DELETE FROM redisdata WHERE key=$1 AND expires_at < now()"
-	_, err = tx.Exec(sqlStat, key)
+	err = deleteExpired(tx, repo.events, db, key)
 	if err != nil {
 		return false, err
 	}
 
+	// SET XX replaces a key of any type, as long as it exists
+	replaced, err := deleteOtherType(tx, db, key, "string")
+	if err != nil {
+		return false, err
+	}
+	if replaced {
+		return repo.InsertOrSkip(tx, db, key, value, expiry_millis)
+	}
+
 	var res sql.Result
 	if expiry_millis == 0 {
-		sqlStat := "UPDATE redisdata SET type='string', value=$2, expires_at=NULL WHERE key=$1"
-		res, err = tx.Exec(sqlStat, key, value)
+		sqlStat := "UPDATE redisdata SET type='string', value=$3, expires_at=NULL, version = nextval('redisdata_version_seq') WHERE db = $1 AND key = $2"
+		res, err = tx.Exec(sqlStat, db, key, value)
 		count, _ := res.RowsAffected()
 		updated = count > 0
 	} else {
-		sqlStat := "UPDATE redisdata SET type='string', value=$2, expires_at=now() + cast($3 as interval) WHERE key=$1"
+		sqlStat := "UPDATE redisdata SET type='string', value=$3, expires_at=now() + cast($4 as interval), version = nextval('redisdata_version_seq') WHERE db = $1 AND key = $2"
 		interval := fmt.Sprintf("%d milliseconds", expiry_millis)
-		res, err = tx.Exec(sqlStat, key, value, interval)
+		res, err = tx.Exec(sqlStat, db, key, value, interval)
 		count, _ := res.RowsAffected()
 		updated = count > 0
 	}
@@ -144,44 +177,96 @@ func (repo *StringRepository) UpdateOrSkip(tx *sql.Tx, key []byte, value []byte,
 		return false, err
 	}
 
+	if updated {
+		err = repo.notifySet(tx, db, key, expiry_millis)
+		if err != nil {
+			return false, err
+		}
+	}
 	return updated, nil
 }
 
-func (repo *StringRepository) InsertOrAppend(tx *sql.Tx, key []byte, value []byte) ([]byte, error) {
+// SET publishes a set event, and an expire event if it gave the key an expiry
+func (repo *StringRepository) notifySet(tx Querier, db int, key []byte, expiry_millis int) error {
+	events := []keyspaceEvent{{class: NotifyString, name: "set", db: db, key: key}}
+	if expiry_millis != 0 {
+		events = append(events, keyspaceEvent{class: NotifyGeneric, name: "expire", db: db, key: key})
+	}
+	return repo.events.notifyAll(tx, events)
+}
+
+func (repo *StringRepository) InsertOrAppend(tx Querier, db int, key []byte, value []byte) ([]byte, error) {
+	if err := checkType(tx, db, key, "string"); err != nil {
+		return nil, err
+	}
+
 	var finalValue []byte
 
 	// delete any expired rows in the db with this key
-	sqlStat := "DELETE FROM redisdata WHERE key=$1 AND expires_at < now()"
-	_, err := tx.Exec(sqlStat, key)
+	err := deleteExpired(tx, repo.events, db, key)
 	if err != nil {
 		return nil, err
 	}
 
-	sqlStat = "INSERT INTO redisdata(key, type, value) VALUES ($1, 'string', $2) ON CONFLICT (key) DO UPDATE SET type = 'string', value = redisdata.value || EXCLUDED.value RETURNING value"
-	err = tx.QueryRow(sqlStat, key, value).Scan(&finalValue)
+	sqlStat := "INSERT INTO redisdata(db, key, type, value) VALUES ($1, $2, 'string', $3) ON CONFLICT (db, key) DO UPDATE SET type = 'string', value = redisdata.value || EXCLUDED.value, version = nextval('redisdata_version_seq') RETURNING value"
+	err = tx.QueryRow(sqlStat, db, key, value).Scan(&finalValue)
 	if err != nil {
 		return nil, err
 	}
 
+	err = repo.events.notify(tx, NotifyString, "append", db, key)
+	if err != nil {
+		return nil, err
+	}
 	return finalValue, nil
 }
 
-func (repo *StringRepository) Incr(tx *sql.Tx, key []byte, by int) ([]byte, error) {
+func (repo *StringRepository) Incr(tx Querier, db int, key []byte, by int) ([]byte, error) {
+	if err := checkType(tx, db, key, "string"); err != nil {
+		return nil, err
+	}
+
 	var finalValue []byte
 
-	sqlStat := "INSERT INTO redisdata(key, type, value) VALUES ($1, 'string', $2) ON CONFLICT (key) DO UPDATE SET type='string', value = CASE WHEN redisdata.expires_at < now() THEN $3 ELSE ((cast(encode(redisdata.value,'escape') as integer)+$4)::text)::bytea END , expires_at = NULL RETURNING value"
-	err := tx.QueryRow(sqlStat, key, by, by, by).Scan(&finalValue)
+	// delete any expired rows in the db with this key
+	err := deleteExpired(tx, repo.events, db, key)
+	if err != nil {
+		return nil, err
+	}
+
+	sqlStat := "INSERT INTO redisdata(db, key, type, value) VALUES ($1, $2, 'string', $3) ON CONFLICT (db, key) DO UPDATE SET type='string', value = CASE WHEN redisdata.expires_at < now() THEN $4 ELSE ((cast(encode(redisdata.value,'escape') as integer)+$5)::text)::bytea END , expires_at = NULL, version = nextval('redisdata_version_seq') RETURNING value"
+	err = tx.QueryRow(sqlStat, db, key, by, by, by).Scan(&finalValue)
+	if err != nil {
+		return nil, err
+	}
+
+	err = repo.events.notify(tx, NotifyString, "incrby", db, key)
 	if err != nil {
 		return nil, err
 	}
 	return finalValue, nil
 }
 
-func (repo *StringRepository) IncrDecimal(tx *sql.Tx, key []byte, by float64) ([]byte, error) {
+func (repo *StringRepository) IncrDecimal(tx Querier, db int, key []byte, by float64) ([]byte, error) {
+	if err := checkType(tx, db, key, "string"); err != nil {
+		return nil, err
+	}
+
 	var finalValue []byte
 
-	sqlStat := "INSERT INTO redisdata(key, type, value) VALUES ($1, 'string', $2) ON CONFLICT (key) DO UPDATE SET type='string', value = CASE WHEN redisdata.expires_at < now() THEN $3 ELSE ((cast(encode(redisdata.value,'escape') as decimal)+$4)::text)::bytea END, expires_at = NULL RETURNING value"
-	err := tx.QueryRow(sqlStat, key, by, by, by).Scan(&finalValue)
+	// delete any expired rows in the db with this key
+	err := deleteExpired(tx, repo.events, db, key)
+	if err != nil {
+		return nil, err
+	}
+
+	sqlStat := "INSERT INTO redisdata(db, key, type, value) VALUES ($1, $2, 'string', $3) ON CONFLICT (db, key) DO UPDATE SET type='string', value = CASE WHEN redisdata.expires_at < now() THEN $4 ELSE ((cast(encode(redisdata.value,'escape') as decimal)+$5)::text)::bytea END, expires_at = NULL, version = nextval('redisdata_version_seq') RETURNING value"
+	err = tx.QueryRow(sqlStat, db, key, by, by, by).Scan(&finalValue)
+	if err != nil {
+		return nil, err
+	}
+
+	err = repo.events.notify(tx, NotifyString, "incrbyfloat", db, key)
 	if err != nil {
 		return nil, err
 	}
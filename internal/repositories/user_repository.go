@@ -0,0 +1,112 @@
+package repositories
+
+import (
+	"database/sql"
+)
+
+// Every pgredis instance LISTENs on this channel, so it can drop any ACL users it has cached when
+// they're changed by another instance. The payload is the name of the user.
+const UserChangedChannel = "pgredis_users"
+
+// The default user, which every connection starts as. It's created with access to everything and
+// no password, like it is in redis.
+const (
+	DefaultUserName  = "default"
+	DefaultUserRules = "on nopass ~* &* +@all"
+)
+
+// Users are locked with the two argument form of pg_advisory_xact_lock, like keys. Keys use the
+// number of their database as the first argument, so users use a number no database can have.
+// Like keys, the second argument includes the schema, which has users of its own.
+const userLockSpace = -2
+
+type UserRepository struct{}
+
+func NewUserRepository() *UserRepository {
+	return &UserRepository{}
+}
+
+// A user and their ACL rules, in the form ACL LIST prints them
+type UserRules struct {
+	Name  string
+	Rules string
+}
+
+// Lock a user until the end of the transaction, whether or not it exists yet
+func (repo *UserRepository) Lock(tx Querier, name string) error {
+	sqlStat := "SELECT pg_advisory_xact_lock($1, hashtext(current_schema() || $2::text))"
+	_, err := tx.Exec(sqlStat, userLockSpace, name)
+	return err
+}
+
+func (repo *UserRepository) Get(tx Querier, name string) (bool, string, error) {
+	var rules string
+	sqlStat := "SELECT rules FROM redisusers WHERE name = $1"
+	err := tx.QueryRow(sqlStat, name).Scan(&rules)
+	switch {
+	case err == sql.ErrNoRows:
+		return false, "", nil
+	case err != nil:
+		return false, "", err
+	default:
+		return true, rules, nil
+	}
+}
+
+func (repo *UserRepository) List(tx Querier) ([]UserRules, error) {
+	result := []UserRules{}
+
+	sqlStat := "SELECT name, rules FROM redisusers ORDER BY name"
+	rows, err := tx.Query(sqlStat)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user UserRules
+		err = rows.Scan(&user.Name, &user.Rules)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, user)
+	}
+	return result, rows.Err()
+}
+
+// Create or replace a user. Every instance is told about the change once the transaction commits.
+func (repo *UserRepository) Save(tx Querier, name string, rules string) error {
+	sqlStat := "INSERT INTO redisusers (name, rules) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET rules = EXCLUDED.rules"
+	_, err := tx.Exec(sqlStat, name, rules)
+	if err != nil {
+		return err
+	}
+	return notifyUserChanged(tx, name)
+}
+
+// Delete users, returning the number that existed
+func (repo *UserRepository) Delete(tx Querier, names []string) (int64, error) {
+	var count int64 = 0
+	for _, name := range names {
+		sqlStat := "DELETE FROM redisusers WHERE name = $1"
+		res, err := tx.Exec(sqlStat, name)
+		if err != nil {
+			return 0, err
+		}
+		deleted, _ := res.RowsAffected()
+		if deleted > 0 {
+			count += deleted
+			err = notifyUserChanged(tx, name)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return count, nil
+}
+
+func notifyUserChanged(tx Querier, name string) error {
+	sqlStat := "SELECT pg_notify(current_setting('pgredis.channel_prefix') || $1, $2)"
+	_, err := tx.Exec(sqlStat, UserChangedChannel, name)
+	return err
+}
@@ -0,0 +1,161 @@
+package pgredis
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/yob/pgredis/internal/repositories"
+)
+
+// Postgres delivers NOTIFY messages to connections that have run LISTEN, and those connections
+// can't be returned to the pool while they're listening. Each pgredis instance opens a single
+// dedicated connection for LISTEN and fans the notifications out to any interested goroutines.
+type notificationListener struct {
+	listener *pq.Listener
+	mutex    sync.Mutex
+	handlers map[string]func(*pq.Notification)
+}
+
+func newNotificationListener(connStr string) *notificationListener {
+	eventCallback := func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Println("Error on notification listener: ", err)
+		}
+	}
+	result := &notificationListener{
+		listener: pq.NewListener(connStr, 10*time.Millisecond, time.Minute, eventCallback),
+		handlers: map[string]func(*pq.Notification){},
+	}
+	go result.dispatch()
+	return result
+}
+
+// Register a handler for notifications on channel. The handler will be called with a nil
+// notification if the listening connection was lost and re-established, as notifications may
+// have been missed in the meantime.
+func (l *notificationListener) listen(channel string, handler func(*pq.Notification)) error {
+	l.mutex.Lock()
+	l.handlers[channel] = handler
+	l.mutex.Unlock()
+
+	return l.listener.Listen(channel)
+}
+
+// Stop listening. The handlers won't be called again.
+func (l *notificationListener) close() {
+	err := l.listener.Close()
+	if err != nil {
+		log.Println("Error closing notification listener: ", err)
+	}
+}
+
+func (l *notificationListener) dispatch() {
+	for notification := range l.listener.Notify {
+		l.mutex.Lock()
+		if notification == nil {
+			for _, handler := range l.handlers {
+				handler(nil)
+			}
+		} else if handler, ok := l.handlers[notification.Channel]; ok {
+			handler(notification)
+		}
+		l.mutex.Unlock()
+	}
+}
+
+// Channels are shared by every schema in the database, so instances with their tables in a schema
+// add it to the start of each channel's name. Instances using the default schema don't, so they
+// keep the names earlier versions used.
+func channelPrefix(schema string) string {
+	if schema == "" {
+		return ""
+	}
+	return schema + "."
+}
+
+// keyWaiters tracks the clients that are blocked waiting for a key to change (eg. BRPOP), so they
+// can be woken when a notification arrives. Notifications identify keys by their digest, so the
+// waiters are too. Two keys with the same digest only cause a wakeup that finds nothing to do.
+type keyWaiters struct {
+	mutex   sync.Mutex
+	waiters map[dbKey]map[chan struct{}]bool
+}
+
+func newKeyWaiters() *keyWaiters {
+	return &keyWaiters{
+		waiters: map[dbKey]map[chan struct{}]bool{},
+	}
+}
+
+// Register interest in a set of keys. The returned channel will receive a value each time one of
+// the keys might have changed. It's buffered, so a wakeup that arrives while the client is busy
+// isn't lost.
+func (w *keyWaiters) register(db int, keys []string) chan struct{} {
+	wakeup := make(chan struct{}, 1)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for _, key := range keys {
+		waitingKey := dbKey{db: db, key: repositories.KeyDigest([]byte(key))}
+		if w.waiters[waitingKey] == nil {
+			w.waiters[waitingKey] = map[chan struct{}]bool{}
+		}
+		w.waiters[waitingKey][wakeup] = true
+	}
+	return wakeup
+}
+
+func (w *keyWaiters) unregister(db int, keys []string, wakeup chan struct{}) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for _, key := range keys {
+		waitingKey := dbKey{db: db, key: repositories.KeyDigest([]byte(key))}
+		delete(w.waiters[waitingKey], wakeup)
+		if len(w.waiters[waitingKey]) == 0 {
+			delete(w.waiters, waitingKey)
+		}
+	}
+}
+
+func (w *keyWaiters) wake(db int, digest string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for wakeup := range w.waiters[dbKey{db: db, key: digest}] {
+		notify(wakeup)
+	}
+}
+
+func (w *keyWaiters) wakeAll() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for _, waiters := range w.waiters {
+		for wakeup := range waiters {
+			notify(wakeup)
+		}
+	}
+}
+
+// Handle a notification that contains a database number and key digest as the payload
+func (w *keyWaiters) handleNotification(notification *pq.Notification) {
+	if notification == nil {
+		w.wakeAll()
+		return
+	}
+	db, digest, err := repositories.DecodeKeyReadyPayload(notification.Extra)
+	if err != nil {
+		log.Println("Error decoding notification payload: ", err)
+		return
+	}
+	w.wake(db, digest)
+}
+
+// send a value to wakeup without blocking. If there's already a value waiting, there's no need to
+// send another.
+func notify(wakeup chan struct{}) {
+	select {
+	case wakeup <- struct{}{}:
+	default:
+	}
+}
@@ -1,15 +1,24 @@
 package pgredis
 
 import (
-	"bufio"
+	"context"
+	"crypto/tls"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/yob/pgredis/internal/migrations"
 	"github.com/yob/pgredis/internal/repositories"
 
 	_ "github.com/lib/pq"
@@ -18,126 +27,235 @@ import (
 
 const (
 	MAX_COMMAND_QUEUE_SIZE = 100
+
+	// the number of logical databases, like the databases setting in redis.conf
+	DATABASE_COUNT = 16
+
+	// the version of redis we claim to be, in INFO and HELLO. Clients use it to decide which
+	// commands they can send, so it's the newest version we have the commands of (WAITAOF is 7.2).
+	REDIS_VERSION = "7.2.0"
+
+	// the schema is part of the notification channel names, which postgres limits to 63 bytes
+	MAX_SCHEMA_LENGTH = 40
 )
 
 type PgRedis struct {
-	commands   map[string]redisCommand
-	hashes     *repositories.HashRepository
-	keys       *repositories.KeyRepository
-	strings    *repositories.StringRepository
-	lists      *repositories.ListRepository
-	sets       *repositories.SetRepository
-	sortedsets *repositories.SortedSetRepository
-	connCount  uint64
-	db         *sql.DB
+	commands    map[string]*commandDefinition
+	blocked     *repositories.BlockedClientRepository
+	hashes      *repositories.HashRepository
+	keys        *repositories.KeyRepository
+	strings     *repositories.StringRepository
+	lists       *repositories.ListRepository
+	pubsub      *repositories.PubSubRepository
+	sets        *repositories.SetRepository
+	sortedsets  *repositories.SortedSetRepository
+	users       *repositories.UserRepository
+	userCache   *aclUserCache
+	aclLog      *aclLog
+	connCount   uint64
+	db          *sql.DB
+	listener    *notificationListener
+	waiters     *keyWaiters
+	subscribers *pubsubHub
+	connections *connectionTracker
+
+	// a slot for each connection that can be pinned to a client
+	sessionSlots chan struct{}
+
+	// hot standbys for read only commands, or nil if there aren't any
+	replicas *replicaSet
+
+	// the version of the primary, like 90624 or 120004
+	serverVersion int
+
+	// the parameters for CONFIG GET and CONFIG SET
+	config *serverConfig
+
+	// closed when the server starts shutting down
+	shuttingDown chan struct{}
+	shutdownOnce sync.Once
+}
+
+// The databases pgredis stores its data in. Up to PinnedSessions clients get a connection of their
+// own, and the rest share what's left of the MaxConnections pool.
+//
+// Read only commands can also be sent to the hot standbys in ReplicaURLs, while they're no more
+// than ReplicaMaxLag behind the primary. Each standby gets a pool of MaxConnections.
+type DatabaseOptions struct {
+	URL            string
+	MaxConnections int
+	PinnedSessions int
+
+	// The postgres schema for pgredis's tables, so several pgredis keyspaces can share a
+	// database. It's created if it doesn't exist. Empty uses the database's default search_path.
+	Schema string
+
+	ReplicaURLs   []string
+	ReplicaMaxLag time.Duration
+
+	// always, everysec or no, see APPENDFSYNC_ALWAYS
+	Appendfsync string
+
+	// Pending schema migrations are applied on start, unless NoAutoMigrate is set. Then they have
+	// to be applied with `pgredis migrate up`, and pgredis refuses to start until they are.
+	NoAutoMigrate bool
+
+	// Expired keys are deleted in the background, up to ExpiryBatchSize every ExpiryInterval. An
+	// ExpiryInterval of 0 leaves them until a write to the same key.
+	ExpiryInterval  time.Duration
+	ExpiryBatchSize int
 }
 
-func NewPgRedis(connStr string, maxConnections int) *PgRedis {
+func NewPgRedis(options DatabaseOptions) *PgRedis {
+	connStr := options.URL
 	fmt.Println("Connecting to: ", connStr)
-	db, err := openDatabaseWithRetries(connStr, 3)
+	db, err := openDatabaseWithRetries(connStr, options.Schema, 3)
 
 	if err != nil {
 		panic(err)
 	}
 
-	db.SetMaxOpenConns(maxConnections)
+	db.SetMaxOpenConns(options.MaxConnections)
 
 	printDbStats(db)
 
-	err = setupSchema(db)
+	version, err := serverVersion(db)
+	if err != nil {
+		panic(err)
+	}
+
+	err = migrateSchema(db, options.Schema, options.NoAutoMigrate)
 	if err != nil {
 		panic(err)
 	}
 
 	redisproto.MaxNumArg = 1024
 
-	return &PgRedis{
-		hashes:     repositories.NewHashRepository(),
-		keys:       repositories.NewKeyRepository(),
-		strings:    repositories.NewStringRepository(),
-		lists:      repositories.NewListRepository(),
-		sets:       repositories.NewSetRepository(),
-		sortedsets: repositories.NewSortedSetRepository(),
-		connCount:  0,
-		db:         db,
-		commands: map[string]redisCommand{
-			"APPEND":           &appendCommand{},
-			"BITCOUNT":         &bitcountCommand{},
-			"BRPOP":            &brpopCommand{},
-			"CLIENT":           &clientCommand{},
-			"DBSIZE":           &dbsizeCommand{},
-			"DECR":             &decrCommand{},
-			"DEL":              &delCommand{},
-			"DECRBY":           &decrbyCommand{},
-			"ECHO":             &echoCommand{},
-			"EXISTS":           &existsCommand{},
-			"EXPIRE":           &expireCommand{},
-			"FLUSHALL":         &flushallCommand{},
-			"FLUSHDB":          &flushallCommand{},
-			"GET":              &getCommand{},
-			"GETBIT":           &getbitCommand{},
-			"GETRANGE":         &getrangeCommand{},
-			"GETSET":           &getsetCommand{},
-			"HGET":             &hgetCommand{},
-			"HGETALL":          &hgetallCommand{},
-			"HMGET":            &hmgetCommand{},
-			"HMSET":            &hmsetCommand{},
-			"HSET":             &hsetCommand{},
-			"INCR":             &incrCommand{},
-			"INFO":             &infoCommand{},
-			"INCRBY":           &incrbyCommand{},
-			"INCRBYFLOAT":      &incrbyfloatCommand{},
-			"LLEN":             &llenCommand{},
-			"LPOP":             &lpopCommand{},
-			"LPUSH":            &lpushCommand{},
-			"LRANGE":           &lrangeCommand{},
-			"LREM":             &lremCommand{},
-			"MGET":             &mgetCommand{},
-			"MSET":             &msetCommand{},
-			"PING":             &pingCommand{},
-			"PSETEX":           &psetexCommand{},
-			"PTTL":             &pttlCommand{},
-			"QUIT":             &quitCommand{},
-			"RPOP":             &rpopCommand{},
-			"RPUSH":            &rpushCommand{},
-			"SADD":             &saddCommand{},
-			"SCARD":            &scardCommand{},
-			"SSCAN":            &sscanCommand{},
-			"SELECT":           &selectCommand{},
-			"SET":              &setCommand{},
-			"SETEX":            &setexCommand{},
-			"SETNX":            &setnxCommand{},
-			"SMEMBERS":         &smembersCommand{},
-			"SREM":             &sremCommand{},
-			"STRLEN":           &strlenCommand{},
-			"TTL":              &ttlCommand{},
-			"TYPE":             &typeCommand{},
-			"ZADD":             &zaddCommand{},
-			"ZCARD":            &zcardCommand{},
-			"ZRANGE":           &zrangeCommand{},
-			"ZRANGEBYSCORE":    &zrangebyscoreCommand{},
-			"ZREVRANGE":        &zrevrangeCommand{},
-			"ZREM":             &zremCommand{},
-			"ZREMRANGEBYRANK":  &zremrangebyrankCommand{},
-			"ZREMRANGEBYSCORE": &zremrangebyscoreCommand{},
-		},
+	listener := newNotificationListener(connStr)
+	waiters := newKeyWaiters()
+	prefix := channelPrefix(options.Schema)
+	err = listener.listen(prefix+repositories.KeyReadyChannel, waiters.handleNotification)
+	if err != nil {
+		panic(err)
 	}
+	pubsub := repositories.NewPubSubRepository()
+	subscribers := newPubsubHub(db, pubsub)
+	err = listener.listen(prefix+repositories.PubSubChannel, subscribers.handleNotification)
+	if err != nil {
+		panic(err)
+	}
+	userCache := newAclUserCache()
+	err = listener.listen(prefix+repositories.UserChangedChannel, userCache.handleNotification)
+	if err != nil {
+		panic(err)
+	}
+	keyspaceEvents := repositories.NewKeyspaceEvents()
+	config := newServerConfig(options.Appendfsync, db, keyspaceEvents)
+	err = config.load(db)
+	if err != nil {
+		panic(err)
+	}
+	err = listener.listen(prefix+repositories.ConfigChangedChannel, config.handleNotification)
+	if err != nil {
+		panic(err)
+	}
+
+	var replicas *replicaSet
+	if len(options.ReplicaURLs) > 0 {
+		replicas, err = newReplicaSet(options.ReplicaURLs, options.Schema, options.MaxConnections, options.ReplicaMaxLag)
+		if err != nil {
+			panic(err)
+		}
+	}
+	shuttingDown := make(chan struct{})
+	if replicas != nil {
+		go replicas.monitor(shuttingDown)
+	}
+
+	redis := &PgRedis{
+		blocked:       repositories.NewBlockedClientRepository(),
+		hashes:        repositories.NewHashRepository(keyspaceEvents),
+		keys:          repositories.NewKeyRepository(keyspaceEvents),
+		strings:       repositories.NewStringRepository(keyspaceEvents),
+		lists:         repositories.NewListRepository(keyspaceEvents),
+		pubsub:        pubsub,
+		sets:          repositories.NewSetRepository(keyspaceEvents),
+		sortedsets:    repositories.NewSortedSetRepository(keyspaceEvents),
+		users:         repositories.NewUserRepository(),
+		userCache:     userCache,
+		aclLog:        newAclLog(),
+		connCount:     0,
+		db:            db,
+		listener:      listener,
+		waiters:       waiters,
+		subscribers:   subscribers,
+		connections:   newConnectionTracker(),
+		shuttingDown:  shuttingDown,
+		sessionSlots:  make(chan struct{}, options.PinnedSessions),
+		replicas:      replicas,
+		serverVersion: version,
+		config:        config,
+		commands:      newCommandTable(),
+	}
+
+	if options.ExpiryInterval > 0 && options.ExpiryBatchSize > 0 {
+		go newExpiryReaper(redis, options.ExpiryInterval, options.ExpiryBatchSize).run(shuttingDown)
+	}
+
+	return redis
+}
+
+// Bring the schema up to date, or with noAutoMigrate, check that it is
+func migrateSchema(db *sql.DB, schema string, noAutoMigrate bool) error {
+	if noAutoMigrate {
+		pending, err := migrations.Pending(db)
+		if err != nil {
+			return err
+		}
+		if len(pending) > 0 {
+			return fmt.Errorf("the database schema is out of date, with %d pending migrations. Apply them with `pgredis migrate up`", len(pending))
+		}
+		return nil
+	}
+
+	applied, err := migrations.Up(db, schema)
+	for _, migration := range applied {
+		log.Printf("Applied migration %d: %s", migration.Version, migration.Description)
+	}
+	return err
+}
+
+// The version of a postgres server, as a number like 90624 or 120004
+func serverVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow("SELECT current_setting('server_version_num')::integer").Scan(&version)
+	return version, err
 }
 
-func openDatabaseWithRetries(connStr string, retries int) (*sql.DB, error) {
+// Open the database, with its tables in schema. An empty schema uses the database's default
+// search_path, which is usually public.
+func OpenDatabase(connStr string, schema string) (*sql.DB, error) {
+	return openDatabaseWithRetries(connStr, schema, 0)
+}
+
+func openDatabaseWithRetries(connStr string, schema string, retries int) (*sql.DB, error) {
+	if len(schema) > MAX_SCHEMA_LENGTH {
+		return nil, fmt.Errorf("the schema name can't be longer than %d bytes", MAX_SCHEMA_LENGTH)
+	}
 
-	db, err := sql.Open("postgres", connStr)
+	connector, err := newTimeoutConnector(connStr, schema)
 
 	if err != nil {
 		return nil, err
 	}
+	db := sql.OpenDB(connector)
 
 	err = db.Ping()
 	if err != nil {
 		if retries > 0 {
 			time.Sleep(3 * time.Second)
 
-			return openDatabaseWithRetries(connStr, retries-1)
+			return openDatabaseWithRetries(connStr, schema, retries-1)
 		} else {
 			return nil, err
 		}
@@ -145,245 +263,630 @@ func openDatabaseWithRetries(connStr string, retries int) (*sql.DB, error) {
 	return db, nil
 }
 
-func (redis *PgRedis) StartServer(bindAddress string, port int) error {
-	listener, err := net.Listen("tcp", net.JoinHostPort(bindAddress, strconv.Itoa(port)))
-	if err != nil {
-		panic(err)
+// Where the server listens for connections. Like redis.conf, a port of 0 disables that listener,
+// so the server can listen for plain connections, TLS connections or both. It can also listen on a
+// unix socket, with or without the TCP listeners.
+//
+// TLSAuthClients is yes, optional or no, and decides whether clients must present a certificate
+// signed by one of the CAs in TLSCACertFile.
+type ServerOptions struct {
+	BindAddress string
+	Port        int
+
+	TLSPort        int
+	TLSCertFile    string
+	TLSKeyFile     string
+	TLSCACertFile  string
+	TLSAuthClients string
+
+	UnixSocket     string
+	UnixSocketPerm os.FileMode
+
+	// how long requests that are running when we shut down have to finish
+	ShutdownTimeout time.Duration
+}
+
+// Listen for connections, and serve them until one of the listeners fails or the server is shut
+// down, either by SIGTERM, SIGINT or the SHUTDOWN command.
+func (redis *PgRedis) StartServer(options ServerOptions) error {
+	listeners := []net.Listener{}
+
+	if options.Port != 0 {
+		listener, err := net.Listen("tcp", net.JoinHostPort(options.BindAddress, strconv.Itoa(options.Port)))
+		if err != nil {
+			return err
+		}
+		log.Print(fmt.Sprintf("pgredis started on %s:%d", options.BindAddress, options.Port))
+		listeners = append(listeners, listener)
 	}
-	log.Print(fmt.Sprintf("pgredis started on %s:%d", bindAddress, port))
-	for {
-		conn, err := listener.Accept()
+
+	if options.TLSPort != 0 {
+		certificates, err := newTLSCertificates(options)
 		if err != nil {
-			log.Println("Error on accept: ", err)
-			continue
+			return err
+		}
+		certificates.reloadOnSighup()
+		listener, err := tls.Listen("tcp", net.JoinHostPort(options.BindAddress, strconv.Itoa(options.TLSPort)), certificates.config())
+		if err != nil {
+			return err
 		}
-		atomic.AddUint64(&redis.connCount, 1)
-		go redis.handleConnection(conn)
+		log.Print(fmt.Sprintf("pgredis started with TLS on %s:%d", options.BindAddress, options.TLSPort))
+		listeners = append(listeners, listener)
 	}
-}
 
-func setupSchema(db *sql.DB) error {
-	_, err := db.Query("create table if not exists redisdata (key bytea PRIMARY KEY, type bytea not null, value bytea not null, expires_at timestamp with time zone NULL)")
-	if err != nil {
-		return err
+	if options.UnixSocket != "" {
+		listener, err := listenUnix(options.UnixSocket, options.UnixSocketPerm)
+		if err != nil {
+			return err
+		}
+		log.Print(fmt.Sprintf("pgredis started on %s", options.UnixSocket))
+		listeners = append(listeners, listener)
 	}
 
-	_, err = db.Query("create table if not exists redislists (key bytea, idx integer, value bytea not null, PRIMARY KEY(key, idx), FOREIGN KEY (key) REFERENCES redisdata (key) ON DELETE CASCADE);")
-	if err != nil {
-		return err
+	if len(listeners) == 0 {
+		return errors.New("nothing to listen on, set a port, a TLS port or a unix socket")
 	}
 
-	_, err = db.Query("create table if not exists redissets (key bytea, value bytea not null, PRIMARY KEY(key, value), FOREIGN KEY (key) REFERENCES redisdata (key) ON DELETE CASCADE);")
-	if err != nil {
-		return err
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			errs <- redis.acceptConnections(listener)
+		}(listener)
 	}
 
-	_, err = db.Query("create table if not exists rediszsets (key bytea, value bytea not null, score decimal not null, PRIMARY KEY(key, value), FOREIGN KEY (key) REFERENCES redisdata (key) ON DELETE CASCADE);")
-	if err != nil {
+	select {
+	case err := <-errs:
 		return err
+	case sig := <-signals:
+		log.Printf("Received %s, shutting down", sig)
+		redis.Shutdown()
+	case <-redis.shuttingDown:
+		log.Println("SHUTDOWN received, shutting down")
 	}
+	return redis.drain(listeners, options.ShutdownTimeout)
+}
 
-	_, err = db.Query("create table if not exists redishashes (key bytea, field bytea not null, value bytea not null, PRIMARY KEY(key, field), FOREIGN KEY (key) REFERENCES redisdata (key) ON DELETE CASCADE);")
+// Listen on a unix socket. A socket file left behind by a server that didn't shut down cleanly is
+// removed, but not one that a running server is still listening on.
+func listenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	info, err := os.Lstat(path)
+	if err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a unix socket", path)
+		}
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("another server is already listening on %s", path)
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	if perm != 0 {
+		err = os.Chmod(path, perm)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
 
-	return nil
+func (redis *PgRedis) acceptConnections(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil && redis.isShuttingDown() {
+			return nil
+		} else if err != nil {
+			log.Println("Error on accept: ", err)
+			continue
+		}
+		id := atomic.AddUint64(&redis.connCount, 1)
+		go redis.handleConnection(conn, id)
+	}
 }
 
 func (redis *PgRedis) selectCmd(cmdString string) redisCommand {
-	implementation := redis.commands[cmdString]
-	if implementation == nil {
-		implementation = &unrecognisedCommand{}
+	definition := redis.commands[cmdString]
+	if definition == nil || definition.implementation == nil {
+		return &unrecognisedCommand{}
 	}
-	return implementation
+	return definition.implementation
 }
 
-func (redis *PgRedis) handleConnection(conn net.Conn) {
-	defer conn.Close()
-	parser := redisproto.NewParser(conn)
-	buffer := bufio.NewWriter(conn)
-	writer := redisproto.NewWriter(buffer)
-	var requestQueue = []redisRequest{}
+func (redis *PgRedis) handleConnection(conn net.Conn, id uint64) {
+	client := newRedisClient(conn, id)
+	if !redis.connections.add(client) {
+		conn.Close()
+		return
+	}
+	defer redis.connections.remove(client)
+	defer redis.closeClient(client)
+	redis.authenticateAsDefault(client)
+	parser := redisproto.NewParser(client.conn)
+
+	// pipelined commands that are waiting to run as a batch, see executePipeline
+	pipeline := []redisRequest{}
 	for {
 		command, err := parser.ReadCommand()
 		if err != nil {
 			_, ok := err.(*redisproto.ProtocolError)
 			if ok {
-				writer.WriteError(err.Error())
+				client.writeMutex.Lock()
+				// the commands before the bad one get their replies first
+				redis.executePipeline(client, pipeline)
+				pipeline = pipeline[:0]
+				client.writer.WriteError(err.Error())
+				client.writer.Flush()
+				client.writeMutex.Unlock()
+				continue
 			} else {
 				log.Println(err, " closed connection to ", conn.RemoteAddr())
 				break
 			}
 		}
-		requestQueue = append(requestQueue, newRequestFromRedisProto(command))
 
-		lastRequest := requestQueue[len(requestQueue)-1]
-		lastRequestCmd := lastRequest.CommandString()
-		firstRequest := requestQueue[0]
-		firstRequestCmd := firstRequest.CommandString()
+		if !redis.connections.startRequest(client) {
+			// the server is draining. Requests already in the batch were accepted before it started,
+			// so they still run and get their replies.
+			if len(pipeline) > 0 {
+				client.writeMutex.Lock()
+				if redis.executePipeline(client, pipeline) {
+					client.writer.Flush()
+				}
+				client.writeMutex.Unlock()
+			}
+			break
+		}
+		request := newRequestFromRedisProto(command)
+		client.writeMutex.Lock()
+		ok := true
+		if redis.canBatch(client, &request) {
+			pipeline = append(pipeline, request)
+		} else {
+			ok = redis.executePipeline(client, pipeline) && redis.handleRequest(client, request)
+			pipeline = pipeline[:0]
+		}
 
-		if len(requestQueue) > MAX_COMMAND_QUEUE_SIZE {
-			writer.WriteError(fmt.Sprintf("Max command queue size (%d) exceeded", MAX_COMMAND_QUEUE_SIZE))
-			writer.Flush()
-			requestQueue = []redisRequest{}
-		} else if lastRequestCmd == "DISCARD" {
-			writer.WriteSimpleString("OK")
-			writer.Flush()
-			requestQueue = []redisRequest{}
-		} else if len(requestQueue) == 1 && lastRequestCmd == "MULTI" {
+		// the batch runs once we've read every command the client has sent so far
+		if ok && len(pipeline) > 0 && (request.IsLast() || len(pipeline) >= MAX_PIPELINE_BATCH_SIZE || redis.isShuttingDown()) {
+			ok = redis.executePipeline(client, pipeline)
+			pipeline = pipeline[:0]
+		}
+		if ok && len(pipeline) == 0 {
+			// failing to write to the client is the only error that closes the connection
+			ok = client.writer.Flush() == nil
+		}
+		client.writeMutex.Unlock()
+
+		// a client with requests waiting in the batch stays busy, so draining doesn't close its
+		// connection before they've run
+		if len(pipeline) > 0 {
+			continue
+		}
+
+		// once the server is shutting down, each connection is closed after its current request
+		if !redis.connections.finishRequest(client) || !ok {
+			break
+		}
+	}
+}
+
+func (redis *PgRedis) closeClient(client *redisClient) {
+	redis.subscribers.unsubscribeAll(client)
+	client.stopDelivery()
+	redis.releaseSession(client)
+
+	// ensure everything is written to the socket before we close it
+	client.writeMutex.Lock()
+	client.buffer.Flush()
+	client.writeMutex.Unlock()
+	client.conn.Close()
+}
+
+// Handle a single request from a client, buffering the reply. Returns false if the connection
+// should be closed, which should only happen when we can't talk to the client any more or the
+// server is shutting down.
+func (redis *PgRedis) handleRequest(client *redisClient, request redisRequest) bool {
+	writer := client.writer
+	requestCmd := request.CommandString()
+
+	if client.inPubsubMode() && !isAllowedWhileSubscribed(requestCmd) {
+		writer.WriteError(fmt.Sprintf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", strings.ToLower(requestCmd)))
+	} else if errMessage := redis.checkPermissions(client, &request); errMessage != "" {
+		// like any other error before EXEC, a denied command means the transaction won't run
+		if client.inMulti {
+			client.multiError = true
+		}
+		writer.WriteError(errMessage)
+	} else if client.inPubsubMode() && requestCmd == "PING" {
+		writeSubscribedPingReply(client, request)
+	} else if requestCmd == "MULTI" {
+		if client.inMulti {
+			// this doesn't abort the transaction, the MULTI is just ignored
+			writer.WriteError("ERR MULTI calls can not be nested")
+		} else {
+			client.inMulti = true
 			writer.WriteSimpleString("OK")
-			writer.Flush()
-		} else if lastRequestCmd == "EXEC" && firstRequestCmd != "MULTI" {
-			writer.WriteError("EXEC without MULTI")
-			writer.Flush()
-			requestQueue = []redisRequest{}
-		} else if len(requestQueue) == 1 {
-			ok := redis.executeSingleCommand(requestQueue[0], buffer)
-			writer.Flush()
-			requestQueue = []redisRequest{}
-			if !ok {
-				break
-			}
-		} else if len(requestQueue) > 1 && firstRequestCmd == "MULTI" && lastRequestCmd != "EXEC" {
-			writer.WriteSimpleString("QUEUED")
-			writer.Flush()
-		} else if len(requestQueue) > 1 && firstRequestCmd == "MULTI" && lastRequestCmd == "EXEC" {
-			ok := redis.executeMultiCommand(requestQueue[1:len(requestQueue)-1], buffer)
-			writer.Flush()
-			requestQueue = []redisRequest{}
+		}
+	} else if requestCmd == "EXEC" {
+		if !client.inMulti {
+			writer.WriteError("ERR EXEC without MULTI")
+		} else if client.multiError {
+			writer.WriteError("EXECABORT Transaction discarded because of previous errors.")
+		} else {
+			ok := redis.executeMultiCommand(client)
 			if !ok {
-				break
+				return false
 			}
+		}
+		client.resetMulti()
+		client.unwatchAll()
+	} else if requestCmd == "DISCARD" {
+		if !client.inMulti {
+			writer.WriteError("ERR DISCARD without MULTI")
+		} else {
+			client.resetMulti()
+			client.unwatchAll()
+			writer.WriteSimpleString("OK")
+		}
+	} else if requestCmd == "WATCH" {
+		if client.inMulti {
+			writer.WriteError("ERR WATCH inside MULTI is not allowed")
+		} else if errMessage := redis.validateRequest(&request); errMessage != "" {
+			writer.WriteError(errMessage)
 		} else {
-			writer.WriteError("Unrecognised command sequence")
-			requestQueue = []redisRequest{}
+			redis.watchKeys(client, request.Args()[1:])
 		}
+	} else if !client.inMulti && requestCmd == "UNWATCH" {
+		client.unwatchAll()
+		writer.WriteSimpleString("OK")
+	} else if !client.inMulti && isSubscriptionCommand(requestCmd) {
+		if errMessage := redis.validateRequest(&request); errMessage != "" {
+			writer.WriteError(errMessage)
+		} else {
+			redis.executeSubscriptionCommand(client, request)
+		}
+	} else if !client.inMulti && requestCmd == "SHUTDOWN" {
+		// like redis, there's no reply when the shutdown starts. The connection is closed instead.
+		if errMessage := redis.validateRequest(&request); errMessage != "" {
+			writer.WriteError(errMessage)
+		} else if err := validateShutdownRequest(&request); err != nil {
+			client.reply(newPgRedisErrorFromError(err))
+		} else {
+			redis.Shutdown()
+			return false
+		}
+	} else if !client.inMulti && (requestCmd == "WAIT" || requestCmd == "WAITAOF") {
+		if errMessage := redis.validateRequest(&request); errMessage != "" {
+			writer.WriteError(errMessage)
+		} else {
+			return redis.executeWaitCommand(client, request)
+		}
+	} else if client.inMulti {
+		redis.queueRequest(client, request)
+	} else if errMessage := redis.validateRequest(&request); errMessage != "" {
+		writer.WriteError(errMessage)
+	} else {
+		return redis.executeSingleCommand(client, request)
 	}
-	// ensure everything is written to the socket before we close it
-	buffer.Flush()
+	return true
 }
 
-func (redis *PgRedis) executeSingleCommand(request redisRequest, buffer *bufio.Writer) bool {
-	// start a db transaction
-	tx, txerr := redis.db.Begin()
-	if txerr != nil {
-		newPgRedisError(txerr.Error()).writeTo(buffer)
-		return false
+// Queue a request sent between MULTI and EXEC. Like redis, any problem we can detect before the
+// transaction runs (an unknown command or the wrong number of arguments) flags the transaction,
+// and EXEC will refuse to run it.
+func (redis *PgRedis) queueRequest(client *redisClient, request redisRequest) {
+	writer := client.writer
+	errMessage := redis.validateRequest(&request)
+	definition := redis.commands[request.CommandString()]
+	if isSubscriptionCommand(request.CommandString()) || (definition != nil && definition.hasFlag("no_multi")) {
+		errMessage = "ERR Command not allowed inside a transaction"
 	}
-	defer tx.Rollback()
 
-	_, err := tx.Exec("SET statement_timeout = 5000")
+	if errMessage != "" {
+		client.multiError = true
+		writer.WriteError(errMessage)
+	} else if len(client.multiQueue) >= MAX_COMMAND_QUEUE_SIZE {
+		client.multiError = true
+		writer.WriteError(fmt.Sprintf("ERR max command queue size (%d) exceeded", MAX_COMMAND_QUEUE_SIZE))
+	} else {
+		client.multiQueue = append(client.multiQueue, request)
+		writer.WriteSimpleString("QUEUED")
+	}
+}
+
+// Record the current version of each key, so EXEC can tell if any of them changed before the
+// transaction runs. Watching a key that's already watched keeps the original version.
+func (redis *PgRedis) watchKeys(client *redisClient, keys []string) {
+	tx := redis.autocommit(client)
+	for _, key := range keys {
+		watchedKey := dbKey{db: client.db, key: key}
+		if _, ok := client.watched[watchedKey]; ok {
+			continue
+		}
+		version, err := redis.keys.Version(tx, client.db, []byte(key))
+		if err != nil {
+			client.reply(newPgRedisErrorFromError(err))
+			return
+		}
+		if len(client.watched) == 0 {
+			client.watchedAt = time.Now()
+		}
+		client.watched[watchedKey] = version
+	}
+	client.reply(newPgRedisString("OK"))
+}
+
+// Start a db transaction. It runs on the client's pinned session if it has one (or can get one),
+// and otherwise on a connection from the pool. client can be nil for work that isn't on behalf
+// of a client.
+//
+// With appendfsync set to everysec or no, the transaction commits without waiting for the WAL to
+// be flushed.
+func (redis *PgRedis) begin(client *redisClient) (transaction, error) {
+	if client != nil {
+		client.afterCommit = nil
+	}
+	synchronousCommit := redis.synchronousCommit(client)
+	if session := redis.clientSession(client); session != nil {
+		tx, err := session.begin(synchronousCommit)
+		if err == nil {
+			return tx, nil
+		}
+		// the connection has probably been lost, so let it go and use the pool this time
+		log.Println("Error starting transaction on database session: ", err)
+		redis.releaseSession(client)
+	}
+
+	tx, err := redis.db.Begin()
+	if err != nil || synchronousCommit {
+		return tx, err
+	}
+	_, err = tx.Exec(ASYNC_COMMIT)
 	if err != nil {
-		newPgRedisError("Error setting statement timeout").writeTo(buffer)
-		return false
+		tx.Rollback()
+		return nil, err
+	}
+	return tx, nil
+}
+
+// Start a read only transaction for a read only command. They don't need to lock their keys,
+// and the transaction only makes sure each statement sees the same snapshot (see READ_ONLY_BEGIN).
+// Clients read from a replica unless they've sent READWRITE, so they can see their own writes
+// straight away.
+func (redis *PgRedis) beginRead(client *redisClient) (transaction, error) {
+	if client.readFromReplicas {
+		if db := redis.replicas.pick(); db != nil {
+			return db.BeginTx(context.Background(), readOnlyTxOptions)
+		}
+	}
+	if session := redis.clientSession(client); session != nil {
+		tx, err := session.beginReadOnly()
+		if err == nil {
+			return tx, nil
+		}
+		log.Println("Error starting transaction on database session: ", err)
+		redis.releaseSession(client)
+	}
+	return redis.db.BeginTx(context.Background(), readOnlyTxOptions)
+}
+
+// A single statement doesn't need a transaction. It runs on its own and sees the latest committed
+// data, the same as it would in a transaction at READ COMMITTED, and we save the round trips for
+// BEGIN and COMMIT.
+func (redis *PgRedis) autocommit(client *redisClient) repositories.Querier {
+	if session := redis.clientSession(client); session != nil {
+		return session
 	}
-	_, err = tx.Exec("SET lock_timeout = 5000")
+	return redis.db
+}
+
+func (redis *PgRedis) isReadOnly(request *redisRequest) bool {
+	definition := redis.commands[request.CommandString()]
+	return definition != nil && definition.hasFlag("readonly")
+}
+
+func (redis *PgRedis) executeReadOnlyCommand(client *redisClient, request redisRequest) bool {
+	tx, err := redis.beginRead(client)
+	if err != nil {
+		client.reply(newPgRedisErrorFromError(err))
+		return true
+	}
+	// there's nothing to commit, so the transaction is always rolled back
+	defer tx.Rollback()
+
+	result, err := redis.selectCmd(request.CommandString()).Execute(&request, redis, client, tx)
 	if err != nil {
-		newPgRedisError("Error setting lock timeout").writeTo(buffer)
+		result = newPgRedisErrorFromError(err)
+	}
+
+	ew := client.reply(result)
+	if ew != nil {
+		log.Println("Error during command execution, connection closed", ew)
 		return false
 	}
+	return true
+}
 
+func (redis *PgRedis) executeSingleCommand(client *redisClient, request redisRequest) bool {
 	cmdObject := redis.selectCmd(request.CommandString())
 
-	keysToLock := cmdObject.keysToLock(&request)
-	err = redis.keys.LockKeys(tx, keysToLock)
+	blockingCmd, ok := cmdObject.(blockingRedisCommand)
+	if ok {
+		return redis.executeBlockingCommand(blockingCmd, client, request)
+	}
+
+	if redis.isReadOnly(&request) {
+		return redis.executeReadOnlyCommand(client, request)
+	}
+
+	tx, err := redis.begin(client)
 	if err != nil {
-		newPgRedisError("Error locking keys").writeTo(buffer)
-		return false
+		client.reply(newPgRedisErrorFromError(err))
+		return true
 	}
+	defer tx.Rollback()
 
-	result, err := cmdObject.Execute(&request, redis, tx)
+	err = redis.keys.LockKeys(tx, client.db, redis.keysToLock(&request))
 	if err != nil {
-		newPgRedisError(err.Error()).writeTo(buffer)
-		return false
+		client.reply(newPgRedisErrorFromError(err))
+		return true
 	}
 
-	ew := result.writeTo(buffer)
+	result, err := cmdObject.Execute(&request, redis, client, tx)
+	if err != nil {
+		client.reply(newPgRedisErrorFromError(err))
+		return true
+	}
+
+	// commit before replying, so the client never sees the result of a command that's rolled back
+	err = tx.Commit()
+	if err != nil {
+		client.reply(newPgRedisErrorFromError(err))
+		return true
+	}
+	client.committed()
+
+	ew := client.reply(result)
 	if ew != nil {
 		// this should be rare, there's no much that can go wrong when writing to an in memory buffer
-		newPgRedisError(fmt.Sprintf("Error during command execution, connection closed: %s", ew)).writeTo(buffer)
+		client.reply(newPgRedisError(fmt.Sprintf("Error during command execution, connection closed: %s", ew)))
 
 		// we may not be able to write to the client, so also log on the server
 		log.Println("Error during command execution, connection closed", ew)
 		return false
 	}
 
-	buffer.Flush()
-
-	txerr = tx.Commit()
-	if txerr != nil {
-		newPgRedisError(txerr.Error()).writeTo(buffer)
-		return false
-	}
-
 	return true
 }
 
-func (redis *PgRedis) executeMultiCommand(requestQueue []redisRequest, buffer *bufio.Writer) bool {
+func (redis *PgRedis) executeMultiCommand(client *redisClient) bool {
 	log.Println("execute single command")
 
-	// start a db transaction
-	tx, txerr := redis.db.Begin()
-	if txerr != nil {
-		newPgRedisError(txerr.Error()).writeTo(buffer)
-		return false
+	tx, err := redis.begin(client)
+	if err != nil {
+		client.reply(newPgRedisErrorFromError(err))
+		return true
 	}
 	defer tx.Rollback()
 
-	_, err := tx.Exec("SET statement_timeout = 5000")
-	if err != nil {
-		newPgRedisError("Error setting statement timeout").writeTo(buffer)
-		return false
+	// a SELECT in the transaction changes the database of the commands after it
+	keysToLock := map[int][]string{}
+	db := client.db
+	for _, nextRequest := range client.multiQueue {
+		keysToLock[db] = append(keysToLock[db], redis.keysToLock(&nextRequest)...)
+		if nextRequest.CommandString() == "SELECT" {
+			if index, err := parseDbIndex(nextRequest.Get(1)); err == nil {
+				db = index
+			}
+		}
+	}
+	for watchedKey := range client.watched {
+		keysToLock[watchedKey.db] = append(keysToLock[watchedKey.db], watchedKey.key)
 	}
-	_, err = tx.Exec("SET lock_timeout = 5000")
+	err = redis.lockKeysInDbs(tx, keysToLock)
 	if err != nil {
-		newPgRedisError("Error setting lock timeout").writeTo(buffer)
-		return false
+		client.reply(newPgRedisErrorFromError(err))
+		return true
 	}
 
-	keysToLock := []string{}
-	for _, nextRequest := range requestQueue {
-		cmdObject := redis.selectCmd(nextRequest.CommandString())
-		keysToLock = append(keysToLock, cmdObject.keysToLock(&nextRequest)...)
+	// if any watched keys have changed since WATCH, the transaction is aborted. The versions of
+	// deleted keys are forgotten eventually, so we can't tell if keys watched before then changed.
+	if len(client.watched) > 0 && time.Since(client.watchedAt) > repositories.DeletedKeyLifetime {
+		client.reply(newPgRedisNilArray())
+		return true
 	}
-	err = redis.keys.LockKeys(tx, keysToLock)
-	if err != nil {
-		newPgRedisError("Error locking keys").writeTo(buffer)
-		return false
+	for watchedKey, watchedVersion := range client.watched {
+		version, err := redis.keys.Version(tx, watchedKey.db, []byte(watchedKey.key))
+		if err != nil {
+			client.reply(newPgRedisErrorFromError(err))
+			return true
+		}
+		if version != watchedVersion {
+			client.reply(newPgRedisNilArray())
+			return true
+		}
 	}
 
+	// Like redis, a command that fails doesn't stop the rest of the transaction from running, and
+	// its error is returned in place of its result. Each command runs in a savepoint so a failure
+	// can be undone without aborting the postgres transaction.
 	multiResponses := []pgRedisValue{}
-	for _, nextRequest := range requestQueue {
+	for _, nextRequest := range client.multiQueue {
+		_, err = tx.Exec("SAVEPOINT multi_command")
+		if err != nil {
+			client.reply(newPgRedisErrorFromError(err))
+			return true
+		}
+
 		cmdObject := redis.selectCmd(nextRequest.CommandString())
-		result, err := cmdObject.Execute(&nextRequest, redis, tx)
+		result, err := cmdObject.Execute(&nextRequest, redis, client, tx)
 		if err != nil {
-			newPgRedisError(err.Error()).writeTo(buffer)
-			return false
+			_, rollbackErr := tx.Exec("ROLLBACK TO SAVEPOINT multi_command")
+			if rollbackErr != nil {
+				client.reply(newPgRedisErrorFromError(rollbackErr))
+				return true
+			}
+			result = newPgRedisErrorFromError(err)
 		}
 		multiResponses = append(multiResponses, result)
 
-		buffer.Flush()
+		_, err = tx.Exec("RELEASE SAVEPOINT multi_command")
+		if err != nil {
+			client.reply(newPgRedisErrorFromError(err))
+			return true
+		}
 	}
 
+	err = tx.Commit()
+	if err != nil {
+		client.reply(newPgRedisErrorFromError(err))
+		return true
+	}
+	client.committed()
+
 	// a multi command was executed
 	redisArray := newPgRedisArray(multiResponses)
-	err = redisArray.writeTo(buffer)
+	err = client.reply(redisArray)
 	if err != nil {
-		newPgRedisError(fmt.Sprintf("Error during command execution, connection closed: %s", err)).writeTo(buffer)
+		client.reply(newPgRedisError(fmt.Sprintf("Error during command execution, connection closed: %s", err)))
 
 		// we may not be able to write to the client, so also log on the server
 		log.Println("Error during command execution, connection closed", err)
 		return false
 	}
 
-	txerr = tx.Commit()
-	if txerr != nil {
-		newPgRedisError(txerr.Error()).writeTo(buffer)
-		return false
+	return true
+}
+
+// Lock keys in more than one database. Like LockKeys, the locks are taken in a consistent order
+// (by database, then by key) to avoid deadlocks.
+func (redis *PgRedis) lockKeysInDbs(tx repositories.Querier, keysByDb map[int][]string) error {
+	dbs := make([]int, 0, len(keysByDb))
+	for db := range keysByDb {
+		dbs = append(dbs, db)
 	}
+	sort.Ints(dbs)
 
-	return true
+	for _, db := range dbs {
+		err := redis.keys.LockKeys(tx, db, keysByDb[db])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func printDbStats(db *sql.DB) {
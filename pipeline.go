@@ -0,0 +1,153 @@
+package pgredis
+
+import (
+	"log"
+
+	"github.com/yob/pgredis/internal/repositories"
+)
+
+// the most pipelined commands we'll run in a single transaction
+const MAX_PIPELINE_BATCH_SIZE = 100
+
+// Clients often pipeline commands, sending many of them without waiting for the replies. Rather
+// than give each one its own transaction, consecutive pipelined commands are gathered into a
+// batch that runs in a single transaction.
+//
+// Only commands that read or write keys are batched. Commands that change the state of the
+// connection (SELECT, AUTH, MULTI, etc) or block run on their own, after the batch before them.
+func (redis *PgRedis) canBatch(client *redisClient, request *redisRequest) bool {
+	if client.inMulti || client.inPubsubMode() {
+		return false
+	}
+	definition := redis.commands[request.CommandString()]
+	if definition == nil || definition.implementation == nil {
+		return false
+	}
+	if _, blocking := definition.implementation.(blockingRedisCommand); blocking {
+		return false
+	}
+	if !definition.hasFlag("write") && !definition.hasFlag("readonly") {
+		return false
+	}
+	return redis.validateRequest(request) == ""
+}
+
+// Run a batch of pipelined commands and buffer their replies, in order. Each command runs in a
+// savepoint, so one that fails doesn't affect the others, and like a single command the replies
+// aren't sent until the transaction commits. Returns false if the connection should be closed.
+func (redis *PgRedis) executePipeline(client *redisClient, requests []redisRequest) bool {
+	switch len(requests) {
+	case 0:
+		return true
+	case 1:
+		return redis.handleRequest(client, requests[0])
+	}
+
+	// permissions are checked up front, so denied commands are only logged once
+	denied := make([]string, len(requests))
+	keysToLock := []string{}
+	readOnly := true
+	for idx := range requests {
+		denied[idx] = redis.checkPermissions(client, &requests[idx])
+		if denied[idx] == "" {
+			keysToLock = append(keysToLock, redis.keysToLock(&requests[idx])...)
+		}
+		readOnly = readOnly && redis.isReadOnly(&requests[idx])
+	}
+
+	// a batch of read only commands shares a read only transaction, and sees the same snapshot
+	if readOnly {
+		tx, err := redis.beginRead(client)
+		if err != nil {
+			return redis.replyToBatch(client, len(requests), nil, err)
+		}
+		defer tx.Rollback()
+
+		results, err := redis.executeBatch(client, tx, requests, denied)
+		return redis.replyToBatch(client, len(requests), results, err)
+	}
+
+	tx, err := redis.begin(client)
+	if err != nil {
+		return redis.replyToBatch(client, len(requests), nil, err)
+	}
+	defer tx.Rollback()
+
+	err = redis.keys.LockKeys(tx, client.db, keysToLock)
+	if err != nil {
+		// we couldn't lock every key in the batch (eg. one was locked for too long), so give each
+		// command a chance on its own
+		tx.Rollback()
+		return redis.executeEachCommand(client, requests, denied)
+	}
+
+	results, err := redis.executeBatch(client, tx, requests, denied)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err == nil {
+		client.committed()
+	}
+	return redis.replyToBatch(client, len(requests), results, err)
+}
+
+// Run each command in a batch on its own, skipping the ones that were denied
+func (redis *PgRedis) executeEachCommand(client *redisClient, requests []redisRequest, denied []string) bool {
+	for idx, request := range requests {
+		if denied[idx] != "" {
+			client.reply(newPgRedisError(denied[idx]))
+		} else if !redis.executeSingleCommand(client, request) {
+			return false
+		}
+	}
+	return true
+}
+
+// Buffer the replies to a batch. If the batch failed nothing was committed, so every command gets
+// the error.
+func (redis *PgRedis) replyToBatch(client *redisClient, count int, results []pgRedisValue, err error) bool {
+	if err != nil {
+		results = make([]pgRedisValue, count)
+		for idx := range results {
+			results[idx] = newPgRedisErrorFromError(err)
+		}
+	}
+	for _, result := range results {
+		ew := client.reply(result)
+		if ew != nil {
+			log.Println("Error during command execution, connection closed", ew)
+			return false
+		}
+	}
+	return true
+}
+
+// Run each command in a batch. Read only commands can't change anything, so the savepoint only
+// moves forward after a write.
+func (redis *PgRedis) executeBatch(client *redisClient, tx repositories.Querier, requests []redisRequest, denied []string) ([]pgRedisValue, error) {
+	_, err := tx.Exec("SAVEPOINT pipeline_command")
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]pgRedisValue, 0, len(requests))
+	for idx, request := range requests {
+		if denied[idx] != "" {
+			results = append(results, newPgRedisError(denied[idx]))
+			continue
+		}
+
+		result, err := redis.selectCmd(request.CommandString()).Execute(&request, redis, client, tx)
+		if err != nil {
+			result = newPgRedisErrorFromError(err)
+			_, err = tx.Exec("ROLLBACK TO SAVEPOINT pipeline_command")
+		} else if !redis.commands[request.CommandString()].hasFlag("readonly") {
+			_, err = tx.Exec("RELEASE SAVEPOINT pipeline_command; SAVEPOINT pipeline_command")
+		}
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
@@ -0,0 +1,267 @@
+package pgredis
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq"
+	"github.com/yob/pgredis/internal/repositories"
+)
+
+// the number of pubsub notifications that can be waiting to be delivered before we drop them
+const MAX_PUBSUB_QUEUE_SIZE = 10000
+
+// PUBLISH sends messages to every pgredis instance via postgres NOTIFY. Each instance receives them
+// on its dedicated LISTEN connection, and uses pubsubHub to find the local clients that should
+// receive them.
+//
+// Messages too big for a notification are read from db. Every notification is handled on the same
+// goroutine, so that read would hold up the others (and wait forever if the pool is exhausted by
+// clients waiting on a notification). Instead the payloads are queued, and delivered in order by a
+// goroutine of their own.
+type pubsubHub struct {
+	mutex    sync.Mutex
+	channels map[string]map[*redisClient]bool
+	patterns map[string]map[*redisClient]bool
+
+	db       repositories.Querier
+	pubsub   *repositories.PubSubRepository
+	payloads chan string
+}
+
+func newPubsubHub(db repositories.Querier, pubsub *repositories.PubSubRepository) *pubsubHub {
+	hub := &pubsubHub{
+		channels: map[string]map[*redisClient]bool{},
+		patterns: map[string]map[*redisClient]bool{},
+		db:       db,
+		pubsub:   pubsub,
+		payloads: make(chan string, MAX_PUBSUB_QUEUE_SIZE),
+	}
+	go hub.deliverPayloads()
+	return hub
+}
+
+func (hub *pubsubHub) subscribe(client *redisClient, channel string) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	if hub.channels[channel] == nil {
+		hub.channels[channel] = map[*redisClient]bool{}
+	}
+	hub.channels[channel][client] = true
+	client.channels[channel] = true
+}
+
+func (hub *pubsubHub) unsubscribe(client *redisClient, channel string) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	delete(hub.channels[channel], client)
+	if len(hub.channels[channel]) == 0 {
+		delete(hub.channels, channel)
+	}
+	delete(client.channels, channel)
+}
+
+func (hub *pubsubHub) psubscribe(client *redisClient, pattern string) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	if hub.patterns[pattern] == nil {
+		hub.patterns[pattern] = map[*redisClient]bool{}
+	}
+	hub.patterns[pattern][client] = true
+	client.patterns[pattern] = true
+}
+
+func (hub *pubsubHub) punsubscribe(client *redisClient, pattern string) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	delete(hub.patterns[pattern], client)
+	if len(hub.patterns[pattern]) == 0 {
+		delete(hub.patterns, pattern)
+	}
+	delete(client.patterns, pattern)
+}
+
+// Remove all subscriptions for a client, usually because it disconnected. Once this returns, no
+// more messages will be delivered to the client.
+func (hub *pubsubHub) unsubscribeAll(client *redisClient) {
+	for channel := range client.channels {
+		hub.unsubscribe(client, channel)
+	}
+	for pattern := range client.patterns {
+		hub.punsubscribe(client, pattern)
+	}
+}
+
+// The number of local clients that would receive a message published to channel
+func (hub *pubsubHub) receiverCount(channel string) int64 {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	count := int64(len(hub.channels[channel]))
+	for pattern, clients := range hub.patterns {
+		if globMatch(pattern, channel) {
+			count += int64(len(clients))
+		}
+	}
+	return count
+}
+
+// The channels with at least one local subscriber, optionally filtered by a glob pattern
+func (hub *pubsubHub) channelNames(pattern string) []string {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	result := []string{}
+	for channel := range hub.channels {
+		if pattern == "" || globMatch(pattern, channel) {
+			result = append(result, channel)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (hub *pubsubHub) subscriberCount(channel string) int64 {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	return int64(len(hub.channels[channel]))
+}
+
+func (hub *pubsubHub) patternCount() int64 {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	return int64(len(hub.patterns))
+}
+
+func (hub *pubsubHub) handleNotification(notification *pq.Notification) {
+	if notification == nil {
+		// the listening connection was re-established, and messages may have been lost. There's
+		// nothing we can do about that, redis pubsub is fire and forget
+		return
+	}
+	select {
+	case hub.payloads <- notification.Extra:
+	default:
+		log.Println("Too many pubsub messages waiting to be delivered, dropping one")
+	}
+}
+
+func (hub *pubsubHub) deliverPayloads() {
+	for payload := range hub.payloads {
+		channelBytes, message, err := hub.pubsub.Decode(hub.db, payload)
+		if err != nil {
+			log.Println("Error decoding pubsub payload: ", err)
+			continue
+		}
+		hub.deliver(string(channelBytes), string(message))
+	}
+}
+
+// Deliver a message to the local clients subscribed to channel, or a pattern that matches it
+func (hub *pubsubHub) deliver(channel string, message string) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	for client := range hub.channels[channel] {
+		client.deliver(newPgRedisPushOfStrings([]string{"message", channel, message}))
+	}
+	for pattern, clients := range hub.patterns {
+		if globMatch(pattern, channel) {
+			for client := range clients {
+				client.deliver(newPgRedisPushOfStrings([]string{"pmessage", pattern, channel, message}))
+			}
+		}
+	}
+}
+
+// Commands that change a client's subscriptions are handled outside the usual command flow, as
+// they don't touch the database and they need the state of the client.
+func isSubscriptionCommand(cmd string) bool {
+	switch cmd {
+	case "SUBSCRIBE", "UNSUBSCRIBE", "PSUBSCRIBE", "PUNSUBSCRIBE":
+		return true
+	default:
+		return false
+	}
+}
+
+// While a RESP2 client is subscribed, only these commands are allowed
+func isAllowedWhileSubscribed(cmd string) bool {
+	return isSubscriptionCommand(cmd) || cmd == "PING" || cmd == "QUIT"
+}
+
+// Execute a subscription command. Redis replies with a separate array for each channel or pattern
+// in the request, including the number of subscriptions the client has afterwards.
+func (redis *PgRedis) executeSubscriptionCommand(client *redisClient, request redisRequest) {
+	cmd := request.CommandString()
+	args := request.Args()[1:]
+	replyName := strings.ToLower(cmd)
+
+	switch cmd {
+	case "SUBSCRIBE":
+		client.startDelivery()
+		for _, channel := range args {
+			redis.subscribers.subscribe(client, channel)
+			writeSubscriptionReply(client, replyName, channel)
+		}
+	case "PSUBSCRIBE":
+		client.startDelivery()
+		for _, pattern := range args {
+			redis.subscribers.psubscribe(client, pattern)
+			writeSubscriptionReply(client, replyName, pattern)
+		}
+	case "UNSUBSCRIBE":
+		if len(args) == 0 {
+			args = sortedKeys(client.channels)
+		}
+		for _, channel := range args {
+			redis.subscribers.unsubscribe(client, channel)
+			writeSubscriptionReply(client, replyName, channel)
+		}
+		if len(args) == 0 {
+			writeEmptyUnsubscribeReply(client, replyName)
+		}
+	case "PUNSUBSCRIBE":
+		if len(args) == 0 {
+			args = sortedKeys(client.patterns)
+		}
+		for _, pattern := range args {
+			redis.subscribers.punsubscribe(client, pattern)
+			writeSubscriptionReply(client, replyName, pattern)
+		}
+		if len(args) == 0 {
+			writeEmptyUnsubscribeReply(client, replyName)
+		}
+	}
+}
+
+// In pubsub mode PING replies with an array, so the client can tell it apart from a message
+func writeSubscribedPingReply(client *redisClient, request redisRequest) {
+	client.reply(newPgRedisArrayOfStrings([]string{"pong", string(request.Get(1))}))
+}
+
+func writeSubscriptionReply(client *redisClient, kind string, name string) {
+	reply := []pgRedisValue{
+		newPgRedisString(kind),
+		newPgRedisString(name),
+		newPgRedisInt(int64(client.subscriptionCount())),
+	}
+	client.reply(newPgRedisPush(reply))
+}
+
+func writeEmptyUnsubscribeReply(client *redisClient, kind string) {
+	reply := []pgRedisValue{
+		newPgRedisString(kind),
+		newPgRedisNil(),
+		newPgRedisInt(int64(client.subscriptionCount())),
+	}
+	client.reply(newPgRedisPush(reply))
+}
+
+func sortedKeys(items map[string]bool) []string {
+	result := make([]string, 0, len(items))
+	for item := range items {
+		result = append(result, item)
+	}
+	sort.Strings(result)
+	return result
+}
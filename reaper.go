@@ -0,0 +1,92 @@
+package pgredis
+
+import (
+	"log"
+	"time"
+)
+
+// The reaper is elected with the two argument form of pg_advisory_xact_lock, like keys and users.
+// Keys use the number of their database as the first argument and users use -2, so the reaper
+// uses -3. The second argument is the schema, as each schema needs a reaper of its own.
+const REAPER_LOCK_SPACE = -3
+
+// Expired keys can't be read, but their rows stay in the database until a write to the same key
+// removes them. The reaper deletes them in the background, up to batchSize keys every interval,
+// so the load it puts on the database is predictable.
+//
+// Only one pgredis instance reaps at a time. Each batch runs in a transaction that first tries to
+// take a transaction level advisory lock, and the instance that gets it deletes the batch while
+// the others skip theirs. The lock and the connection are only held for the length of a batch, so
+// the reaper never keeps a connection that clients are waiting for.
+type expiryReaper struct {
+	redis     *PgRedis
+	interval  time.Duration
+	batchSize int
+
+	// whether the last batch got the lock, so changes of leader can be logged
+	leader bool
+}
+
+func newExpiryReaper(redis *PgRedis, interval time.Duration, batchSize int) *expiryReaper {
+	return &expiryReaper{
+		redis:     redis,
+		interval:  interval,
+		batchSize: batchSize,
+	}
+}
+
+// Reap every interval until stop is closed
+func (reaper *expiryReaper) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(reaper.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			reaper.reap()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Delete a batch of expired keys, if this instance gets the lock
+func (reaper *expiryReaper) reap() {
+	locked, err := reaper.deleteBatch()
+	if err != nil {
+		log.Println("Error reaping expired keys: ", err)
+		return
+	}
+	if locked && !reaper.leader {
+		log.Println("This instance is now reaping expired keys")
+	}
+	reaper.leader = locked
+}
+
+// The batch is deleted in a transaction so the expired events are published with it. Returns
+// false if another instance holds the lock.
+func (reaper *expiryReaper) deleteBatch() (bool, error) {
+	tx, err := reaper.redis.begin(nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	err = tx.QueryRow("SELECT pg_try_advisory_xact_lock($1, hashtext(current_schema()))", REAPER_LOCK_SPACE).Scan(&locked)
+	if err != nil || !locked {
+		return false, err
+	}
+
+	_, err = reaper.redis.keys.DeleteExpiredBatch(tx, reaper.batchSize)
+	if err != nil {
+		return true, err
+	}
+
+	// the versions WATCH keeps for deleted keys are only needed for a while
+	err = reaper.redis.keys.DeleteOldVersions(tx, reaper.batchSize)
+	if err != nil {
+		return true, err
+	}
+	return true, tx.Commit()
+}
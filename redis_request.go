@@ -33,6 +33,15 @@ func newRequestFromRedisProto(from *redisproto.Command) redisRequest {
 	return redisRequest{argv: argv, last: last}
 }
 
+// Build a request from a list of arguments, like the command passed to COMMAND GETKEYS
+func newRequestFromArgs(args []string) redisRequest {
+	argv := make([][]byte, 0, len(args))
+	for _, arg := range args {
+		argv = append(argv, []byte(arg))
+	}
+	return redisRequest{argv: argv, last: true}
+}
+
 // Return the first argument of the request as a string. This is typically the redis command (GET,
 // SET, etc)
 func (c *redisRequest) CommandString() string {
@@ -0,0 +1,152 @@
+package pgredis
+
+import (
+	"database/sql"
+	"log"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// how often we check how far behind each replica is
+const REPLICA_LAG_CHECK_INTERVAL = time.Second
+
+// Read only commands can be sent to postgres hot standbys, to take load off the primary. A
+// standby is only used while it's within maxLag of the primary, and if none are, reads go to the
+// primary like everything else.
+type replicaSet struct {
+	replicas []*replica
+	maxLag   time.Duration
+	next     uint64
+}
+
+type replica struct {
+	db *sql.DB
+
+	// 1 if the replica is close enough to the primary to read from, updated by monitor()
+	healthy int32
+
+	// the query that returns the replica's lag in seconds, which depends on the postgres version
+	lagQuery string
+}
+
+func newReplicaSet(connStrs []string, schema string, maxConnections int, maxLag time.Duration) (*replicaSet, error) {
+	set := &replicaSet{maxLag: maxLag}
+	for _, connStr := range connStrs {
+		db, err := openDatabaseWithRetries(connStr, schema, 3)
+		if err != nil {
+			set.close()
+			return nil, err
+		}
+		db.SetMaxOpenConns(maxConnections)
+		set.replicas = append(set.replicas, &replica{db: db})
+	}
+	set.check()
+	return set, nil
+}
+
+// Return a replica's db to read from, taking turns between the healthy ones. Returns nil if
+// there aren't any and the primary should be used.
+func (set *replicaSet) pick() *sql.DB {
+	if set == nil {
+		return nil
+	}
+	for range set.replicas {
+		idx := atomic.AddUint64(&set.next, 1) % uint64(len(set.replicas))
+		candidate := set.replicas[idx]
+		if atomic.LoadInt32(&candidate.healthy) == 1 {
+			return candidate.db
+		}
+	}
+	return nil
+}
+
+// Check the lag of each replica every REPLICA_LAG_CHECK_INTERVAL, until stop is closed
+func (set *replicaSet) monitor(stop <-chan struct{}) {
+	ticker := time.NewTicker(REPLICA_LAG_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			set.check()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (set *replicaSet) check() {
+	for _, candidate := range set.replicas {
+		lag, err := candidate.lag()
+		healthy := err == nil && lag <= set.maxLag
+		if err != nil {
+			log.Println("Error checking replica lag: ", err)
+		}
+
+		wasHealthy := atomic.SwapInt32(&candidate.healthy, boolToInt32(healthy)) == 1
+		if wasHealthy && !healthy {
+			log.Printf("Replica is more than %s behind the primary, reading from the primary instead", set.maxLag)
+		} else if !wasHealthy && healthy {
+			log.Printf("Replica is within %s of the primary, reading from it", set.maxLag)
+		}
+	}
+}
+
+func (set *replicaSet) close() {
+	if set == nil {
+		return
+	}
+	for _, replica := range set.replicas {
+		replica.db.Close()
+	}
+}
+
+// How far the replica is behind the primary. pg_last_xact_replay_timestamp is the time of the last
+// transaction the replica replayed, so on a quiet primary it grows even though the replica isn't
+// missing anything. A replica that's streaming from the primary and has replayed everything it
+// has received counts as up to date.
+//
+// A replica whose WAL receiver has stopped has also replayed everything it received, but it will
+// never receive any more, so it's only measured by the last transaction it replayed. Postgres only
+// shows the receiver's status to superusers (and pg_read_all_stats in postgres 10 and later), so
+// for other users replicas are always measured that way.
+func (candidate *replica) lag() (time.Duration, error) {
+	if candidate.lagQuery == "" {
+		version, err := serverVersion(candidate.db)
+		if err != nil {
+			return 0, err
+		}
+		candidate.lagQuery = replicaLagQuery(version)
+	}
+
+	var seconds sql.NullFloat64
+	err := candidate.db.QueryRow(candidate.lagQuery).Scan(&seconds)
+	if err != nil {
+		return 0, err
+	}
+	if !seconds.Valid {
+		// the replica hasn't replayed anything yet, so we can't tell how far behind it is
+		return time.Duration(math.MaxInt64), nil
+	}
+	return time.Duration(seconds.Float64 * float64(time.Second)), nil
+}
+
+// The query for a replica's lag in seconds. pg_stat_wal_receiver was added in postgres 9.6, so
+// older replicas are only measured by the last transaction they replayed.
+func replicaLagQuery(version int) string {
+	replayLag := "extract(epoch FROM now() - pg_last_xact_replay_timestamp())"
+	if version < 90600 {
+		return "SELECT CASE WHEN NOT pg_is_in_recovery() THEN 0 ELSE " + replayLag + " END"
+	}
+	return "SELECT CASE WHEN NOT pg_is_in_recovery() THEN 0 " +
+		"WHEN " + walName(version, "pg_last_wal_receive_lsn()") + " = " + walName(version, "pg_last_wal_replay_lsn()") + " " +
+		"AND EXISTS (SELECT 1 FROM pg_stat_wal_receiver WHERE status = 'streaming') THEN 0 " +
+		"ELSE " + replayLag + " END"
+}
+
+func boolToInt32(value bool) int32 {
+	if value {
+		return 1
+	}
+	return 0
+}
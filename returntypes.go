@@ -2,13 +2,23 @@ package pgredis
 
 import (
 	"io"
+	"math"
 	"strconv"
 
 	"github.com/secmask/go-redisproto"
 )
 
+// The versions of the redis protocol a client can choose with HELLO. Connections start with
+// RESP2, and RESP3 adds types like maps, sets, doubles and push messages.
+const (
+	RESP2 = 2
+	RESP3 = 3
+)
+
+// A reply to a client. Values are written in the protocol the client has chosen, and the RESP3
+// types fall back to the nearest RESP2 type for clients that haven't upgraded.
 type pgRedisValue interface {
-	writeTo(io.Writer) error
+	writeTo(target io.Writer, protocol int) error
 }
 
 type pgRedisInt struct {
@@ -22,7 +32,7 @@ func newPgRedisInt(value int64) pgRedisValue {
 	}
 }
 
-func (num *pgRedisInt) writeTo(target io.Writer) error {
+func (num *pgRedisInt) writeTo(target io.Writer, protocol int) error {
 	protocolWriter := redisproto.NewWriter(target)
 	return protocolWriter.WriteInt(num.value)
 }
@@ -38,7 +48,7 @@ func newPgRedisString(value string) pgRedisValue {
 	}
 }
 
-func (str *pgRedisString) writeTo(target io.Writer) error {
+func (str *pgRedisString) writeTo(target io.Writer, protocol int) error {
 	protocolWriter := redisproto.NewWriter(target)
 	return protocolWriter.WriteBulkString(str.value)
 }
@@ -54,7 +64,7 @@ func newPgRedisError(value string) pgRedisValue {
 	}
 }
 
-func (err *pgRedisError) writeTo(target io.Writer) error {
+func (err *pgRedisError) writeTo(target io.Writer, protocol int) error {
 	protocolWriter := redisproto.NewWriter(target)
 	return protocolWriter.WriteError(err.value)
 }
@@ -66,7 +76,10 @@ func newPgRedisNil() pgRedisValue {
 	return &pgRedisNil{}
 }
 
-func (empty *pgRedisNil) writeTo(target io.Writer) error {
+func (empty *pgRedisNil) writeTo(target io.Writer, protocol int) error {
+	if protocol == RESP3 {
+		return writeResp3Null(target)
+	}
 	protocolWriter := redisproto.NewWriter(target)
 	return protocolWriter.WriteBulk(nil)
 }
@@ -78,11 +91,54 @@ func newPgRedisNilArray() pgRedisValue {
 	return &pgRedisNilArray{}
 }
 
-func (empty *pgRedisNilArray) writeTo(target io.Writer) error {
+// RESP2 has separate nil replies for strings and arrays, RESP3 has a single null
+func (empty *pgRedisNilArray) writeTo(target io.Writer, protocol int) error {
+	if protocol == RESP3 {
+		return writeResp3Null(target)
+	}
 	protocolWriter := redisproto.NewWriter(target)
 	return protocolWriter.WriteObjectsSlice(nil)
 }
 
+func writeResp3Null(target io.Writer) error {
+	_, err := target.Write([]byte("_\r\n"))
+	return err
+}
+
+type pgRedisDouble struct {
+	value float64
+}
+
+func newPgRedisDouble(value float64) pgRedisValue {
+	return &pgRedisDouble{
+		value: value,
+	}
+}
+
+// A double is written as a bulk string in RESP2, as redis does for scores
+func (num *pgRedisDouble) writeTo(target io.Writer, protocol int) error {
+	formatted := formatDouble(num.value)
+	if protocol == RESP3 {
+		_, err := target.Write([]byte("," + formatted + "\r\n"))
+		return err
+	}
+	protocolWriter := redisproto.NewWriter(target)
+	return protocolWriter.WriteBulkString(formatted)
+}
+
+func formatDouble(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "inf"
+	case math.IsInf(value, -1):
+		return "-inf"
+	case math.IsNaN(value):
+		return "nan"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
 type pgRedisArray struct {
 	values []pgRedisValue
 }
@@ -95,31 +151,132 @@ func newPgRedisArray(values []pgRedisValue) pgRedisValue {
 }
 
 func newPgRedisArrayOfStrings(values []string) pgRedisValue {
-	newValues := make([]pgRedisValue, len(values))
-	for idx, value := range values {
-		newValues[idx] = newPgRedisString(value)
+	return pgRedisArray{
+		values: stringValues(values),
 	}
+}
 
-	return pgRedisArray{
-		values: newValues,
+func (arr pgRedisArray) writeTo(target io.Writer, protocol int) error {
+	return writeAggregate(target, protocol, '*', len(arr.values), arr.values)
+}
+
+// A map is sent as a flat array of keys and values in RESP2, like HGETALL always has
+type pgRedisMap struct {
+	values []pgRedisValue
+}
+
+// values alternate between keys and values
+func newPgRedisMap(values []pgRedisValue) pgRedisValue {
+	return pgRedisMap{
+		values: values,
 	}
 }
 
-func (arr pgRedisArray) writeTo(target io.Writer) error {
-	star := []byte{'*'}
-	newLine := []byte{'\r', '\n'}
-	arraySizeAsString := strconv.FormatInt(int64(len(arr.values)), 10)
-	protocolWriter := redisproto.NewWriter(target)
-	protocolWriter.Write(star)                      // start an array
-	protocolWriter.Write([]byte(arraySizeAsString)) // the number of items in array
-	protocolWriter.Write(newLine)
+func newPgRedisMapOfStrings(values []string) pgRedisValue {
+	return pgRedisMap{
+		values: stringValues(values),
+	}
+}
+
+func (m pgRedisMap) writeTo(target io.Writer, protocol int) error {
+	if protocol == RESP3 {
+		return writeAggregate(target, protocol, '%', len(m.values)/2, m.values)
+	}
+	return writeAggregate(target, protocol, '*', len(m.values), m.values)
+}
+
+type pgRedisSet struct {
+	values []pgRedisValue
+}
 
-	for _, value := range arr.values {
+func newPgRedisSetOfStrings(values []string) pgRedisValue {
+	return pgRedisSet{
+		values: stringValues(values),
+	}
+}
+
+func (set pgRedisSet) writeTo(target io.Writer, protocol int) error {
+	if protocol == RESP3 {
+		return writeAggregate(target, protocol, '~', len(set.values), set.values)
+	}
+	return writeAggregate(target, protocol, '*', len(set.values), set.values)
+}
+
+// A list of pairs, like the members and scores from ZRANGE WITHSCORES. RESP3 clients get an array
+// of two element arrays, and RESP2 clients get a single flat array.
+type pgRedisPairs struct {
+	values []pgRedisValue
+}
+
+// values alternate between the first and second item of each pair
+func newPgRedisPairs(values []pgRedisValue) pgRedisValue {
+	return pgRedisPairs{
+		values: values,
+	}
+}
+
+func (pairs pgRedisPairs) writeTo(target io.Writer, protocol int) error {
+	if protocol != RESP3 {
+		return writeAggregate(target, protocol, '*', len(pairs.values), pairs.values)
+	}
+	nested := make([]pgRedisValue, 0, len(pairs.values)/2)
+	for idx := 0; idx+1 < len(pairs.values); idx += 2 {
+		nested = append(nested, newPgRedisArray(pairs.values[idx:idx+2]))
+	}
+	return writeAggregate(target, protocol, '*', len(nested), nested)
+}
+
+// An out-of-band message, like a pubsub message. RESP3 marks these so the client can tell them
+// apart from replies, and RESP2 clients get an array.
+type pgRedisPush struct {
+	values []pgRedisValue
+}
+
+func newPgRedisPush(values []pgRedisValue) pgRedisValue {
+	return pgRedisPush{
+		values: values,
+	}
+}
+
+func newPgRedisPushOfStrings(values []string) pgRedisValue {
+	return pgRedisPush{
+		values: stringValues(values),
+	}
+}
+
+func (push pgRedisPush) writeTo(target io.Writer, protocol int) error {
+	if protocol == RESP3 {
+		return writeAggregate(target, protocol, '>', len(push.values), push.values)
+	}
+	return writeAggregate(target, protocol, '*', len(push.values), push.values)
+}
+
+// Write the header of an aggregate type (array, map, set or push) followed by its values
+func writeAggregate(target io.Writer, protocol int, prefix byte, size int, values []pgRedisValue) error {
+	header := []byte{prefix}
+	header = strconv.AppendInt(header, int64(size), 10)
+	header = append(header, '\r', '\n')
+	_, err := target.Write(header)
+	if err != nil {
+		return err
+	}
+
+	for _, value := range values {
 		if value == nil {
 			panic("oh oh")
-		} else {
-			value.writeTo(target)
+		}
+		err = value.writeTo(target, protocol)
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
+
+func stringValues(values []string) []pgRedisValue {
+	result := make([]pgRedisValue, len(values))
+	for idx, value := range values {
+		result[idx] = newPgRedisString(value)
+	}
+	return result
+}
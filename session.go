@@ -0,0 +1,229 @@
+package pgredis
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"log"
+
+	"github.com/lib/pq"
+	"github.com/yob/pgredis/internal/repositories"
+)
+
+// the most prepared statements a session keeps. Most commands use a handful of fixed queries,
+// but a few build their SQL from the request and shouldn't fill the cache.
+const MAX_SESSION_STATEMENTS = 256
+
+// the timeouts every statement runs under, set on each connection when it's opened
+const SESSION_SETTINGS = "SET statement_timeout = 5000; SET lock_timeout = 5000"
+
+// Opens connections to postgres with SESSION_SETTINGS applied, so they hold for every statement
+// whether it's in a transaction or not.
+//
+// With a schema, each connection's search_path is set to it, so the tables are found there. The
+// notification channels are shared by the whole database, so the repositories add the
+// pgredis.channel_prefix setting to their names.
+type timeoutConnector struct {
+	*pq.Connector
+	settings string
+}
+
+func newTimeoutConnector(connStr string, schema string) (*timeoutConnector, error) {
+	connector, err := pq.NewConnector(connStr)
+	if err != nil {
+		return nil, err
+	}
+	settings := SESSION_SETTINGS + "; SET pgredis.channel_prefix = " + pq.QuoteLiteral(channelPrefix(schema))
+	if schema != "" {
+		settings += "; SET search_path TO " + pq.QuoteIdentifier(schema)
+	}
+	return &timeoutConnector{Connector: connector, settings: settings}, nil
+}
+
+func (connector *timeoutConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := connector.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.(driver.ExecerContext).ExecContext(ctx, connector.settings, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// run in a transaction so it commits without waiting for the WAL to be flushed
+const ASYNC_COMMIT = "SET LOCAL synchronous_commit TO off"
+
+// Read only commands run in a transaction like this, so every statement they run sees the same
+// snapshot. Without it, a command that checks the type of a key and then reads it could see a
+// different value (or type) in each statement.
+const READ_ONLY_BEGIN = "BEGIN READ ONLY ISOLATION LEVEL REPEATABLE READ"
+
+var readOnlyTxOptions = &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+
+// A transaction on a connection from the pool, or on a client's pinned session
+type transaction interface {
+	repositories.Querier
+	Commit() error
+	Rollback() error
+}
+
+// A database connection pinned to a single client. The statements it prepares are kept for the
+// life of the connection. A query with arguments takes two round trips on a pooled
+// connection (one to parse it and one to run it), and only one on a session.
+type dbSession struct {
+	conn       *sql.Conn
+	statements map[string]*sql.Stmt
+}
+
+func openSession(db *sql.DB) (*dbSession, error) {
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &dbSession{
+		conn:       conn,
+		statements: map[string]*sql.Stmt{},
+	}, nil
+}
+
+// Start a transaction. Without synchronousCommit, it's sent along with BEGIN so it doesn't need a
+// round trip of its own.
+func (session *dbSession) begin(synchronousCommit bool) (*sessionTx, error) {
+	statement := "BEGIN"
+	if !synchronousCommit {
+		statement = "BEGIN; " + ASYNC_COMMIT
+	}
+	return session.beginWith(statement)
+}
+
+func (session *dbSession) beginReadOnly() (*sessionTx, error) {
+	return session.beginWith(READ_ONLY_BEGIN)
+}
+
+func (session *dbSession) beginWith(statement string) (*sessionTx, error) {
+	_, err := session.conn.ExecContext(context.Background(), statement)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionTx{dbSession: session}, nil
+}
+
+// Return the prepared statement for query, preparing it if this is the first time it's been
+// used. Returns nil if the statement can't be cached, and the query should run unprepared.
+func (session *dbSession) prepare(query string) *sql.Stmt {
+	if stmt, ok := session.statements[query]; ok {
+		return stmt
+	}
+	if len(session.statements) >= MAX_SESSION_STATEMENTS {
+		return nil
+	}
+
+	stmt, err := session.conn.PrepareContext(context.Background(), query)
+	if err != nil {
+		return nil
+	}
+	session.statements[query] = stmt
+	return stmt
+}
+
+// Release the connection back to the pool
+func (session *dbSession) close() {
+	for _, stmt := range session.statements {
+		stmt.Close()
+	}
+	err := session.conn.Close()
+	if err != nil {
+		log.Println("Error closing database session: ", err)
+	}
+}
+
+// Outside a transaction, each statement on a session commits on its own. Queries without arguments
+// aren't prepared, so they can contain more than one statement.
+func (session *dbSession) Exec(query string, args ...interface{}) (sql.Result, error) {
+	if len(args) > 0 {
+		if stmt := session.prepare(query); stmt != nil {
+			return stmt.Exec(args...)
+		}
+	}
+	return session.conn.ExecContext(context.Background(), query, args...)
+}
+
+func (session *dbSession) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	if stmt := session.prepare(query); stmt != nil {
+		return stmt.Query(args...)
+	}
+	return session.conn.QueryContext(context.Background(), query, args...)
+}
+
+func (session *dbSession) QueryRow(query string, args ...interface{}) *sql.Row {
+	if stmt := session.prepare(query); stmt != nil {
+		return stmt.QueryRow(args...)
+	}
+	return session.conn.QueryRowContext(context.Background(), query, args...)
+}
+
+// A transaction on a session. database/sql won't let a transaction use statements prepared on its
+// connection, so the transaction is managed with plain BEGIN and COMMIT instead of a *sql.Tx.
+type sessionTx struct {
+	*dbSession
+	finished bool
+}
+
+func (tx *sessionTx) Commit() error {
+	if tx.finished {
+		return sql.ErrTxDone
+	}
+	tx.finished = true
+	_, err := tx.conn.ExecContext(context.Background(), "COMMIT")
+	return err
+}
+
+// Like *sql.Tx, rolling back a transaction that's already finished does nothing
+func (tx *sessionTx) Rollback() error {
+	if tx.finished {
+		return sql.ErrTxDone
+	}
+	tx.finished = true
+	_, err := tx.conn.ExecContext(context.Background(), "ROLLBACK")
+	return err
+}
+
+// The client's pinned session, opening one if there's a connection to spare. Returns nil if the
+// client should use the pool.
+func (redis *PgRedis) clientSession(client *redisClient) *dbSession {
+	if client == nil {
+		return nil
+	}
+	if client.session != nil {
+		return client.session
+	}
+
+	select {
+	case redis.sessionSlots <- struct{}{}:
+	default:
+		// every pinned connection is taken, try again next time
+		return nil
+	}
+	session, err := openSession(redis.db)
+	if err != nil {
+		<-redis.sessionSlots
+		log.Println("Error opening database session, using the pool: ", err)
+		return nil
+	}
+	client.session = session
+	return session
+}
+
+// Give the client's pinned session back, so another client can have it
+func (redis *PgRedis) releaseSession(client *redisClient) {
+	if client.session == nil {
+		return
+	}
+	client.session.close()
+	client.session = nil
+	<-redis.sessionSlots
+}
@@ -0,0 +1,157 @@
+package pgredis
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The server keeps track of its connections, so it can shut down without interrupting a request.
+// When it starts draining, idle connections are closed straight away and busy ones are closed as
+// soon as they finish the request they're working on. A client is idle while we're waiting for it
+// to send a request, unless it has pipelined requests waiting to run as a batch.
+type connectionTracker struct {
+	mutex    sync.Mutex
+	clients  map[*redisClient]bool
+	draining bool
+	finished sync.WaitGroup
+}
+
+func newConnectionTracker() *connectionTracker {
+	return &connectionTracker{
+		clients: map[*redisClient]bool{},
+	}
+}
+
+// Start tracking a new connection. Returns false if the server is draining, and the connection
+// should be closed.
+func (tracker *connectionTracker) add(client *redisClient) bool {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	if tracker.draining {
+		return false
+	}
+	tracker.clients[client] = false
+	tracker.finished.Add(1)
+	return true
+}
+
+func (tracker *connectionTracker) remove(client *redisClient) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	if _, ok := tracker.clients[client]; ok {
+		delete(tracker.clients, client)
+		tracker.finished.Done()
+	}
+}
+
+// Mark a client as busy. Returns false if the server is draining, and the request shouldn't run.
+func (tracker *connectionTracker) startRequest(client *redisClient) bool {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	if tracker.draining {
+		return false
+	}
+	tracker.clients[client] = true
+	return true
+}
+
+// Mark a client as idle. Returns false if the server is draining, and the connection should be closed.
+func (tracker *connectionTracker) finishRequest(client *redisClient) bool {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.clients[client] = false
+	return !tracker.draining
+}
+
+// Stop accepting requests, and close the connections that are idle
+func (tracker *connectionTracker) drain() {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.draining = true
+	for client, busy := range tracker.clients {
+		if !busy {
+			client.conn.Close()
+		}
+	}
+}
+
+// Close every connection, busy or not
+func (tracker *connectionTracker) closeAll() {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	for client := range tracker.clients {
+		client.conn.Close()
+	}
+}
+
+// Wait for every connection to close, returning false if they haven't within timeout
+func (tracker *connectionTracker) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		tracker.finished.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Start shutting the server down. StartServer does the work, and returns once it's finished.
+func (redis *PgRedis) Shutdown() {
+	redis.shutdownOnce.Do(func() {
+		close(redis.shuttingDown)
+	})
+}
+
+func (redis *PgRedis) isShuttingDown() bool {
+	select {
+	case <-redis.shuttingDown:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shut down gracefully. New connections are refused, idle connections are closed, and busy
+// connections get up to timeout to finish their current request before they're closed too.
+// Blocked clients (eg. BRPOP) are woken with an error when the shutdown starts.
+func (redis *PgRedis) drain(listeners []net.Listener, timeout time.Duration) error {
+	for _, listener := range listeners {
+		listener.Close()
+	}
+
+	redis.connections.drain()
+	if !redis.connections.wait(timeout) {
+		log.Println("Connections still open after the shutdown timeout, closing them")
+		redis.connections.closeAll()
+	}
+
+	// closing the database waits for any queries that are still running
+	redis.listener.close()
+	redis.replicas.close()
+	err := redis.db.Close()
+	log.Println("pgredis shut down")
+	return err
+}
+
+// SHUTDOWN [NOSAVE | SAVE] [NOW] [FORCE]. Everything is already saved in postgres and there are no
+// replicas to wait for, so the options are accepted and ignored.
+func validateShutdownRequest(request *redisRequest) error {
+	for _, arg := range request.Args()[1:] {
+		switch strings.ToUpper(arg) {
+		case "NOSAVE", "SAVE", "NOW", "FORCE":
+		case "ABORT":
+			return newErr("No shutdown in progress.")
+		default:
+			return newSyntaxError()
+		}
+	}
+	return nil
+}
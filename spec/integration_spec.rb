@@ -13,6 +13,9 @@ RSpec.describe "realredis" do
   include_examples "pipelining"
   include_examples "server"
   include_examples "transactions"
+  include_examples "pubsub"
+  include_examples "acl"
+  include_examples "resp3"
 end
 
 RSpec.describe "pgredis" do
@@ -28,4 +31,7 @@ RSpec.describe "pgredis" do
   include_examples "pipelining"
   include_examples "server"
   include_examples "transactions"
+  include_examples "pubsub"
+  include_examples "acl"
+  include_examples "resp3"
 end
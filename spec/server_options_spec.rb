@@ -0,0 +1,155 @@
+# coding: utf-8
+
+require 'openssl'
+require 'tmpdir'
+
+# Options that need a pgredis server of their own, started with PgredisProcess
+RSpec.describe "pgredis server options" do
+  let(:redis) { Redis.new(url: ENV.fetch("PGREDIS_URL")) }
+
+  context "with --pinned-sessions at its maximum" do
+    let(:port) { 16380 }
+
+    before do
+      @server = PgredisProcess.new("spec_pinned", "--port", port, "--max-connections", 3, "--pinned-sessions", 2,
+                                   "--expiry-interval", "10ms")
+      @server.wait_for_port(port)
+    end
+    after do
+      @server.stop
+    end
+
+    it "leaves a connection for clients that aren't pinned while the reaper runs" do
+      pinned = 2.times.map { Redis.new(host: "127.0.0.1", port: port) }
+      pinned.each_with_index { |client, idx| client.set("pinned:#{idx}", idx) }
+      sleep(0.1) # the reaper runs a few batches
+
+      unpinned = Redis.new(host: "127.0.0.1", port: port, timeout: 5)
+      expect(unpinned.set("foo", "bar")).to eql("OK")
+      expect(unpinned.get("foo")).to eql("bar")
+    end
+  end
+
+  context "with --tls-port" do
+    let(:port) { 16382 }
+
+    # write a self signed certificate and its key to dir, replacing any that are there
+    def write_certificate(dir, common_name)
+      key = OpenSSL::PKey::RSA.new(2048)
+      certificate = OpenSSL::X509::Certificate.new
+      certificate.version = 2
+      certificate.serial = rand(2**64)
+      certificate.subject = certificate.issuer = OpenSSL::X509::Name.parse("/CN=#{common_name}")
+      certificate.public_key = key.public_key
+      certificate.not_before = Time.now - 60
+      certificate.not_after = Time.now + 3600
+      certificate.sign(key, OpenSSL::Digest::SHA256.new)
+      File.write(File.join(dir, "server.crt"), certificate.to_pem)
+      File.write(File.join(dir, "server.key"), key.to_pem)
+    end
+
+    # the common name of the certificate the server presents to a new connection
+    def presented_common_name
+      socket = TCPSocket.new("127.0.0.1", port)
+      ssl = OpenSSL::SSL::SSLSocket.new(socket, OpenSSL::SSL::SSLContext.new)
+      ssl.connect
+      ssl.peer_cert.subject.to_a.find { |name, _, _| name == "CN" }[1]
+    ensure
+      ssl&.close
+      socket&.close
+    end
+
+    before do
+      @dir = Dir.mktmpdir
+      write_certificate(@dir, "first")
+      @server = PgredisProcess.new("spec_tls", "--port", 0, "--tls-port", port,
+                                   "--tls-cert-file", File.join(@dir, "server.crt"),
+                                   "--tls-key-file", File.join(@dir, "server.key"),
+                                   "--tls-auth-clients", "no")
+      @server.wait_for_port(port)
+    end
+    after do
+      @server.stop
+      FileUtils.remove_entry(@dir)
+    end
+
+    it "accepts TLS connections" do
+      client = Redis.new(host: "127.0.0.1", port: port, ssl: true,
+                         ssl_params: { verify_mode: OpenSSL::SSL::VERIFY_NONE })
+      expect(client.set("foo", "bar")).to eql("OK")
+      expect(client.get("foo")).to eql("bar")
+    end
+
+    it "presents a new certificate to new connections after SIGHUP" do
+      expect(presented_common_name).to eql("first")
+
+      write_certificate(@dir, "second")
+      @server.hup
+
+      # the certificates are reloaded in the background
+      Timeout.timeout(5) do
+        sleep(0.1) until presented_common_name == "second"
+      end
+      expect(presented_common_name).to eql("second")
+    end
+  end
+
+  context "with --unixsocket" do
+    let(:path) { File.join(@dir, "pgredis.sock") }
+
+    def start_server
+      @server = PgredisProcess.new("spec_unix", "--port", 0, "--unixsocket", path, "--unixsocketperm", "700")
+      @server.wait_for_socket(path)
+    end
+
+    before do
+      @dir = Dir.mktmpdir
+    end
+    after do
+      @server&.stop
+      FileUtils.remove_entry(@dir)
+    end
+
+    it "accepts connections on the socket" do
+      start_server
+      client = Redis.new(path: path)
+      expect(client.set("foo", "bar")).to eql("OK")
+      expect(client.get("foo")).to eql("bar")
+    end
+
+    it "sets the permissions of the socket" do
+      start_server
+      expect(File.socket?(path)).to eql(true)
+      expect(File.stat(path).mode & 0o777).to eql(0o700)
+    end
+
+    it "replaces a socket left behind by a server that stopped" do
+      UNIXServer.new(path).close
+      expect(File.socket?(path)).to eql(true)
+
+      start_server
+      expect(Redis.new(path: path).ping).to eql("PONG")
+    end
+  end
+
+  # testreplica streamed from the test database until it caught up, and then lost its connection
+  context "with a replica whose WAL receiver has stopped" do
+    let(:port) { 16381 }
+
+    before do
+      @server = PgredisProcess.new("spec_replica", "--port", port,
+                                   "--replica-database", ENV.fetch("PGREDIS_REPLICA_DATABASE_URL"),
+                                   "--replica-max-lag", "1s")
+      @server.wait_for_port(port)
+    end
+    after do
+      @server.stop
+    end
+
+    it "reads from the primary" do
+      client = Redis.new(host: "127.0.0.1", port: port)
+      client.set("foo", "bar")
+      expect(client.get("foo")).to eql("bar")
+    end
+  end
+end
@@ -0,0 +1,136 @@
+# coding: utf-8
+
+RSpec.shared_examples "acl" do
+  # ACL users aren't removed by FLUSHALL, so each example cleans up after itself
+  let(:admin) { Redis.new(url: redis.id) }
+
+  after do
+    admin.call("acl", "deluser", "alice")
+    admin.call("acl", "log", "reset")
+  end
+
+  context "acl whoami" do
+    it "returns the default user for a new connection" do
+      expect(redis.call("acl", "whoami")).to eql("default")
+    end
+  end
+
+  context "acl setuser" do
+    it "creates a user that's disabled and can't run any commands" do
+      expect(redis.call("acl", "setuser", "alice")).to eql("OK")
+      expect(redis.call("acl", "list")).to include("user alice off resetchannels -@all")
+    end
+
+    it "returns an error for an unknown rule" do
+      expect {
+        redis.call("acl", "setuser", "alice", "+notacommand")
+      }.to raise_error(Redis::CommandError, "ERR Error in ACL SETUSER modifier '+notacommand': Unknown command or category name in ACL")
+    end
+  end
+
+  context "acl getuser" do
+    before do
+      redis.call("acl", "setuser", "alice", "on", ">secret", "~foo*", "+get")
+    end
+
+    it "returns the flags, commands and key patterns of the user" do
+      result = Hash[*redis.call("acl", "getuser", "alice")]
+      expect(result["flags"]).to eql(["on"])
+      expect(result["commands"]).to eql("-@all +get")
+      expect(result["keys"]).to eql("~foo*")
+    end
+
+    it "returns nil for an unknown user" do
+      expect(redis.call("acl", "getuser", "bob")).to be_nil
+    end
+  end
+
+  context "acl deluser" do
+    it "returns the number of users that were deleted" do
+      redis.call("acl", "setuser", "alice")
+      expect(redis.call("acl", "deluser", "alice", "bob")).to eql(1)
+    end
+
+    it "can't delete the default user" do
+      expect {
+        redis.call("acl", "deluser", "default")
+      }.to raise_error(Redis::CommandError, "ERR The 'default' user cannot be removed")
+    end
+  end
+
+  context "acl cat" do
+    it "returns the categories" do
+      expect(redis.call("acl", "cat")).to include("read", "write", "dangerous")
+    end
+
+    it "returns the commands in a category" do
+      expect(redis.call("acl", "cat", "string")).to include("get", "set")
+    end
+  end
+
+  context "auth" do
+    before do
+      admin.call("acl", "setuser", "alice", "on", ">secret", "~foo*", "+get", "+acl")
+    end
+
+    it "logs in as the user" do
+      expect(redis.call("auth", "alice", "secret")).to eql("OK")
+      expect(redis.call("acl", "whoami")).to eql("alice")
+    end
+
+    it "returns an error for the wrong password" do
+      expect {
+        redis.call("auth", "alice", "wrong")
+      }.to raise_error(Redis::CommandError, "WRONGPASS invalid username-password pair or user is disabled.")
+    end
+
+    it "returns an error with just a password, when the default user doesn't have one" do
+      expect {
+        redis.call("auth", "secret")
+      }.to raise_error(Redis::CommandError, /\AERR AUTH <password> called without any password configured/)
+    end
+
+    it "denies commands the user hasn't been given" do
+      redis.call("auth", "alice", "secret")
+      expect {
+        redis.set("foo", "bar")
+      }.to raise_error(Redis::CommandError, /\ANOPERM/)
+    end
+
+    it "denies keys that don't match the user's patterns" do
+      redis.call("auth", "alice", "secret")
+      expect(redis.get("foobar")).to be_nil
+      expect {
+        redis.get("bar")
+      }.to raise_error(Redis::CommandError, /\ANOPERM/)
+    end
+
+    it "records denied commands in the log" do
+      redis.call("auth", "alice", "secret")
+      expect { redis.set("foo", "bar") }.to raise_error(Redis::CommandError)
+      entry = Hash[*admin.call("acl", "log").first]
+      expect(entry).to include("reason" => "command", "object" => "set", "username" => "alice")
+    end
+  end
+
+  context "hello" do
+    it "returns details of the server" do
+      result = Hash[*redis.call("hello", "2")]
+      expect(result).to include("server" => "redis", "proto" => 2, "mode" => "standalone")
+    end
+
+    it "can log in as a user" do
+      admin.call("acl", "setuser", "alice", "on", ">secret", "+@all", "~*")
+      redis.call("hello", "2", "auth", "alice", "secret")
+      expect(redis.call("acl", "whoami")).to eql("alice")
+    end
+
+    it "doesn't log in when another option is invalid" do
+      admin.call("acl", "setuser", "alice", "on", ">secret", "+@all", "~*")
+      expect {
+        redis.call("hello", "2", "auth", "alice", "secret", "foo")
+      }.to raise_error(Redis::CommandError, "ERR Syntax error in HELLO option 'foo'")
+      expect(redis.call("acl", "whoami")).to eql("default")
+    end
+  end
+end
@@ -37,4 +37,52 @@ RSpec.shared_examples "connection" do
       ).to eql("OK")
     end
   end
+
+  context "select" do
+    it "keeps the keys in each database separate" do
+      redis.set("foo", "zero")
+      expect(redis.select(1)).to eql("OK")
+      expect(redis.get("foo")).to be_nil
+      redis.set("foo", "one")
+      redis.select(0)
+      expect(redis.get("foo")).to eql("zero")
+    end
+
+    it "returns an error for a database that doesn't exist" do
+      expect {
+        redis.select(16)
+      }.to raise_error(Redis::CommandError, "ERR DB index is out of range")
+    end
+
+    it "returns an error for a non-integer database" do
+      expect {
+        redis.select("foo")
+      }.to raise_error(Redis::CommandError, "ERR invalid DB index")
+    end
+  end
+
+  context "errors" do
+    let(:other_client) { Redis.new(url: redis.id) }
+
+    # WATCH state belongs to a connection, so if the watched key being modified aborts the
+    # transaction we know the same connection was used throughout
+    it "keep the connection open" do
+      redis.set("foo", "1")
+      redis.watch("foo")
+      expect {
+        redis.call("notacommand")
+      }.to raise_error(Redis::CommandError, /\AERR unknown command/)
+      other_client.set("foo", "2")
+      result = redis.multi do
+        redis.set("foo", "3")
+      end
+      expect(result).to be_nil
+    end
+
+    it "return the wrong number of arguments" do
+      expect {
+        redis.call("get")
+      }.to raise_error(Redis::CommandError, "ERR wrong number of arguments for 'get' command")
+    end
+  end
 end
@@ -216,4 +216,25 @@ RSpec.shared_examples "hashes" do
       end
     end
   end
+
+  context "when the key holds the wrong type" do
+    before do
+      redis.sadd("foo", "aaa")
+    end
+    it "returns an error from hset" do
+      expect {
+        redis.hset("foo", "field", "value")
+      }.to raise_error(Redis::CommandError, /\AWRONGTYPE/)
+    end
+    it "returns an error from hget" do
+      expect {
+        redis.hget("foo", "field")
+      }.to raise_error(Redis::CommandError, /\AWRONGTYPE/)
+    end
+    it "returns an error from hgetall" do
+      expect {
+        redis.hgetall("foo")
+      }.to raise_error(Redis::CommandError, /\AWRONGTYPE/)
+    end
+  end
 end
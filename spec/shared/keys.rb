@@ -137,6 +137,79 @@ RSpec.shared_examples "keys" do
     end
   end
 
+  context "keys" do
+    before do
+      redis.set("user:1", "a")
+      redis.set("user:2", "b")
+      redis.set("user:10", "c")
+      redis.set("users", "d")
+      redis.set("100%", "e")
+      redis.set("user:3", "f", px: 1) # almost insta expire
+      sleep(0.1)
+    end
+    it "returns every key with *" do
+      expect(redis.keys("*")).to match_array(["user:1", "user:2", "user:10", "users", "100%"])
+    end
+    it "returns the keys that match a prefix" do
+      expect(redis.keys("user:*")).to match_array(["user:1", "user:2", "user:10"])
+    end
+    it "returns the keys that match a single character" do
+      expect(redis.keys("user:?")).to match_array(["user:1", "user:2"])
+    end
+    it "returns the keys that match brackets" do
+      expect(redis.keys("user:[1-2]*")).to match_array(["user:1", "user:2", "user:10"])
+    end
+    it "treats characters that are special to postgres as literals" do
+      expect(redis.keys("10_%")).to eql([])
+      expect(redis.keys("100%")).to eql(["100%"])
+    end
+    it "matches escaped characters literally" do
+      redis.set("what?", "g")
+      expect(redis.keys("what\\?")).to eql(["what?"])
+    end
+    it "returns nothing when no keys match" do
+      expect(redis.keys("nope*")).to eql([])
+    end
+  end
+
+  context "move" do
+    context "when the key doesn't exist in the other database" do
+      before do
+        redis.hset("foo", "a", "1")
+      end
+      it "moves the key and returns true" do
+        expect(redis.move("foo", 1)).to eql(true)
+        expect(redis.exists?("foo")).to eql(false)
+        redis.select(1)
+        expect(redis.hgetall("foo")).to eql("a" => "1")
+      end
+    end
+    context "when the key already exists in the other database" do
+      before do
+        redis.set("foo", "zero")
+        redis.select(1)
+        redis.set("foo", "one")
+        redis.select(0)
+      end
+      it "leaves both keys alone and returns false" do
+        expect(redis.move("foo", 1)).to eql(false)
+        expect(redis.get("foo")).to eql("zero")
+      end
+    end
+    context "when the key doesn't exist" do
+      it "returns false" do
+        expect(redis.move("foo", 1)).to eql(false)
+      end
+    end
+    context "when the other database is the current database" do
+      it "returns an error" do
+        expect {
+          redis.move("foo", 0)
+        }.to raise_error(Redis::CommandError, "ERR source and destination objects are the same")
+      end
+    end
+  end
+
   context "pttl" do
     context "when the key exists with no expiry" do
       before do
@@ -183,6 +256,61 @@ RSpec.shared_examples "keys" do
     end
   end
 
+  context "scan" do
+    before do
+      (1..25).each { |i| redis.set("string:#{i}", i) }
+      redis.hset("hash:1", "field", "value")
+      redis.sadd("set:1", "member")
+      redis.set("string:expired", "x", px: 1) # almost insta expire
+      sleep(0.1)
+    end
+    it "returns every key over a number of pages" do
+      expect(redis.scan_each(count: 5).to_a.sort).to eql(
+        ((1..25).map { |i| "string:#{i}" } + ["hash:1", "set:1"]).sort
+      )
+    end
+    it "returns a cursor of 0 once every key has been returned" do
+      cursor, keys = redis.scan(0, count: 1000)
+      expect(cursor).to eql("0")
+      expect(keys.size).to eql(27)
+    end
+    it "returns the keys that match a pattern" do
+      expect(redis.scan_each(match: "string:1*", count: 3).to_a).to match_array(
+        ["string:1"] + (10..19).map { |i| "string:#{i}" }
+      )
+    end
+    it "returns the keys that match brackets" do
+      expect(redis.scan_each(match: "[hs][ae]*:1").to_a).to match_array(["hash:1", "set:1"])
+    end
+    it "returns the keys of a type" do
+      keys = []
+      cursor = "0"
+      loop do
+        cursor, page = redis.call("scan", cursor, "type", "hash")
+        keys += page
+        break if cursor == "0"
+      end
+      expect(keys).to eql(["hash:1"])
+    end
+    it "can be continued with a cursor more than once" do
+      cursor, _ = redis.scan(0, count: 5)
+      expect(redis.scan(cursor, count: 5)[1]).to eql(redis.scan(cursor, count: 5)[1])
+    end
+    it "skips expired keys" do
+      expect(redis.scan_each.to_a).not_to include("string:expired")
+    end
+    it "returns an error when the cursor isn't a number" do
+      expect {
+        redis.scan("foo")
+      }.to raise_error(Redis::CommandError, "ERR invalid cursor")
+    end
+    it "returns an error when the count is less than 1" do
+      expect {
+        redis.scan(0, count: 0)
+      }.to raise_error(Redis::CommandError, "ERR syntax error")
+    end
+  end
+
   context "ttl" do
     context "when the key exists with no expiry" do
       before do
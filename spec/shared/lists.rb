@@ -1,6 +1,86 @@
 # coding: utf-8
 
 RSpec.shared_examples "lists" do
+  context "blmove" do
+    context "when the source list doesn't exist" do
+      it "returns nil after the timeout" do
+        expect(
+          redis.call(:blmove, "foo", "bar", "RIGHT", "LEFT", "0.1")
+        ).to eql(nil)
+      end
+    end
+    context "when the source list has two items" do
+      before do
+        redis.rpush("foo", ["aaa", "bbb"])
+      end
+      it "moves an item from the source to the destination" do
+        expect(
+          redis.call(:blmove, "foo", "bar", "LEFT", "RIGHT", 1)
+        ).to eql("aaa")
+        expect(redis.lrange("foo", 0, -1)).to eql(["bbb"])
+        expect(redis.lrange("bar", 0, -1)).to eql(["aaa"])
+      end
+    end
+  end
+
+  context "blmpop" do
+    context "when no lists exist" do
+      it "returns nil after the timeout" do
+        expect(
+          redis.call(:blmpop, "0.1", 2, "foo", "bar", "LEFT")
+        ).to eql(nil)
+      end
+    end
+    context "when the second list has three items" do
+      before do
+        redis.rpush("bar", ["aaa", "bbb", "ccc"])
+      end
+      it "returns the key and the requested number of items" do
+        expect(
+          redis.call(:blmpop, 1, 2, "foo", "bar", "RIGHT", "COUNT", 2)
+        ).to eql(["bar", ["ccc", "bbb"]])
+        expect(redis.lrange("bar", 0, -1)).to eql(["aaa"])
+      end
+    end
+  end
+
+  context "blpop" do
+    context "when no lists exist" do
+      it "returns nil" do
+        expect(
+          redis.blpop(["foo", "bar"], timeout: 1)
+        ).to eql(nil)
+      end
+    end
+    context "when a list exists with two items" do
+      before do
+        redis.rpush("foo", ["aaa", "bbb"])
+      end
+      it "returns the first item and removes it from the list" do
+        expect(
+          redis.blpop(["bar", "foo"], timeout: 1)
+        ).to eql(["foo", "aaa"])
+        expect(
+          redis.lrange("foo", 0, -1)
+        ).to eql(["bbb"])
+      end
+    end
+    context "with a fractional timeout" do
+      it "returns nil" do
+        expect(
+          redis.call(:blpop, "foo", "0.2")
+        ).to eql(nil)
+      end
+    end
+    context "with a negative timeout" do
+      it "raises an error" do
+        expect {
+          redis.call(:blpop, "foo", "-1")
+        }.to raise_error(Redis::CommandError, /timeout is negative/)
+      end
+    end
+  end
+
   context "brpop" do
     context "when no lists exist" do
       context "removing the last item" do
@@ -63,6 +143,57 @@ RSpec.shared_examples "lists" do
         end
       end
     end
+
+    context "when another client pushes to the list while blocked" do
+      it "returns the pushed item" do
+        pusher = Thread.new do
+          sleep(0.5)
+          Redis.new(url: redis.id).rpush("foo", "aaa")
+        end
+        expect(
+          redis.brpop("foo", timeout: 5)
+        ).to eql(["foo", "aaa"])
+        pusher.join
+      end
+    end
+
+    context "when another client pushes to a list with a very long key while blocked" do
+      let(:key) { "k" * 10_000 }
+
+      it "returns the pushed item" do
+        pusher = Thread.new do
+          sleep(0.5)
+          Redis.new(url: redis.id).rpush(key, "aaa")
+        end
+        expect(
+          redis.brpop(key, timeout: 5)
+        ).to eql([key, "aaa"])
+        pusher.join
+      end
+    end
+  end
+
+  context "brpoplpush" do
+    context "when the source list doesn't exist" do
+      it "returns nil" do
+        expect(
+          redis.brpoplpush("foo", "bar", timeout: 1)
+        ).to eql(nil)
+      end
+    end
+    context "when another client pushes to the source list while blocked" do
+      it "moves the pushed item to the destination" do
+        pusher = Thread.new do
+          sleep(0.5)
+          Redis.new(url: redis.id).rpush("foo", "aaa")
+        end
+        expect(
+          redis.brpoplpush("foo", "bar", timeout: 5)
+        ).to eql("aaa")
+        expect(redis.lrange("bar", 0, -1)).to eql(["aaa"])
+        pusher.join
+      end
+    end
   end
 
   context "llen" do
@@ -409,4 +540,30 @@ RSpec.shared_examples "lists" do
 
   end
 
+  context "when the key holds the wrong type" do
+    before do
+      redis.set("foo", "bar")
+    end
+    it "returns an error from lpush" do
+      expect {
+        redis.lpush("foo", "aaa")
+      }.to raise_error(Redis::CommandError, /\AWRONGTYPE/)
+      expect(redis.get("foo")).to eql("bar")
+    end
+    it "returns an error from llen" do
+      expect {
+        redis.llen("foo")
+      }.to raise_error(Redis::CommandError, /\AWRONGTYPE/)
+    end
+    it "returns an error from lpop" do
+      expect {
+        redis.lpop("foo")
+      }.to raise_error(Redis::CommandError, /\AWRONGTYPE/)
+    end
+    it "returns an error from lrange" do
+      expect {
+        redis.lrange("foo", 0, -1)
+      }.to raise_error(Redis::CommandError, /\AWRONGTYPE/)
+    end
+  end
 end
@@ -20,4 +20,69 @@ RSpec.shared_examples "pipelining" do
       expect( redis.get("bar") ).to eql("baz")
     end
   end
+
+  context "when one of the commands fails" do
+    it "still applies the commands around it, and replies in order" do
+      res_one = nil
+      res_two = nil
+      res_three = nil
+      expect {
+        redis.pipelined do
+          res_one = redis.set("foo", "1")
+          res_two = redis.lpush("foo", "a")
+          res_three = redis.incr("foo")
+        end
+      }.to raise_error(Redis::CommandError, /WRONGTYPE/)
+
+      expect( res_one.value ).to eql("OK")
+      expect( res_three.value ).to eql(2)
+      expect( redis.get("foo") ).to eql("2")
+    end
+  end
+
+  context "with a command that changes the connection" do
+    it "runs the commands after it in the new state" do
+      res_one = nil
+      res_two = nil
+      redis.pipelined do
+        redis.set("foo", "zero")
+        redis.select(1)
+        res_one = redis.set("foo", "one")
+        res_two = redis.get("foo")
+        redis.select(0)
+      end
+
+      expect( res_one.value ).to eql("OK")
+      expect( res_two.value ).to eql("one")
+      expect( redis.get("foo") ).to eql("zero")
+      redis.select(1)
+      expect( redis.get("foo") ).to eql("one")
+    end
+  end
+
+  # pgredis runs a batch in one transaction. A command that fails in postgres (rather than with an
+  # error pgredis detects first, like WRONGTYPE) aborts the transaction, unless it's rolled back to
+  # the savepoint before the command.
+  context "when a command fails in the database" do
+    before do
+      redis.set("bar", "not a number")
+    end
+    it "still applies the commands around it, and replies in order" do
+      res_one = nil
+      res_two = nil
+      res_three = nil
+      expect {
+        redis.pipelined do
+          res_one = redis.set("foo", "1")
+          res_two = redis.incr("bar")
+          res_three = redis.incr("foo")
+        end
+      }.to raise_error(Redis::CommandError)
+
+      expect( res_one.value ).to eql("OK")
+      expect( res_three.value ).to eql(2)
+      expect( redis.get("foo") ).to eql("2")
+      expect( redis.get("bar") ).to eql("not a number")
+    end
+  end
 end
@@ -0,0 +1,194 @@
+# coding: utf-8
+
+RSpec.shared_examples "pubsub" do
+  context "publish" do
+    context "with no subscribers" do
+      it "returns 0" do
+        expect(
+          redis.publish("foo", "bar")
+        ).to eql(0)
+      end
+    end
+  end
+
+  context "subscribe" do
+    it "receives messages published by another client" do
+      received = []
+      subscriber = Redis.new(url: redis.id)
+      thread = Thread.new do
+        subscriber.subscribe("foo") do |on|
+          on.message do |channel, message|
+            received << [channel, message]
+            subscriber.unsubscribe
+          end
+        end
+      end
+      sleep(0.5)
+      expect(
+        redis.publish("foo", "bar")
+      ).to eql(1)
+      thread.join(5)
+      expect(received).to eql([["foo", "bar"]])
+    end
+
+    # subscribe to channel, and collect count messages
+    def collect_messages(channel, count)
+      received = []
+      subscriber = Redis.new(url: redis.id)
+      thread = Thread.new do
+        subscriber.subscribe(channel) do |on|
+          on.message do |_, message|
+            received << message
+            subscriber.unsubscribe if received.size >= count
+          end
+        end
+      end
+      sleep(0.5)
+      yield
+      thread.join(5)
+      received
+    end
+
+    it "receives the same message published twice in a transaction" do
+      received = collect_messages("foo", 2) do
+        result = redis.multi do
+          redis.publish("foo", "bar")
+          redis.publish("foo", "bar")
+        end
+        expect(result).to eql([1, 1])
+      end
+      expect(received).to eql(["bar", "bar"])
+    end
+
+    it "receives the same message published twice in a pipeline" do
+      received = collect_messages("foo", 2) do
+        redis.pipelined do
+          redis.publish("foo", "bar")
+          redis.publish("foo", "bar")
+        end
+      end
+      expect(received).to eql(["bar", "bar"])
+    end
+
+    it "receives messages too big for a postgres notification" do
+      message = "x" * 20_000
+      received = collect_messages("foo", 1) do
+        expect(redis.publish("foo", message)).to eql(1)
+      end
+      expect(received).to eql([message])
+    end
+  end
+
+  context "psubscribe" do
+    it "receives messages published to matching channels" do
+      received = []
+      subscriber = Redis.new(url: redis.id)
+      thread = Thread.new do
+        subscriber.psubscribe("news.*") do |on|
+          on.pmessage do |pattern, channel, message|
+            received << [pattern, channel, message]
+            subscriber.punsubscribe
+          end
+        end
+      end
+      sleep(0.5)
+      redis.publish("weather", "sunny")
+      redis.publish("news.tech", "hello")
+      thread.join(5)
+      expect(received).to eql([["news.*", "news.tech", "hello"]])
+    end
+  end
+
+  context "keyspace notifications" do
+    after do
+      redis.config(:set, "notify-keyspace-events", "")
+    end
+
+    # subscribe to every keyspace and keyevent channel, and collect count messages
+    def collect_keyspace_events(count)
+      received = []
+      subscriber = Redis.new(url: redis.id)
+      thread = Thread.new do
+        subscriber.psubscribe("__key*__:*") do |on|
+          on.pmessage do |pattern, channel, message|
+            received << [channel, message]
+            subscriber.punsubscribe if received.size >= count
+          end
+        end
+      end
+      sleep(0.5)
+      yield
+      thread.join(5)
+      received
+    end
+
+    it "sets and gets the flags" do
+      expect(redis.config(:set, "notify-keyspace-events", "KEA")).to eql("OK")
+      expect(redis.config(:get, "notify-keyspace-events")).to eql("notify-keyspace-events" => "AKE")
+      expect(redis.config(:set, "notify-keyspace-events", "Kl$")).to eql("OK")
+      expect(redis.config(:get, "notify-keyspace-events")).to eql("notify-keyspace-events" => "$lK")
+    end
+
+    it "returns an error for an invalid flag" do
+      expect {
+        redis.config(:set, "notify-keyspace-events", "KEQ")
+      }.to raise_error(Redis::CommandError, /CONFIG SET failed \(possibly related to argument 'notify-keyspace-events'\) - Invalid event class character/)
+    end
+
+    it "publishes keyspace and keyevent messages for a write" do
+      redis.config(:set, "notify-keyspace-events", "KEA")
+      received = collect_keyspace_events(2) do
+        redis.set("foo", "bar")
+      end
+      expect(received).to eql([["__keyspace@0__:foo", "set"], ["__keyevent@0__:set", "foo"]])
+    end
+
+    it "only publishes the enabled classes" do
+      redis.config(:set, "notify-keyspace-events", "El")
+      received = collect_keyspace_events(2) do
+        redis.set("foo", "bar")
+        redis.rpush("list", "a")
+        redis.lpop("list")
+      end
+      expect(received).to eql([["__keyevent@0__:rpush", "list"], ["__keyevent@0__:lpop", "list"]])
+    end
+
+    it "publishes del when a list is emptied" do
+      redis.config(:set, "notify-keyspace-events", "Egl")
+      received = collect_keyspace_events(3) do
+        redis.rpush("list", "a")
+        redis.rpop("list")
+      end
+      expect(received).to eql([["__keyevent@0__:rpush", "list"], ["__keyevent@0__:rpop", "list"], ["__keyevent@0__:del", "list"]])
+    end
+
+    it "publishes an event for each write in a transaction" do
+      redis.config(:set, "notify-keyspace-events", "E$")
+      received = collect_keyspace_events(2) do
+        redis.multi do
+          redis.incr("counter")
+          redis.incr("counter")
+        end
+      end
+      expect(received).to eql([["__keyevent@0__:incrby", "counter"], ["__keyevent@0__:incrby", "counter"]])
+    end
+
+    it "publishes expired when a key expires" do
+      redis.config(:set, "notify-keyspace-events", "Ex")
+      received = collect_keyspace_events(1) do
+        redis.set("foo", "bar", px: 100)
+      end
+      expect(received).to eql([["__keyevent@0__:expired", "foo"]])
+    end
+  end
+
+  context "pubsub channels" do
+    context "with no subscribers" do
+      it "returns an empty array" do
+        expect(
+          redis.pubsub(:channels)
+        ).to eql([])
+      end
+    end
+  end
+end
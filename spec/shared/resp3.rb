@@ -0,0 +1,122 @@
+# coding: utf-8
+
+require "socket"
+require "timeout"
+require "uri"
+
+RSpec.shared_examples "resp3" do
+  # redis-rb only speaks RESP2, so these examples use a plain socket and check the raw replies
+  let(:socket) do
+    uri = URI(redis.id)
+    TCPSocket.new(uri.host, uri.port)
+  end
+
+  after do
+    socket.close
+  end
+
+  def send_command(*args)
+    socket.write("*#{args.size}\r\n" + args.map { |arg| "$#{arg.to_s.bytesize}\r\n#{arg}\r\n" }.join)
+  end
+
+  # read as many bytes as the reply we expect, so a short reply fails the example instead of hanging
+  def read_reply(expected)
+    Timeout.timeout(5) { socket.read(expected.bytesize) }
+  end
+
+  def read_until(terminator)
+    Timeout.timeout(5) do
+      result = ""
+      result << socket.read(1) until result.end_with?(terminator)
+      result
+    end
+  end
+
+  def upgrade
+    send_command("hello", "3")
+    read_until("$7\r\nmodules\r\n*0\r\n")
+  end
+
+  context "hello 3" do
+    it "replies with a map that includes the new protocol" do
+      reply = upgrade
+      expect(reply).to start_with("%7\r\n")
+      expect(reply).to include("$5\r\nproto\r\n:3\r\n")
+    end
+
+    it "returns an error for an unsupported protocol" do
+      send_command("hello", "4")
+      expected = "-NOPROTO unsupported protocol version\r\n"
+      expect(read_reply(expected)).to eql(expected)
+    end
+  end
+
+  context "after upgrading to RESP3" do
+    before do
+      upgrade
+    end
+
+    it "returns null for a missing key" do
+      send_command("get", "foo")
+      expect(read_reply("_\r\n")).to eql("_\r\n")
+    end
+
+    it "returns a map from hgetall" do
+      redis.hset("foo", "a", "1")
+      send_command("hgetall", "foo")
+      expected = "%1\r\n$1\r\na\r\n$1\r\n1\r\n"
+      expect(read_reply(expected)).to eql(expected)
+    end
+
+    it "returns a set from smembers" do
+      redis.sadd("foo", "a")
+      send_command("smembers", "foo")
+      expected = "~1\r\n$1\r\na\r\n"
+      expect(read_reply(expected)).to eql(expected)
+    end
+
+    it "returns a double from zscore" do
+      redis.zadd("foo", 1.5, "a")
+      send_command("zscore", "foo", "a")
+      expect(read_reply(",1.5\r\n")).to eql(",1.5\r\n")
+    end
+
+    it "returns pairs of members and scores from zrange withscores" do
+      redis.zadd("foo", 1.5, "a")
+      send_command("zrange", "foo", "0", "-1", "WITHSCORES")
+      expected = "*1\r\n*2\r\n$1\r\na\r\n,1.5\r\n"
+      expect(read_reply(expected)).to eql(expected)
+    end
+
+    it "sends subscription replies and messages as push messages" do
+      send_command("subscribe", "news")
+      expected = ">3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n"
+      expect(read_reply(expected)).to eql(expected)
+
+      redis.publish("news", "hello")
+      expected = ">3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nhello\r\n"
+      expect(read_reply(expected)).to eql(expected)
+    end
+
+    it "allows any command while subscribed" do
+      send_command("subscribe", "news")
+      read_reply(">3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n")
+      send_command("get", "foo")
+      expect(read_reply("_\r\n")).to eql("_\r\n")
+    end
+
+    it "sends messages while the client is blocked" do
+      send_command("subscribe", "news")
+      read_reply(">3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n")
+      send_command("brpop", "foo", "5")
+
+      redis.publish("news", "hello")
+      expected = ">3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nhello\r\n"
+      expect(read_reply(expected)).to eql(expected)
+
+      redis.rpush("foo", "a")
+      expected = "*2\r\n$3\r\nfoo\r\n$1\r\na\r\n"
+      expect(read_reply(expected)).to eql(expected)
+    end
+  end
+end
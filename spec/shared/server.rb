@@ -30,9 +30,109 @@ RSpec.shared_examples "server" do
       end
     end
     context "with an arg" do
-      it "returns just the info for that section"
+      it "returns just the info for that section" do
+        redis.set("foo", "bar")
+        result = redis.info("keyspace")
+        expect(result.keys).to eql(["db0"])
+        expect(result["db0"]).to include("keys" => "1", "expires" => "0")
+      end
+    end
+
+  end
+
+  context "flushdb" do
+    it "only removes the keys in the current database" do
+      redis.set("foo", "bar")
+      redis.select(1)
+      redis.set("foo", "baz")
+      expect(redis.flushdb).to eql("OK")
+      expect(redis.dbsize).to eql(0)
+      redis.select(0)
+      expect(redis.get("foo")).to eql("bar")
+    end
+  end
+
+  context "swapdb" do
+    it "swaps the contents of two databases" do
+      redis.set("foo", "zero")
+      redis.lpush("list", "a")
+      redis.select(1)
+      redis.set("foo", "one")
+      expect(redis.swapdb(0, 1)).to eql("OK")
+      expect(redis.get("foo")).to eql("zero")
+      expect(redis.lrange("list", 0, -1)).to eql(["a"])
+      redis.select(0)
+      expect(redis.get("foo")).to eql("one")
+      expect(redis.exists?("list")).to eql(false)
     end
 
+    it "returns an error for an invalid database" do
+      expect {
+        redis.swapdb(0, 16)
+      }.to raise_error(Redis::CommandError, "ERR DB index is out of range")
+    end
+  end
+
+  context "config" do
+    # redis and pgredis have different defaults, so put back whatever the server started with
+    before do
+      @appendfsync = redis.config(:get, "appendfsync").fetch("appendfsync")
+    end
+    after do
+      redis.config(:set, "appendfsync", @appendfsync)
+    end
+
+    it "sets and gets appendfsync" do
+      expect(redis.config(:set, "appendfsync", "always")).to eql("OK")
+      expect(redis.config(:get, "appendfsync")).to eql("appendfsync" => "always")
+      expect(redis.config(:set, "appendfsync", "everysec")).to eql("OK")
+      expect(redis.config(:get, "appendfsync")).to eql("appendfsync" => "everysec")
+    end
+
+    it "returns an error for an invalid appendfsync" do
+      expect {
+        redis.config(:set, "appendfsync", "sometimes")
+      }.to raise_error(Redis::CommandError, /CONFIG SET failed \(possibly related to argument 'appendfsync'\)/)
+    end
+
+    it "returns an error for an unknown parameter" do
+      expect {
+        redis.config(:set, "not-a-parameter", "1")
+      }.to raise_error(Redis::CommandError, /Unknown option/)
+    end
+  end
+
+  context "wait" do
+    it "returns 0 when there are no replicas" do
+      redis.set("foo", "bar")
+      expect(redis.call("wait", 0, 0)).to eql(0)
+    end
+
+    it "gives up after the timeout" do
+      redis.set("foo", "bar")
+      expect(redis.call("wait", 1, 50)).to eql(0)
+    end
+
+    it "returns an error for a negative timeout" do
+      expect {
+        redis.call("wait", 1, -1)
+      }.to raise_error(Redis::CommandError, "ERR timeout is negative")
+    end
+  end
+
+  context "shutdown" do
+    # a successful shutdown stops the server, so only the errors can be checked here
+    it "returns an error for ABORT when no shutdown is in progress" do
+      expect {
+        redis.call("shutdown", "abort")
+      }.to raise_error(Redis::CommandError, "ERR No shutdown in progress.")
+    end
+
+    it "returns an error for an unknown option" do
+      expect {
+        redis.call("shutdown", "later")
+      }.to raise_error(Redis::CommandError, "ERR syntax error")
+    end
   end
 
   context "client setname" do
@@ -43,4 +143,35 @@ RSpec.shared_examples "server" do
     end
 
   end
+
+  context "command" do
+    context "count" do
+      it "returns the number of commands" do
+        expect(redis.call("command", "count")).to be > 0
+      end
+    end
+
+    context "info" do
+      it "returns the arity, flags and key positions of a command" do
+        info = redis.call("command", "info", "get").first
+        expect(info[0..5]).to eql(["get", 2, ["readonly", "fast"], 1, 1, 1])
+      end
+
+      it "returns nil for an unknown command" do
+        expect(redis.call("command", "info", "notacommand")).to eql([nil])
+      end
+    end
+
+    context "getkeys" do
+      it "returns the keys of a command with multiple keys" do
+        expect(redis.call("command", "getkeys", "mset", "a", "1", "b", "2")).to eql(["a", "b"])
+      end
+
+      it "returns an error for a command without keys" do
+        expect {
+          redis.call("command", "getkeys", "ping")
+        }.to raise_error(Redis::CommandError, "ERR The command has no key arguments")
+      end
+    end
+  end
 end
@@ -164,4 +164,25 @@ RSpec.shared_examples "sets" do
       end
     end
   end
+
+  context "when the key holds the wrong type" do
+    before do
+      redis.set("foo", "bar")
+    end
+    it "returns an error from sadd" do
+      expect {
+        redis.sadd("foo", "aaa")
+      }.to raise_error(Redis::CommandError, /\AWRONGTYPE/)
+    end
+    it "returns an error from smembers" do
+      expect {
+        redis.smembers("foo")
+      }.to raise_error(Redis::CommandError, /\AWRONGTYPE/)
+    end
+    it "returns an error from srem" do
+      expect {
+        redis.srem("foo", "aaa")
+      }.to raise_error(Redis::CommandError, /\AWRONGTYPE/)
+    end
+  end
 end
@@ -1,6 +1,49 @@
 # coding: utf-8
 
 RSpec.shared_examples "sorted sets" do
+  context "bzpopmax" do
+    context "when no sets exist" do
+      it "returns nil" do
+        expect(
+          redis.bzpopmax(["foo", "bar"], timeout: 1)
+        ).to eql(nil)
+      end
+    end
+    context "when a set exists with two members" do
+      before do
+        redis.zadd("foo", [[1, "a"], [2, "b"]])
+      end
+      it "returns and removes the highest scoring member" do
+        expect(
+          redis.bzpopmax(["bar", "foo"], timeout: 1)
+        ).to eql(["foo", "b", 2.0])
+        expect(redis.zrange("foo", 0, -1)).to eql(["a"])
+      end
+    end
+  end
+
+  context "bzpopmin" do
+    context "when no sets exist" do
+      it "returns nil" do
+        expect(
+          redis.bzpopmin("foo", timeout: 1)
+        ).to eql(nil)
+      end
+    end
+    context "when another client adds to the set while blocked" do
+      it "returns the added member" do
+        adder = Thread.new do
+          sleep(0.5)
+          Redis.new(url: redis.id).zadd("foo", 3, "c")
+        end
+        expect(
+          redis.bzpopmin("foo", timeout: 5)
+        ).to eql(["foo", "c", 3.0])
+        adder.join
+      end
+    end
+  end
+
   context "zadd" do
     context "when the set doesn't exist" do
       it "creates the set and returns 1" do
@@ -753,4 +796,45 @@ RSpec.shared_examples "sorted sets" do
       end
     end
   end
+
+  context "zscore" do
+    context "when the member exists" do
+      before do
+        redis.zadd("foo", "1.5", "a")
+      end
+      it "returns the score" do
+        expect(
+          redis.zscore("foo", "a")
+        ).to eql(1.5)
+      end
+    end
+    context "when the member doesn't exist" do
+      it "returns nil" do
+        expect(
+          redis.zscore("foo", "a")
+        ).to be_nil
+      end
+    end
+  end
+
+  context "when the key holds the wrong type" do
+    before do
+      redis.sadd("foo", "aaa")
+    end
+    it "returns an error from zadd" do
+      expect {
+        redis.zadd("foo", 1, "aaa")
+      }.to raise_error(Redis::CommandError, /\AWRONGTYPE/)
+    end
+    it "returns an error from zrange" do
+      expect {
+        redis.zrange("foo", 0, -1)
+      }.to raise_error(Redis::CommandError, /\AWRONGTYPE/)
+    end
+    it "returns an error from zcard" do
+      expect {
+        redis.zcard("foo")
+      }.to raise_error(Redis::CommandError, /\AWRONGTYPE/)
+    end
+  end
 end
@@ -190,6 +190,12 @@ RSpec.shared_examples "strings" do
       redis.setex("foo", 2, "bar")
       expect(redis.ttl("foo")).to be_between(0, 2)
     end
+
+    it "returns an error when the expiry isn't an integer" do
+      expect {
+        redis.setex("foo", "soon", "bar")
+      }.to raise_error(Redis::CommandError, "ERR value is not an integer or out of range")
+    end
   end
 
   context "psetex" do
@@ -533,4 +539,33 @@ RSpec.shared_examples "strings" do
   context "bitop" do
     it "does stuff"
   end
+
+  context "when the key holds the wrong type" do
+    before do
+      redis.rpush("foo", "aaa")
+    end
+    it "returns an error from get" do
+      expect {
+        redis.get("foo")
+      }.to raise_error(Redis::CommandError, /\AWRONGTYPE/)
+    end
+    it "returns an error from incr" do
+      expect {
+        redis.incr("foo")
+      }.to raise_error(Redis::CommandError, /\AWRONGTYPE/)
+    end
+    it "returns an error from append" do
+      expect {
+        redis.append("foo", "bar")
+      }.to raise_error(Redis::CommandError, /\AWRONGTYPE/)
+    end
+    it "returns nil from mget" do
+      expect(redis.mget("foo")).to eql([nil])
+    end
+    it "replaces the key with set" do
+      expect(redis.set("foo", "bar")).to eql("OK")
+      expect(redis.get("foo")).to eql("bar")
+      expect(redis.type("foo")).to eql("string")
+    end
+  end
 end
@@ -37,6 +37,57 @@ RSpec.shared_examples "transactions" do
     end
   end
 
+  context "multi with a queue-time error" do
+    it "refuses to execute the transaction" do
+      redis.multi
+      expect(redis.set("foo", "1")).to eql("QUEUED")
+      expect {
+        redis.call("notacommand")
+      }.to raise_error(Redis::CommandError, /unknown command/)
+      expect {
+        redis.exec
+      }.to raise_error(Redis::CommandError, /\AEXECABORT/)
+      expect(redis.get("foo")).to be_nil
+    end
+
+    it "refuses to execute the transaction with the wrong number of arguments" do
+      redis.multi
+      expect {
+        redis.call("get")
+      }.to raise_error(Redis::CommandError, "ERR wrong number of arguments for 'get' command")
+      expect {
+        redis.exec
+      }.to raise_error(Redis::CommandError, /\AEXECABORT/)
+    end
+  end
+
+  context "multi with a runtime error" do
+    before do
+      redis.set("foo", "bar")
+    end
+    it "applies the other commands" do
+      redis.multi
+      redis.set("baz", "1")
+      redis.incr("foo")
+      redis.set("qux", "2")
+      result = redis.exec
+      expect(result[0]).to eql("OK")
+      expect(result[1]).to be_a(Redis::CommandError)
+      expect(result[2]).to eql("OK")
+      expect(redis.get("foo")).to eql("bar")
+      expect(redis.get("baz")).to eql("1")
+      expect(redis.get("qux")).to eql("2")
+    end
+  end
+
+  context "exec without multi" do
+    it "returns an error" do
+      expect {
+        redis.exec
+      }.to raise_error(Redis::CommandError, "ERR EXEC without MULTI")
+    end
+  end
+
   context "multi with discard" do
     context "when the key exists" do
       before do
@@ -50,4 +101,109 @@ RSpec.shared_examples "transactions" do
       end
     end
   end
+
+  context "watch" do
+    let(:other_client) { Redis.new(url: redis.id) }
+
+    before do
+      redis.set("foo", "1")
+    end
+
+    context "when the watched key isn't modified" do
+      it "applies the transaction" do
+        expect(redis.watch("foo")).to eql("OK")
+        result = redis.multi do
+          redis.incr("foo")
+        end
+        expect(result).to eql([2])
+        expect(redis.get("foo")).to eql("2")
+      end
+    end
+
+    context "when another client modifies the watched key" do
+      it "aborts the transaction" do
+        redis.watch("foo")
+        other_client.set("foo", "10")
+        result = redis.multi do
+          redis.incr("foo")
+        end
+        expect(result).to be_nil
+        expect(redis.get("foo")).to eql("10")
+      end
+    end
+
+    context "when another client deletes the watched key" do
+      it "aborts the transaction" do
+        redis.watch("foo")
+        other_client.del("foo")
+        result = redis.multi do
+          redis.set("foo", "2")
+        end
+        expect(result).to be_nil
+        expect(redis.get("foo")).to be_nil
+      end
+    end
+
+    context "when another client creates and deletes a watched key that didn't exist" do
+      it "aborts the transaction" do
+        redis.watch("baz")
+        other_client.set("baz", "1")
+        other_client.del("baz")
+        result = redis.multi do
+          redis.set("baz", "2")
+        end
+        expect(result).to be_nil
+        expect(redis.get("baz")).to be_nil
+      end
+    end
+
+    context "when another client adds to a watched list" do
+      it "aborts the transaction" do
+        redis.rpush("bar", "a")
+        redis.watch("bar")
+        other_client.rpush("bar", "b")
+        result = redis.multi do
+          redis.rpush("bar", "c")
+        end
+        expect(result).to be_nil
+        expect(redis.lrange("bar", 0, -1)).to eql(["a", "b"])
+      end
+    end
+
+    context "when the keys are unwatched" do
+      it "applies the transaction" do
+        redis.watch("foo")
+        other_client.set("foo", "10")
+        expect(redis.unwatch).to eql("OK")
+        result = redis.multi do
+          redis.incr("foo")
+        end
+        expect(result).to eql([11])
+      end
+    end
+
+    context "when the watch is sent inside multi" do
+      it "returns an error" do
+        redis.multi
+        expect {
+          redis.watch("foo")
+        }.to raise_error(Redis::CommandError, "ERR WATCH inside MULTI is not allowed")
+        redis.discard
+      end
+    end
+
+    context "after the transaction is executed" do
+      it "no longer watches the keys" do
+        redis.watch("foo")
+        redis.multi do
+          redis.incr("foo")
+        end
+        other_client.set("foo", "10")
+        result = redis.multi do
+          redis.incr("foo")
+        end
+        expect(result).to eql([11])
+      end
+    end
+  end
 end
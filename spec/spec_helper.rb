@@ -1,5 +1,6 @@
 require 'redis'
 
+Dir[File.dirname(__FILE__) + "/support/**/*.rb"].each {|f| require f}
 Dir[File.dirname(__FILE__) + "/shared/**/*.rb"].each {|f| require f}
 
 RSpec.configure do |config|
@@ -0,0 +1,58 @@
+require 'socket'
+require 'timeout'
+require 'tmpdir'
+
+# A pgredis server of its own, for specs that need options the shared test server doesn't use.
+# It's started from the binary the test server builds, and keeps its tables in a schema of its
+# own so it doesn't share keys with the test server.
+class PgredisProcess
+  BINARY = File.expand_path("../../bin/pgredis", __dir__)
+
+  attr_reader :pid
+
+  def initialize(schema, *args)
+    @log_path = File.join(Dir.tmpdir, "pgredis-#{schema}.log")
+    env = { "DATABASE_URL" => ENV.fetch("PGREDIS_DATABASE_URL") }
+    @pid = Process.spawn(env, BINARY, "server", "--bind", "127.0.0.1", "--schema", schema, *args.map(&:to_s),
+                         out: @log_path, err: @log_path)
+  end
+
+  # Wait until the server accepts connections on port
+  def wait_for_port(port)
+    wait_until { TCPSocket.new("127.0.0.1", port).close }
+  end
+
+  # Wait until the server accepts connections on the unix socket at path
+  def wait_for_socket(path)
+    wait_until { UNIXSocket.new(path).close }
+  end
+
+  def hup
+    Process.kill("HUP", pid)
+  end
+
+  def stop
+    Process.kill("TERM", pid)
+    Process.wait(pid)
+  rescue Errno::ESRCH, Errno::ECHILD
+    # it has already stopped
+  end
+
+  def log
+    File.exist?(@log_path) ? File.read(@log_path) : ""
+  end
+
+  private
+
+  def wait_until
+    Timeout.timeout(30) do
+      begin
+        yield
+      rescue SystemCallError
+        raise "pgredis stopped before it was ready:\n#{log}" if Process.waitpid(pid, Process::WNOHANG)
+        sleep 0.1
+        retry
+      end
+    end
+  end
+end
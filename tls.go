@@ -0,0 +1,115 @@
+package pgredis
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// The certificates for the TLS listener. They're loaded from disk on startup and again when the
+// process receives SIGHUP, so certificates can be rotated without a restart. Connections that are
+// already open keep using the certificate they were established with.
+type tlsCertificates struct {
+	mutex       sync.RWMutex
+	options     ServerOptions
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+}
+
+func newTLSCertificates(options ServerOptions) (*tlsCertificates, error) {
+	if options.TLSCertFile == "" || options.TLSKeyFile == "" {
+		return nil, errors.New("--tls-cert-file and --tls-key-file are required to listen on --tls-port")
+	}
+	if options.TLSAuthClients != "yes" && options.TLSAuthClients != "optional" && options.TLSAuthClients != "no" {
+		return nil, fmt.Errorf("--tls-auth-clients must be yes, optional or no, not '%s'", options.TLSAuthClients)
+	}
+	if options.TLSAuthClients != "no" && options.TLSCACertFile == "" {
+		return nil, errors.New("--tls-ca-cert-file is required to authenticate clients, or set --tls-auth-clients to no")
+	}
+
+	certificates := &tlsCertificates{options: options}
+	err := certificates.load()
+	if err != nil {
+		return nil, err
+	}
+	return certificates, nil
+}
+
+// Read the certificate, key and CA certificates from disk. If any of them can't be read, the
+// certificates that are already loaded are kept.
+func (certificates *tlsCertificates) load() error {
+	certificate, err := tls.LoadX509KeyPair(certificates.options.TLSCertFile, certificates.options.TLSKeyFile)
+	if err != nil {
+		return err
+	}
+
+	var clientCAs *x509.CertPool
+	if certificates.options.TLSCACertFile != "" {
+		pem, err := ioutil.ReadFile(certificates.options.TLSCACertFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", certificates.options.TLSCACertFile)
+		}
+	}
+
+	certificates.mutex.Lock()
+	defer certificates.mutex.Unlock()
+	certificates.certificate = &certificate
+	certificates.clientCAs = clientCAs
+	return nil
+}
+
+// Reload the certificates each time the process receives SIGHUP
+func (certificates *tlsCertificates) reloadOnSighup() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			err := certificates.load()
+			if err != nil {
+				log.Println("Error reloading TLS certificates, continuing with the previous ones: ", err)
+			} else {
+				log.Println("Reloaded TLS certificates")
+			}
+		}
+	}()
+}
+
+// The config for the TLS listener. Each handshake asks for a fresh config, so it always uses the
+// most recently loaded certificates.
+func (certificates *tlsCertificates) config() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			certificates.mutex.RLock()
+			defer certificates.mutex.RUnlock()
+			return &tls.Config{
+				Certificates: []tls.Certificate{*certificates.certificate},
+				ClientCAs:    certificates.clientCAs,
+				ClientAuth:   tlsClientAuthType(certificates.options.TLSAuthClients),
+				MinVersion:   tls.VersionTLS12,
+			}, nil
+		},
+	}
+}
+
+// Map the values of tls-auth-clients in redis.conf to the crypto/tls equivalent
+func tlsClientAuthType(authClients string) tls.ClientAuthType {
+	switch authClients {
+	case "no":
+		return tls.NoClientCert
+	case "optional":
+		return tls.VerifyClientCertIfGiven
+	default:
+		return tls.RequireAndVerifyClientCert
+	}
+}
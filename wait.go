@@ -0,0 +1,139 @@
+package pgredis
+
+import (
+	"time"
+)
+
+// how often WAIT and WAITAOF check on the standbys
+const WAIT_POLL_INTERVAL = 10 * time.Millisecond
+
+// WAIT numreplicas timeout, and WAITAOF numlocal numreplicas timeout.
+//
+// Redis replicas acknowledge an offset in the replication stream, and postgres standbys report the
+// WAL position they've reached in pg_stat_replication. WAIT counts the standbys that have replayed
+// the client's writes, so they'd be visible to a read from a replica. WAITAOF counts the standbys
+// that have flushed them to disk, and numlocal is the primary's own WAL flush.
+//
+// We don't look up the WAL position of every commit, as most clients never send WAIT. Instead we
+// remember that the client has written something, and WAIT uses the primary's current position,
+// which is at or after the client's last commit. Until it writes, a client has nothing to wait for.
+//
+// The standbys' positions are only visible to superusers and members of pg_monitor, and other
+// users will always see 0 replicas.
+func (redis *PgRedis) executeWaitCommand(client *redisClient, request redisRequest) bool {
+	aof := request.CommandString() == "WAITAOF"
+	args := request.argv[1:]
+
+	numLocal := 0
+	if aof {
+		value, err := parseIntArg(args[0])
+		if err != nil {
+			client.reply(newPgRedisErrorFromError(err))
+			return true
+		}
+		numLocal = value
+		args = args[1:]
+	}
+	numReplicas, err := parseIntArg(args[0])
+	if err != nil {
+		client.reply(newPgRedisErrorFromError(err))
+		return true
+	}
+	timeoutMs, err := parseIntArg(args[1])
+	if err != nil {
+		client.reply(newPgRedisErrorFromError(err))
+		return true
+	}
+	if timeoutMs < 0 {
+		client.reply(newPgRedisError("ERR timeout is negative"))
+		return true
+	}
+
+	target := "0/0"
+	if client.hasWritten {
+		err = redis.db.QueryRow("SELECT " + walName(redis.serverVersion, "pg_current_wal_insert_lsn()") + "::text").Scan(&target)
+		if err != nil {
+			client.reply(newPgRedisErrorFromError(err))
+			return true
+		}
+	}
+
+	// a timeout of 0 means wait forever, and a nil channel never receives
+	var deadline <-chan time.Time
+	if timeoutMs > 0 {
+		timer := time.NewTimer(time.Duration(timeoutMs) * time.Millisecond)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	poll := time.NewTicker(WAIT_POLL_INTERVAL)
+	defer poll.Stop()
+
+	for {
+		local, replicas, err := redis.countWalAcks(target, aof)
+		if err != nil {
+			client.reply(newPgRedisErrorFromError(err))
+			return true
+		}
+		done := local >= numLocal && replicas >= numReplicas
+
+		if !done {
+			closed, stopWatching := client.conn.watch()
+			select {
+			case <-poll.C:
+			case <-deadline:
+				done = true
+			case <-redis.shuttingDown:
+				done = true
+			case <-closed:
+				stopWatching()
+				return false
+			}
+			stopWatching()
+		}
+
+		if done {
+			if aof {
+				client.reply(newPgRedisArray([]pgRedisValue{newPgRedisInt(int64(local)), newPgRedisInt(int64(replicas))}))
+			} else {
+				client.reply(newPgRedisInt(int64(replicas)))
+			}
+			return true
+		}
+	}
+}
+
+// Count the standbys that have reached target, and whether the primary has flushed it (1 or 0).
+// WAIT counts standbys that have replayed target, and WAITAOF counts the ones that have flushed it.
+func (redis *PgRedis) countWalAcks(target string, flushed bool) (int, int, error) {
+	column := walName(redis.serverVersion, "replay_lsn")
+	if flushed {
+		column = walName(redis.serverVersion, "flush_lsn")
+	}
+	sqlStat := "SELECT " +
+		"CASE WHEN " + walName(redis.serverVersion, "pg_current_wal_flush_lsn()") + " >= $1::pg_lsn THEN 1 ELSE 0 END, " +
+		"(SELECT count(*) FROM pg_stat_replication WHERE " + column + " >= $1::pg_lsn)"
+
+	var local, replicas int
+	err := redis.db.QueryRow(sqlStat, target).Scan(&local, &replicas)
+	return local, replicas, err
+}
+
+// Postgres 10 renamed the functions and columns that mention xlog and location to wal and lsn
+var PRE_PG10_WAL_NAMES = map[string]string{
+	"pg_current_wal_insert_lsn()": "pg_current_xlog_insert_location()",
+	"pg_current_wal_flush_lsn()":  "pg_current_xlog_flush_location()",
+	"pg_last_wal_receive_lsn()":   "pg_last_xlog_receive_location()",
+	"pg_last_wal_replay_lsn()":    "pg_last_xlog_replay_location()",
+	"replay_lsn":                  "replay_location",
+	"flush_lsn":                   "flush_location",
+}
+
+// The name of a WAL function or column, for a server running serverVersion (eg. 90624)
+func walName(serverVersion int, name string) string {
+	if serverVersion < 100000 {
+		if oldName, ok := PRE_PG10_WAL_NAMES[name]; ok {
+			return oldName
+		}
+	}
+	return name
+}